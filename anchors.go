@@ -0,0 +1,146 @@
+package solvere
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var ErrInvalidTrustAnchor = errors.New("solvere: Trust anchors must be DS or DNSKEY records")
+
+// ParseTrustAnchors reads DS and DNSKEY records in zone file format from r
+func ParseTrustAnchors(r io.Reader) ([]dns.RR, error) {
+	anchors := []dns.RR{}
+	var err error
+	for t := range dns.ParseZone(r, ".", "") {
+		// keep reading until the channel is closed so the parser doesn't block
+		if err != nil {
+			continue
+		}
+		if t.Error != nil {
+			err = t.Error
+			continue
+		}
+		switch t.RR.(type) {
+		case *dns.DS, *dns.DNSKEY:
+			anchors = append(anchors, t.RR)
+		default:
+			err = ErrInvalidTrustAnchor
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return anchors, nil
+}
+
+// trustAnchorXML is the format IANA publishes the root trust anchors in, as
+// described in RFC 7958 Section 2
+type trustAnchorXML struct {
+	Zone       string `xml:"Zone"`
+	KeyDigests []struct {
+		ValidFrom  string `xml:"validFrom,attr"`
+		ValidUntil string `xml:"validUntil,attr"`
+		KeyTag     uint16 `xml:"KeyTag"`
+		Algorithm  uint8  `xml:"Algorithm"`
+		DigestType uint8  `xml:"DigestType"`
+		Digest     string `xml:"Digest"`
+	} `xml:"KeyDigest"`
+}
+
+// ParseTrustAnchorXML reads trust anchors in the XML format used by IANA for
+// the root zone trust anchors (RFC 7958) from r and returns DS records for
+// the digests that are valid at now
+func ParseTrustAnchorXML(r io.Reader, now time.Time) ([]dns.RR, error) {
+	var ta trustAnchorXML
+	err := xml.NewDecoder(r).Decode(&ta)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := dns.IsDomainName(ta.Zone); !ok || ta.Zone == "" {
+		return nil, fmt.Errorf("solvere: Invalid trust anchor zone %q", ta.Zone)
+	}
+	anchors := []dns.RR{}
+	for _, kd := range ta.KeyDigests {
+		validFrom, err := time.Parse(time.RFC3339, kd.ValidFrom)
+		if err != nil {
+			return nil, err
+		}
+		if now.Before(validFrom) {
+			continue
+		}
+		if kd.ValidUntil != "" {
+			validUntil, err := time.Parse(time.RFC3339, kd.ValidUntil)
+			if err != nil {
+				return nil, err
+			}
+			if !now.Before(validUntil) {
+				continue
+			}
+		}
+		digest := strings.TrimSpace(kd.Digest)
+		if _, err := hex.DecodeString(digest); err != nil {
+			return nil, fmt.Errorf("solvere: Invalid trust anchor digest %q", digest)
+		}
+		anchors = append(anchors, &dns.DS{
+			Hdr:        dns.RR_Header{Name: dns.Fqdn(ta.Zone), Rrtype: dns.TypeDS, Class: dns.ClassINET},
+			KeyTag:     kd.KeyTag,
+			Algorithm:  kd.Algorithm,
+			DigestType: kd.DigestType,
+			Digest:     strings.ToUpper(digest),
+		})
+	}
+	return anchors, nil
+}
+
+// AddTrustAnchors adds DS or DNSKEY records as trust anchors for the zones they
+// are owned by. Lookups for names at or below a zone with trust anchors start
+// validating at the closest one, using its anchors to validate its DNSKEY
+// RRset, and responses from the zones above it aren't validated. This means
+// the zone doesn't need to be delegated from a signed parent, or delegated at
+// all if it is reached using AddStubZone. Trust anchors for the root zone are
+// used as well as the keys passed to NewRecursiveResolver. It should be called
+// before the resolver is used.
+func (rr *RecursiveResolver) AddTrustAnchors(anchors []dns.RR) error {
+	for _, a := range anchors {
+		switch a.(type) {
+		case *dns.DS, *dns.DNSKEY:
+		default:
+			return ErrInvalidTrustAnchor
+		}
+	}
+	if rr.extraAnchors == nil {
+		rr.extraAnchors = make(map[string][]dns.RR)
+	}
+	for _, a := range anchors {
+		zone := strings.ToLower(dns.Fqdn(a.Header().Name))
+		rr.extraAnchors[zone] = append(rr.extraAnchors[zone], trustAnchorDS([]dns.RR{a})...)
+	}
+	return nil
+}
+
+// zoneAnchors returns the DS records added as trust anchors for zone
+func (rr *RecursiveResolver) zoneAnchors(zone string) []dns.RR {
+	return rr.extraAnchors[strings.ToLower(dns.Fqdn(zone))]
+}
+
+// closestTrustAnchor returns the closest zone at or above name, other than the
+// root, with trust anchors added by AddTrustAnchors along with the anchors
+func (rr *RecursiveResolver) closestTrustAnchor(name string) (string, []dns.RR) {
+	if len(rr.extraAnchors) == 0 {
+		return "", nil
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, i := range dns.Split(name) {
+		if anchors := rr.extraAnchors[name[i:]]; len(anchors) > 0 {
+			return name[i:], anchors
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,124 @@
+package solvere
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseTrustAnchors(t *testing.T) {
+	anchors, err := ParseTrustAnchors(strings.NewReader(`corp.example. 3600 IN DS 31589 8 2 CDE0D742D6998AA554A92D890F8184C698CFAC8A26FA59875A990C03E576343C
+internal. 3600 IN DNSKEY 257 3 8 AwEAAagAIKlVZrpC6Ia7gEzahOR+9W29euxhJhVVLOyQbSEW0O8gcCjF
+`))
+	if err != nil {
+		t.Fatalf("ParseTrustAnchors failed: %s", err)
+	}
+	if len(anchors) != 2 {
+		t.Fatalf("ParseTrustAnchors returned wrong number of anchors: %d", len(anchors))
+	}
+	if ds, ok := anchors[0].(*dns.DS); !ok || ds.Hdr.Name != "corp.example." || ds.KeyTag != 31589 {
+		t.Fatalf("ParseTrustAnchors returned unexpected DS record: %s", anchors[0])
+	}
+	if _, ok := anchors[1].(*dns.DNSKEY); !ok {
+		t.Fatalf("ParseTrustAnchors returned unexpected DNSKEY record: %s", anchors[1])
+	}
+
+	_, err = ParseTrustAnchors(strings.NewReader("corp.example. 3600 IN A 10.0.0.1\n"))
+	if err != ErrInvalidTrustAnchor {
+		t.Fatalf("ParseTrustAnchors didn't fail with ErrInvalidTrustAnchor: %v", err)
+	}
+	_, err = ParseTrustAnchors(strings.NewReader("corp.example. 3600 IN DS bad\n"))
+	if err == nil {
+		t.Fatal("ParseTrustAnchors didn't fail with a invalid record")
+	}
+}
+
+const rootAnchorsXML = `<?xml version="1.0" encoding="UTF-8"?>
+<TrustAnchor id="380DC50D-484E-40D0-A3AE-68F2B18F61C7" source="http://data.iana.org/root-anchors/root-anchors.xml">
+<Zone>.</Zone>
+<KeyDigest id="Kjqmt7v" validFrom="2010-07-15T00:00:00+00:00" validUntil="2019-01-11T00:00:00+00:00">
+<KeyTag>19036</KeyTag>
+<Algorithm>8</Algorithm>
+<DigestType>2</DigestType>
+<Digest>49AAC11D7B6F6446702E54A1607371607A1A41855200FD2CE1CDDE32F24E8FB5</Digest>
+</KeyDigest>
+<KeyDigest id="Klajeyz" validFrom="2017-02-02T00:00:00+00:00">
+<KeyTag>20326</KeyTag>
+<Algorithm>8</Algorithm>
+<DigestType>2</DigestType>
+<Digest>E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D</Digest>
+</KeyDigest>
+</TrustAnchor>
+`
+
+func TestParseTrustAnchorXML(t *testing.T) {
+	testCases := []struct {
+		now  time.Time
+		tags []uint16
+	}{
+		{time.Date(2009, 1, 1, 0, 0, 0, 0, time.UTC), nil},
+		{time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), []uint16{19036, 20326}},
+		{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), []uint16{20326}},
+	}
+	for _, tc := range testCases {
+		anchors, err := ParseTrustAnchorXML(strings.NewReader(rootAnchorsXML), tc.now)
+		if err != nil {
+			t.Fatalf("ParseTrustAnchorXML failed: %s", err)
+		}
+		if len(anchors) != len(tc.tags) {
+			t.Fatalf("ParseTrustAnchorXML returned %d anchors at %s, expected %d", len(anchors), tc.now, len(tc.tags))
+		}
+		for i, a := range anchors {
+			ds := a.(*dns.DS)
+			if ds.Hdr.Name != "." || ds.KeyTag != tc.tags[i] || ds.Algorithm != dns.RSASHA256 || ds.DigestType != dns.SHA256 {
+				t.Fatalf("ParseTrustAnchorXML returned unexpected DS record: %s", ds)
+			}
+		}
+	}
+
+	_, err := ParseTrustAnchorXML(strings.NewReader(strings.Replace(rootAnchorsXML, "E06D44", "ZZZZZZ", 1)), time.Now())
+	if err == nil {
+		t.Fatal("ParseTrustAnchorXML didn't fail with a invalid digest")
+	}
+}
+
+func TestAddTrustAnchors(t *testing.T) {
+	rootKey, _ := newRootKey(dns.ZONE | dns.SEP)
+	rr := &RecursiveResolver{rootAnchor: trustAnchorDS([]dns.RR{rootKey})}
+
+	err := rr.AddTrustAnchors([]dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "corp.example.", Rrtype: dns.TypeA}}})
+	if err != ErrInvalidTrustAnchor {
+		t.Fatalf("AddTrustAnchors didn't fail with ErrInvalidTrustAnchor: %v", err)
+	}
+
+	corpKey, _ := newTestKey("Corp.Example.", dns.ZONE|dns.SEP)
+	extraRootKey, _ := newRootKey(dns.ZONE | dns.SEP)
+	err = rr.AddTrustAnchors([]dns.RR{corpKey, extraRootKey})
+	if err != nil {
+		t.Fatalf("AddTrustAnchors failed: %s", err)
+	}
+	anchors := rr.zoneAnchors("corp.example.")
+	if len(anchors) != 1 || anchors[0].(*dns.DS).KeyTag != corpKey.KeyTag() {
+		t.Fatalf("Unexpected trust anchors for corp.example.: %v", anchors)
+	}
+	if anchors := rr.zoneAnchors("example."); len(anchors) != 0 {
+		t.Fatalf("Unexpected trust anchors for example.: %v", anchors)
+	}
+	if anchors := rr.rootAnchors(); len(anchors) != 2 || len(rr.rootAnchor) != 1 {
+		t.Fatalf("Root trust anchors weren't combined: %v", anchors)
+	}
+
+	// validation starts at the closest anchored zone
+	rr.useDNSSEC = true
+	if zone, _ := rr.closestTrustAnchor("www.dev.corp.example."); zone != "corp.example." {
+		t.Fatalf("closestTrustAnchor returned %q, expected corp.example.", zone)
+	}
+	if state, ds := rr.initialSecurity(&Question{Name: "www.Corp.Example."}); state.status != Secure || state.zone != "corp.example." || len(ds) != 1 {
+		t.Fatalf("initialSecurity returned %s at %q with %d DS records, expected Secure at corp.example.", state.status, state.zone, len(ds))
+	}
+	if state, _ := rr.initialSecurity(&Question{Name: "www.example."}); state.zone != "." {
+		t.Fatalf("initialSecurity returned %s at %q, expected the root", state.status, state.zone)
+	}
+}
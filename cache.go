@@ -2,8 +2,9 @@ package solvere
 
 import (
 	"crypto/sha1"
-	"math"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -11,8 +12,16 @@ import (
 	"github.com/jmhodges/clock"
 )
 
+// hashQuestion returns the key a question is cached under. Names are compared
+// case insensitively (RFC 4343) and answers that weren't validated because
+// checking was disabled are kept separately from those that were.
 func hashQuestion(q *Question) [sha1.Size]byte {
-	inp := append([]byte{uint8(q.Type & 0xff), uint8(q.Type >> 8)}, []byte(q.Name)...)
+	class := q.class()
+	var cd uint8
+	if q.CheckingDisabled {
+		cd = 1
+	}
+	inp := append([]byte{uint8(q.Type & 0xff), uint8(q.Type >> 8), uint8(class & 0xff), uint8(class >> 8), cd}, []byte(strings.ToLower(dns.Fqdn(q.Name)))...)
 	return sha1.Sum(inp)
 }
 
@@ -21,36 +30,46 @@ const (
 )
 
 func minTTL(a []dns.RR, clk clock.Clock) int {
-	var min *uint32
+	min := -1
+	now := clk.Now()
 	for _, r := range a {
-		if min == nil {
-			min = &r.Header().Ttl
-			continue
-		}
-		if r.Header().Ttl < *min {
-			min = &r.Header().Ttl
-		}
-		if r.Header().Rrtype == dns.TypeRRSIG {
+		ttl := int64(r.Header().Ttl)
+		if sig, ok := r.(*dns.RRSIG); ok {
 			// if expiration is lower than Ttl then use that instead so we always
 			// use fresh signatures
-			rr := r.(*dns.RRSIG)
-			n := clk.Now().UTC().Unix()
-			mod := (int64(rr.Expiration) - n) / year68
-			t := int64(rr.Expiration) + (mod * year68)
-			expiresIn := (t - n) / 1000000000 // convert to seconds
-			if expiresIn > 0 && expiresIn < math.MaxUint32 && uint32(expiresIn) < *min {
-				uei := uint32(expiresIn)
-				min = &uei
+			expiresIn := int64(sigTime(sig.Expiration, now).Sub(now) / time.Second)
+			if expiresIn < 0 {
+				expiresIn = 0
 			}
+			if expiresIn < ttl {
+				ttl = expiresIn
+			}
+		}
+		if min == -1 || ttl < int64(min) {
+			min = int(ttl)
 		}
 	}
-	if min == nil {
+	if min == -1 {
 		return 0
 	}
-	return int(*min)
+	return min
+}
+
+// signaturesExpired returns true if any of the signatures in answer have
+// expired
+func signaturesExpired(answer *Answer, now time.Time) bool {
+	for _, section := range [][]dns.RR{answer.Answer, answer.Authority, answer.Additional} {
+		for _, r := range section {
+			if sig, ok := r.(*dns.RRSIG); ok && now.After(sigTime(sig.Expiration, now)) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 type cacheEntry struct {
+	q        Question
 	answer   *Answer
 	ttl      int
 	modified time.Time
@@ -76,34 +95,181 @@ func (ce *cacheEntry) expired(clk clock.Clock) bool {
 	return clk.Now().After(ce.modified.Add(time.Second * time.Duration(ce.ttl)))
 }
 
+// agedRecords returns copies of rrs with their TTLs reduced by elapsed seconds
+func agedRecords(rrs []dns.RR, elapsed uint32) []dns.RR {
+	if rrs == nil {
+		return nil
+	}
+	aged := make([]dns.RR, len(rrs))
+	for i, r := range rrs {
+		aged[i] = dns.Copy(r)
+		// the TTL field of a OPT record holds flags rather than a TTL
+		if hdr := aged[i].Header(); hdr.Rrtype != dns.TypeOPT {
+			if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return aged
+}
+
+// agedAnswer returns a copy of a answer that was cached at cached with the TTLs
+// of its records reduced by the time it has spent in the cache. Callers get
+// their own records, which they can't use to modify the cached answer, with
+// TTLs that stop downstream caches keeping them for longer than they should.
+// Answers kept forever don't expire so their TTLs are left as they are.
+func agedAnswer(answer *Answer, cached, now time.Time, forever bool) *Answer {
+	var elapsed uint32
+	if !forever && now.After(cached) {
+		elapsed = uint32(now.Sub(cached) / time.Second)
+	}
+	aged := *answer
+	aged.Answer = agedRecords(answer.Answer, elapsed)
+	aged.Authority = agedRecords(answer.Authority, elapsed)
+	aged.Additional = agedRecords(answer.Additional, elapsed)
+	aged.Chain = agedRecords(answer.Chain, elapsed)
+	return &aged
+}
+
+// cached returns a aged copy of the answer
+func (ce *cacheEntry) cached(now time.Time) *Answer {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	return agedAnswer(ce.answer, ce.modified, now, ce.forever)
+}
+
+// entry returns a aged copy of the answer and when it expires
+func (ce *cacheEntry) entry(now time.Time) CacheEntry {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	e := CacheEntry{Question: ce.q, Answer: agedAnswer(ce.answer, ce.modified, now, ce.forever), Forever: ce.forever}
+	if !ce.forever {
+		e.Expires = ce.modified.Add(time.Second * time.Duration(ce.ttl))
+	}
+	return e
+}
+
 // QuestionAnswerCache is used to cache responses to queries. The internal implementation
-// can be bypassed using this interface.
+// can be bypassed using this interface. Answers added to be kept forever are
+// only replaced by other answers added to be kept forever.
 type QuestionAnswerCache interface {
 	Get(q *Question) *Answer
 	Add(q *Question, answer *Answer, forever bool)
 }
 
+// CacheOptions configures the caches returned by NewBasicCacheWithOptions,
+// NewLRUCacheWithOptions and NewShardedCacheWithOptions, fields a cache
+// doesn't use are ignored
+type CacheOptions struct {
+	// Clock is used to expire answers and to schedule pruning, if nil the
+	// system clock is used
+	Clock clock.Clock
+	// PruneInterval is how often expired answers are removed in the
+	// background, if 0 the cache's default is used and if negative expired
+	// answers are only removed when they are looked up
+	PruneInterval time.Duration
+	// MaxEntries and MaxBytes limit the size of a LRUCache, a limit of 0
+	// disables it, and Eviction decides which answers are evicted when it is
+	// full
+	MaxEntries int
+	MaxBytes   int
+	Eviction   EvictionPolicy
+	// Shards is the number of shards used by a ShardedCache
+	Shards int
+	// TTLs is used to clamp the TTLs of answers added to the cache
+	TTLs *TTLPolicy
+}
+
+func (o CacheOptions) clock() clock.Clock {
+	if o.Clock == nil {
+		return clock.Default()
+	}
+	return o.Clock
+}
+
+func (o CacheOptions) pruneInterval(def time.Duration) time.Duration {
+	if o.PruneInterval == 0 {
+		return def
+	}
+	return o.PruneInterval
+}
+
+// pruner calls prune every interval in the background until it is closed
+type pruner struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func startPruner(interval time.Duration, clk clock.Clock, prune func()) *pruner {
+	p := &pruner{stop: make(chan struct{}), done: make(chan struct{})}
+	if interval < 0 {
+		close(p.done)
+		return p
+	}
+	// the timer is created before returning so it is scheduled from when the
+	// cache was created rather than when the goroutine starts
+	t := clk.NewTimer(interval)
+	go func() {
+		defer close(p.done)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				prune()
+				t.Reset(interval)
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// close stops the pruner and waits for it to exit, it is safe to call more
+// than once
+func (p *pruner) close() {
+	if p == nil {
+		return
+	}
+	p.once.Do(func() { close(p.stop) })
+	<-p.done
+}
+
 // BasicCache is a basic implementation of the QuestionAnswerCache interface
 type BasicCache struct {
-	mu    sync.RWMutex
-	cache map[[sha1.Size]byte]*cacheEntry
-	clk   clock.Clock
+	counters cacheCounters
+	mu       sync.RWMutex
+	cache    map[[sha1.Size]byte]*cacheEntry
+	clk      clock.Clock
+	ttls     *TTLPolicy
+	pruner   *pruner
 }
 
 var defaultPruneInterval = time.Minute
 
 // NewBasicCache returns an initialized BasicCache
 func NewBasicCache() *BasicCache {
-	bc := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: clock.Default()}
-	go func() {
-		t := time.NewTicker(defaultPruneInterval)
-		for range t.C {
-			bc.fullPrune()
-		}
-	}()
+	return NewBasicCacheWithOptions(CacheOptions{})
+}
+
+// NewBasicCacheWithOptions returns an initialized BasicCache configured by
+// opts, BasicCache isn't bounded so the size options are ignored. Close should
+// be called once the cache is no longer needed to stop pruning it.
+func NewBasicCacheWithOptions(opts CacheOptions) *BasicCache {
+	bc := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: opts.clock(), ttls: opts.TTLs}
+	bc.pruner = startPruner(opts.pruneInterval(defaultPruneInterval), bc.clk, bc.fullPrune)
 	return bc
 }
 
+// Close stops the removal of expired answers in the background, the cache can
+// still be used afterwards
+func (bc *BasicCache) Close() {
+	bc.pruner.close()
+}
+
 func (bc *BasicCache) del(id [sha1.Size]byte) {
 	bc.mu.Lock()
 	defer bc.mu.Unlock()
@@ -122,26 +288,51 @@ func (bc *BasicCache) fullPrune() {
 	for _, id := range ids {
 		bc.del(id)
 	}
+	atomic.AddUint64(&bc.counters.expired, uint64(len(ids)))
+}
+
+// SetTTLPolicy sets the policy used to clamp the TTLs of answers added to the
+// cache. It should be called before the cache is used.
+func (bc *BasicCache) SetTTLPolicy(policy *TTLPolicy) {
+	bc.ttls = policy
 }
 
-// Add adds a response to the cache using a index based on the question
+// Add adds a response to the cache using a index based on the question, with
+// the TTLs of its records clamped by the cache's TTLPolicy
 func (bc *BasicCache) Add(q *Question, answer *Answer, forever bool) {
-	id := hashQuestion(q)
 	var ttl int
 	if !forever {
+		var clamped bool
+		answer, clamped = bc.ttls.clamp(q, answer)
 		ttl = minTTL(append(answer.Answer, append(answer.Additional, answer.Authority...)...), bc.clk)
 		if ttl == 0 {
 			return
 		}
+		if clamped {
+			atomic.AddUint64(&bc.counters.clamped, 1)
+		}
 	}
+	bc.add(q, answer, ttl, forever)
+}
+
+func (bc *BasicCache) add(q *Question, answer *Answer, ttl int, forever bool) {
+	id := hashQuestion(q)
 	// should filter out OPT records here
 	bc.mu.Lock()
 	defer bc.mu.Unlock()
-	if _, present := bc.cache[id]; present {
-		bc.cache[id].update(answer, ttl, bc.clk)
-		return
+	if e, present := bc.cache[id]; present {
+		if e.forever && !forever {
+			// answers kept forever are only replaced by other answers kept
+			// forever
+			return
+		}
+		if e.forever == forever {
+			e.update(answer, ttl, bc.clk)
+			return
+		}
 	}
 	bc.cache[id] = &cacheEntry{
+		*q,
 		answer,
 		ttl,
 		bc.clk.Now(),
@@ -162,16 +353,35 @@ func (bc *BasicCache) getEntry(q *Question) (*cacheEntry, bool) {
 	return entry, present
 }
 
-// Get returns the response for a question if it exists in the cache
+// Get returns a copy of the response for a question if it exists in the cache,
+// with TTLs reduced by the time it has been cached. Secure answers are removed
+// once any of their signatures expire, even if the TTL hasn't, so they will be
+// looked up and validated again.
 func (bc *BasicCache) Get(q *Question) *Answer {
 	if entry, present := bc.getEntry(q); present {
-		if entry.expired(bc.clk) {
+		now := bc.clk.Now()
+		answer := entry.cached(now)
+		if entry.expired(bc.clk) || (answer.Security == Secure && signaturesExpired(answer, now)) {
 			bc.del(hashQuestion(q))
+			atomic.AddUint64(&bc.counters.expired, 1)
+			atomic.AddUint64(&bc.counters.misses, 1)
 			return nil
 		}
-		entry.mu.Lock()
-		defer entry.mu.Unlock()
-		return entry.answer
+		atomic.AddUint64(&bc.counters.hits, 1)
+		return answer
 	}
+	atomic.AddUint64(&bc.counters.misses, 1)
 	return nil
 }
+
+// Entries returns copies of the unexpired answers in the cache
+func (bc *BasicCache) Entries() []CacheEntry {
+	return bc.List(".", true)
+}
+
+// Restore adds a answer returned by Entries unless it has expired
+func (bc *BasicCache) Restore(entry CacheEntry) {
+	if ttl, ok := restoreTTL(entry, bc.clk); ok {
+		bc.add(&entry.Question, entry.Answer, ttl, entry.Forever)
+	}
+}
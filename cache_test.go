@@ -2,6 +2,8 @@ package solvere
 
 import (
 	"crypto/sha1"
+	"fmt"
+	"math"
 	"net"
 	"testing"
 	"time"
@@ -26,7 +28,9 @@ func TestMinTTL(t *testing.T) {
 	}
 
 	fc := clock.NewFake()
-	n := time.Now().Add(time.Second).UTC().Unix()
+	now := time.Unix(time.Now().Unix(), 0)
+	fc.Set(now)
+	n := now.Add(time.Second).UTC().Unix()
 	mod := (n / year68) - 1
 	if mod < 0 {
 		mod = 0
@@ -42,9 +46,48 @@ func TestMinTTL(t *testing.T) {
 	}
 }
 
+// sameAnswer returns true if a and b contain the same records ignoring their
+// TTLs
+func sameAnswer(a, b *Answer) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	key := func(a *Answer) string {
+		rrs := append(append(append([]dns.RR{}, a.Answer...), a.Authority...), a.Additional...)
+		k := fmt.Sprintf("%d %s\n", a.Rcode, a.Security)
+		for _, r := range agedRecords(rrs, math.MaxUint32) {
+			k += r.String() + "\n"
+		}
+		return k
+	}
+	return key(a) == key(b)
+}
+
+func TestHashQuestion(t *testing.T) {
+	q := Question{Name: "example.com.", Type: dns.TypeA}
+	testCases := []struct {
+		q    Question
+		same bool
+	}{
+		{Question{Name: "Example.COM.", Type: dns.TypeA}, true},
+		{Question{Name: "example.com", Type: dns.TypeA}, true},
+		{Question{Name: "example.com.", Type: dns.TypeA, Class: dns.ClassINET}, true},
+		{Question{Name: "example.com.", Type: dns.TypeAAAA}, false},
+		{Question{Name: "example.com.", Type: dns.TypeA, Class: dns.ClassCHAOS}, false},
+		{Question{Name: "example.com.", Type: dns.TypeA, CheckingDisabled: true}, false},
+		{Question{Name: "example.net.", Type: dns.TypeA}, false},
+	}
+	for _, tc := range testCases {
+		if same := hashQuestion(&tc.q) == hashQuestion(&q); same != tc.same {
+			t.Fatalf("hashQuestion(%+v) matching hashQuestion(%+v) was %t, expected %t", tc.q, q, same, tc.same)
+		}
+	}
+}
+
 func TestCache(t *testing.T) {
 	fc := clock.NewFake()
-	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc}
+	cache := NewBasicCacheWithOptions(CacheOptions{Clock: fc, PruneInterval: -1})
+	defer cache.Close()
 
 	q := Question{Name: "testing", Type: dns.TypeA}
 	ca := cache.Get(&q)
@@ -55,7 +98,7 @@ func TestCache(t *testing.T) {
 	a := Answer{Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Ttl: 5}, A: net.IP{1, 2, 3, 4}}}}
 	cache.Add(&q, &a, true)
 	ca = cache.Get(&q)
-	if ca != &a {
+	if !sameAnswer(ca, &a) {
 		t.Fatalf("Cache returned incorrect answer: expected %#v, got %#v", a, ca)
 	}
 	fc.Add(time.Second * 30)
@@ -68,7 +111,7 @@ func TestCache(t *testing.T) {
 	q = Question{Name: "testing-2", Type: dns.TypeA}
 	cache.Add(&q, &a, false)
 	ca = cache.Get(&q)
-	if ca != &a {
+	if !sameAnswer(ca, &a) {
 		t.Fatalf("Cache returned incorrect answer: expected %#v, got %#v", a, ca)
 	}
 	fc.Add(time.Second * 30)
@@ -105,3 +148,153 @@ func TestCache(t *testing.T) {
 	}
 
 }
+
+func TestCacheExpiredSignatures(t *testing.T) {
+	fc := clock.NewFake()
+	fc.Set(time.Unix(time.Now().Unix(), 0))
+	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc}
+
+	q := Question{Name: "testing", Type: dns.TypeA}
+	a := Answer{
+		Answer: []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Ttl: 3600}, A: net.IP{1, 2, 3, 4}},
+			&dns.RRSIG{Hdr: dns.RR_Header{Ttl: 3600}, Expiration: uint32(fc.Now().Add(time.Minute).Unix())},
+		},
+		Security: Secure,
+	}
+	cache.Add(&q, &a, true)
+	if cache.Get(&q) == nil {
+		t.Fatal("Cache didn't return answer with valid signatures")
+	}
+	fc.Add(2 * time.Minute)
+	if ca := cache.Get(&q); ca != nil {
+		t.Fatalf("Cache returned Secure answer with expired signatures: %#v", ca)
+	}
+
+	// Answers that weren't validated aren't affected
+	a.Security = Insecure
+	cache.Add(&q, &a, true)
+	if cache.Get(&q) == nil {
+		t.Fatal("Cache didn't return Insecure answer with expired signatures")
+	}
+}
+
+// testCache is implemented by every type of cache
+type testCache interface {
+	ManagedCache
+	PersistentCache
+	Close()
+}
+
+// testCaches creates each type of cache with the given options, for tests that
+// every type of cache should pass
+var testCaches = map[string]func(CacheOptions) testCache{
+	"BasicCache":   func(opts CacheOptions) testCache { return NewBasicCacheWithOptions(opts) },
+	"LRUCache":     func(opts CacheOptions) testCache { return NewLRUCacheWithOptions(opts) },
+	"ShardedCache": func(opts CacheOptions) testCache { return NewShardedCacheWithOptions(opts) },
+}
+
+func TestCacheAgedAnswers(t *testing.T) {
+	for name, newCache := range testCaches {
+		fc := clock.NewFake()
+		cache := newCache(CacheOptions{Clock: fc, PruneInterval: -1})
+		q := Question{Name: "testing", Type: dns.TypeA}
+		opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetDo()
+		a := &Answer{
+			Answer:     []dns.RR{&dns.A{Hdr: dns.RR_Header{Ttl: 300}, A: net.IP{1, 2, 3, 4}}},
+			Authority:  []dns.RR{&dns.NS{Hdr: dns.RR_Header{Ttl: 30}, Ns: "ns.testing."}},
+			Additional: []dns.RR{opt},
+		}
+		cache.Add(&q, a, false)
+		fc.Add(time.Second * 10)
+
+		ca := cache.Get(&q)
+		if ca == nil {
+			t.Fatalf("%s: Cache didn't return answer", name)
+		}
+		if ttl := ca.Answer[0].Header().Ttl; ttl != 290 {
+			t.Fatalf("%s: Cache returned answer with TTL %d, expected 290", name, ttl)
+		}
+		if ttl := ca.Authority[0].Header().Ttl; ttl != 20 {
+			t.Fatalf("%s: Cache returned authority with TTL %d, expected 20", name, ttl)
+		}
+		if !ca.Additional[0].(*dns.OPT).Do() {
+			t.Fatalf("%s: Cache modified the flags of a OPT record", name)
+		}
+		if a.Answer[0].Header().Ttl != 300 {
+			t.Fatalf("%s: Cache modified the TTL of the cached record", name)
+		}
+
+		// callers can't modify the cached records
+		ca.Answer[0].(*dns.A).A = net.IP{5, 6, 7, 8}
+		ca.Answer = nil
+		if ca = cache.Get(&q); len(ca.Answer) != 1 || !ca.Answer[0].(*dns.A).A.Equal(net.IP{1, 2, 3, 4}) {
+			t.Fatalf("%s: Modifying a returned answer modified the cached answer", name)
+		}
+
+		// answers kept forever keep their TTLs
+		q = Question{Name: "pinned", Type: dns.TypeA}
+		cache.Add(&q, a, true)
+		fc.Add(time.Hour)
+		if ca = cache.Get(&q); ca == nil || ca.Answer[0].Header().Ttl != 300 {
+			t.Fatalf("%s: Cache modified the TTLs of a answer kept forever: %v", name, ca)
+		}
+
+		// answers kept forever aren't replaced by answers that expire
+		cache.Add(&q, &Answer{Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Ttl: 60}, A: net.IP{5, 6, 7, 8}}}}, false)
+		fc.Add(time.Hour)
+		if ca = cache.Get(&q); ca == nil || !ca.Answer[0].(*dns.A).A.Equal(net.IP{1, 2, 3, 4}) {
+			t.Fatalf("%s: Cache replaced a answer kept forever: %v", name, ca)
+		}
+	}
+}
+
+func TestCachePruning(t *testing.T) {
+	for name, newCache := range testCaches {
+		fc := clock.NewFake()
+		cache := newCache(CacheOptions{Clock: fc, PruneInterval: time.Minute, MaxEntries: 10})
+		cache.Add(&Question{Name: "testing.", Type: dns.TypeA}, lruAnswer(30), false)
+
+		// the fake clock fires the prune timer but the prune itself happens in
+		// the background
+		fc.Add(time.Minute)
+		deadline := time.Now().Add(5 * time.Second)
+		for cache.Stats().Expired != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: expired answer wasn't pruned in the background", name)
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		cache.Close()
+		cache.Close()
+		var p *pruner
+		switch c := cache.(type) {
+		case *BasicCache:
+			p = c.pruner
+		case *LRUCache:
+			p = c.pruner
+		case *ShardedCache:
+			p = c.pruner
+		}
+		select {
+		case <-p.done:
+		default:
+			t.Fatalf("%s: Close didn't stop pruning", name)
+		}
+
+		// the cache can still be used once it is closed
+		cache.Add(&Question{Name: "testing.", Type: dns.TypeA}, lruAnswer(30), false)
+		if cache.Get(&Question{Name: "testing.", Type: dns.TypeA}) == nil {
+			t.Fatalf("%s: closed cache didn't return answer", name)
+		}
+	}
+
+	cache := NewShardedCacheWithOptions(CacheOptions{PruneInterval: -1})
+	select {
+	case <-cache.pruner.done:
+	default:
+		t.Fatal("cache with a negative prune interval started pruning")
+	}
+}
@@ -0,0 +1,329 @@
+package solvere
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	ErrChainIncomplete   = errors.New("solvere: Chain doesn't contain the records needed to validate the answer")
+	ErrChainTooManyHops  = errors.New("solvere: Chain contains too many aliases")
+	ErrInvalidChainData  = errors.New("solvere: Malformed DNSSEC chain extension data")
+	ErrTrailingChainData = errors.New("solvere: DNSSEC chain extension data contains trailing bytes")
+	ErrChainTooLarge     = errors.New("solvere: Chain is too large for the DNSSEC chain extension")
+)
+
+// maxChainAliases is the maximum number of CNAME records that will be followed
+// when validating a chain
+const maxChainAliases = 8
+
+// ValidateChain validates the answer to q using only the records in rrs, the
+// DNSKEY, DS, RRSIG, NSEC and NSEC3 records that make up the chain from the
+// closest of anchors (DS or DNSKEY records) enclosing q.Name, along with the
+// answer itself or signed proof that it doesn't exist. Signatures are checked
+// against now and no queries are made. CNAME records at the name are followed
+// if they are in rrs. If no anchor encloses the name Indeterminate is returned,
+// if validation fails Bogus is returned with the reason.
+func ValidateChain(q Question, rrs []dns.RR, anchors []dns.RR, now time.Time) (SecurityStatus, error) {
+	// validation caps TTLs so the callers records are left alone
+	chain := make([]dns.RR, len(rrs))
+	for i, r := range rrs {
+		chain[i] = dns.Copy(r)
+		chain[i].Header().Name = strings.ToLower(r.Header().Name)
+	}
+	state := securityState{status: Secure}
+	name := strings.ToLower(dns.Fqdn(q.Name))
+	for i := 0; i < maxChainAliases; i++ {
+		status, target, err := validateChainName(chain, name, q.Type, anchors, now)
+		if err != nil {
+			return Bogus, err
+		}
+		state = state.worse(securityState{status: status})
+		if target == "" || status != Secure {
+			return state.status, nil
+		}
+		name = target
+	}
+	return Bogus, ErrChainTooManyHops
+}
+
+// closestAnchor returns the anchors owned by the closest name at or above name
+func closestAnchor(anchors []dns.RR, name string) (string, []dns.RR) {
+	zone := ""
+	closest := []dns.RR{}
+	for _, a := range anchors {
+		owner := strings.ToLower(a.Header().Name)
+		if !isSubDomain(owner, name) || (zone != "" && dns.CountLabel(owner) < dns.CountLabel(zone)) {
+			continue
+		}
+		if owner != zone {
+			zone, closest = owner, []dns.RR{}
+		}
+		closest = append(closest, a)
+	}
+	return zone, closest
+}
+
+// validateChainName follows the chain from the closest trust anchor down to the
+// zone that signed the answer for name, returning the target of a validated
+// CNAME if there is one
+func validateChainName(rrs []dns.RR, name string, qtype uint16, anchors []dns.RR, now time.Time) (SecurityStatus, string, error) {
+	zone, zoneAnchors := closestAnchor(anchors, name)
+	if zone == "" {
+		return Indeterminate, "", nil
+	}
+	var policy *AlgorithmPolicy
+	dsSet := policy.usableDS(trustAnchorDS(zoneAnchors))
+	if len(dsSet) == 0 {
+		return Indeterminate, "", nil
+	}
+	for {
+		v := &validator{now: now}
+		keys := extractRRSet(rrs, zone, dns.TypeDNSKEY)
+		keyMap := zoneKeys(keys)
+		if len(keyMap) == 0 {
+			return Bogus, "", ErrNoDNSKEY
+		}
+		sepKeys, err := checkDS(keyMap, dsSet)
+		if err != nil {
+			return Bogus, "", err
+		}
+		_, err = v.verifyDNSKEYSet(append(keys, signedBy(rrs, zone, keys)...), zone, sepKeys)
+		if err != nil {
+			return Bogus, "", err
+		}
+
+		child := chainChild(rrs, zone, name, qtype)
+		if child == "" {
+			return v.validateChainAnswer(rrs, zone, name, qtype, keyMap)
+		}
+		ds := extractRRSet(rrs, child, dns.TypeDS)
+		err = v.verifyRRSIG(&dns.Msg{Answer: append(ds, signedBy(rrs, zone, ds)...)}, keyMap)
+		if err != nil {
+			return Bogus, "", err
+		}
+		dsSet = policy.usableDS(ds)
+		if len(dsSet) == 0 {
+			return Insecure, "", nil
+		}
+		zone = child
+	}
+}
+
+// chainChild returns the zone closest to zone on the way to name that there
+// are DS records for in rrs. If the answer is the DS RRset for name it belongs
+// to the parent so name itself isn't considered.
+func chainChild(rrs []dns.RR, zone, name string, qtype uint16) string {
+	child := ""
+	for _, r := range extractRRSet(rrs, "", dns.TypeDS) {
+		owner := r.Header().Name
+		if owner == zone || (owner == name && qtype == dns.TypeDS) || !isSubDomain(zone, owner) || !isSubDomain(owner, name) {
+			continue
+		}
+		if child == "" || dns.CountLabel(owner) < dns.CountLabel(child) {
+			child = owner
+		}
+	}
+	return child
+}
+
+// signedBy returns the RRSIG records in rrs created by zone that cover the
+// RRsets in records
+func signedBy(rrs []dns.RR, zone string, records []dns.RR) []dns.RR {
+	sets := map[string]struct{}{}
+	for _, r := range records {
+		sets[rrsetKey(r.Header().Name, r.Header().Rrtype)] = struct{}{}
+	}
+	sigs := []dns.RR{}
+	for _, r := range extractRRSet(rrs, "", dns.TypeRRSIG) {
+		sig := r.(*dns.RRSIG)
+		if _, present := sets[rrsetKey(sig.Hdr.Name, sig.TypeCovered)]; present && strings.EqualFold(sig.SignerName, zone) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// delegationsBetween returns the names below zone down to and including name,
+// the possible zone cuts between them
+func delegationsBetween(zone, name string) []string {
+	names := []string{}
+	if zone == name {
+		return names
+	}
+	for n := nextCloser(name, zone); ; n = nextCloser(name, n) {
+		names = append(names, n)
+		if n == name {
+			return names
+		}
+	}
+}
+
+// validateChainAnswer validates the answer for name using the keys of zone, the
+// last zone in the chain. If the answer isn't in rrs there must be proof it
+// doesn't exist or that there is a unsigned delegation on the way to it.
+func (v *validator) validateChainAnswer(rrs []dns.RR, zone, name string, qtype uint16, keyMap map[uint16][]*dns.DNSKEY) (SecurityStatus, string, error) {
+	denial := extractDenial(rrs)
+	sigs := signedBy(rrs, zone, denial)
+	denial = signedOnly(sigs, denial)
+	if len(denial) > 0 {
+		if err := v.verifyRRSIG(&dns.Msg{Ns: append(denial, sigs...)}, keyMap); err != nil {
+			return Bogus, "", err
+		}
+	}
+
+	target := ""
+	answer := extractRRSet(rrs, name, qtype)
+	if len(answer) == 0 && qtype != dns.TypeCNAME {
+		answer = extractRRSet(rrs, name, dns.TypeCNAME)
+		if len(answer) > 0 {
+			target = strings.ToLower(answer[0].(*dns.CNAME).Target)
+		}
+	}
+	if sigs := signedBy(rrs, zone, answer); len(answer) > 0 && len(sigs) > 0 {
+		if err := v.verifyRRSIG(&dns.Msg{Answer: append(answer, sigs...)}, keyMap); err != nil {
+			return Bogus, "", err
+		}
+		if err := v.verifyWildcards(append(answer, sigs...), denial); err != nil {
+			return Bogus, "", err
+		}
+		return Secure, target, nil
+	}
+	if len(denial) == 0 {
+		return Bogus, "", ErrChainIncomplete
+	}
+
+	// a unsigned delegation has to be ruled out before the denial is trusted
+	// since the parent's NSEC records can appear to prove names below it
+	// don't exist
+	for _, d := range delegationsBetween(zone, name) {
+		if d == name && qtype == dns.TypeDS {
+			break
+		}
+		err := v.verifyDelegation(d, denial)
+		if err == nil || err == errInsecureNSEC3Iterations {
+			return Insecure, "", nil
+		} else if err == ErrTooManyNSEC3Hashes || err == ErrNSEC3Iterations {
+			return Bogus, "", err
+		}
+	}
+	q := &Question{Name: name, Type: qtype}
+	err := v.verifyNODATA(q, denial)
+	if err != nil && err != errInsecureNSEC3Iterations {
+		err = v.verifyNameError(q, denial)
+	}
+	switch err {
+	case nil:
+		return Secure, "", nil
+	case errInsecureNSEC3Iterations:
+		return Insecure, "", nil
+	}
+	return Bogus, "", err
+}
+
+// ParseDNSSECChain parses the extension data of the TLS DNSSEC chain extension
+// (RFC 9102 Section 2), returning the extSupportLifetime field and the records
+// in the authentication chain, which can be passed to ValidateChain
+func ParseDNSSECChain(data []byte) (uint16, []dns.RR, error) {
+	if len(data) < 4 {
+		return 0, nil, ErrInvalidChainData
+	}
+	lifetime := binary.BigEndian.Uint16(data)
+	length := int(binary.BigEndian.Uint16(data[2:]))
+	data = data[4:]
+	if length > len(data) {
+		return 0, nil, ErrInvalidChainData
+	} else if length < len(data) {
+		return 0, nil, ErrTrailingChainData
+	}
+	rrs := []dns.RR{}
+	for off := 0; off < len(data); {
+		r, next, err := dns.UnpackRR(data, off)
+		if err != nil {
+			return 0, nil, err
+		}
+		if next <= off {
+			return 0, nil, ErrInvalidChainData
+		}
+		rrs = append(rrs, r)
+		off = next
+	}
+	return lifetime, rrs, nil
+}
+
+// PackDNSSECChain packs rrs as the extension data of the TLS DNSSEC chain
+// extension (RFC 9102 Section 2) with the given extSupportLifetime
+func PackDNSSECChain(lifetime uint16, rrs []dns.RR) ([]byte, error) {
+	length := 0
+	for _, r := range rrs {
+		length += dns.Len(r)
+	}
+	if length > 65535 {
+		return nil, ErrChainTooLarge
+	}
+	buf := make([]byte, 4+length)
+	off := 4
+	for _, r := range rrs {
+		var err error
+		off, err = dns.PackRR(r, buf, off, nil, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	binary.BigEndian.PutUint16(buf, lifetime)
+	binary.BigEndian.PutUint16(buf[2:], uint16(off-4))
+	return buf[:off], nil
+}
+
+// dnssecRecords returns the DNSKEY, DS, RRSIG, NSEC and NSEC3 records in section
+func dnssecRecords(section []dns.RR) []dns.RR {
+	return extractRRSet(section, "", dns.TypeDNSKEY, dns.TypeDS, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3)
+}
+
+// uniqueRecords returns rrs without any duplicate records, ignoring differences
+// in TTL
+func uniqueRecords(rrs []dns.RR) []dns.RR {
+	seen := map[string]struct{}{}
+	unique := []dns.RR{}
+	for _, r := range rrs {
+		c := dns.Copy(r)
+		c.Header().Ttl = 0
+		key := strings.ToLower(c.String())
+		if _, present := seen[key]; present {
+			continue
+		}
+		seen[key] = struct{}{}
+		unique = append(unique, r)
+	}
+	return unique
+}
+
+// ChainRecords returns the answer records along with the authentication chain
+// for them, everything ValidateChain needs to validate the answer again
+// later. If authentication chains weren't enabled when the answer was
+// looked up only the answer and any signed denial records are returned.
+func (a *Answer) ChainRecords() []dns.RR {
+	rrs := append(append([]dns.RR{}, a.Answer...), dnssecRecords(a.Authority)...)
+	return uniqueRecords(append(rrs, a.Chain...))
+}
+
+// ChainZone returns the records from ChainRecords in zone file format
+func (a *Answer) ChainZone() string {
+	buf := new(bytes.Buffer)
+	for _, r := range a.ChainRecords() {
+		buf.WriteString(r.String())
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// PackChain returns the records from ChainRecords in the format used by the TLS
+// DNSSEC chain extension (RFC 9102) with the given extSupportLifetime
+func (a *Answer) PackChain(lifetime uint16) ([]byte, error) {
+	return PackDNSSECChain(lifetime, a.ChainRecords())
+}
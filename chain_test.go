@@ -0,0 +1,201 @@
+package solvere
+
+import (
+	"crypto/rsa"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testChain builds the records for a chain from the root down to the example.
+// zone, where every RRset is signed directly by the KSK of its zone
+type testChain struct {
+	now      time.Time
+	rootKey  *dns.DNSKEY
+	rootPriv *rsa.PrivateKey
+	zoneKey  *dns.DNSKEY
+	zonePriv *rsa.PrivateKey
+}
+
+func newTestChain() *testChain {
+	tc := &testChain{now: time.Now()}
+	tc.rootKey, tc.rootPriv = newTestKey(".", dns.ZONE|dns.SEP)
+	tc.zoneKey, tc.zonePriv = newTestKey("example.", dns.ZONE|dns.SEP)
+	return tc
+}
+
+func (tc *testChain) signRoot(rrset ...dns.RR) []dns.RR {
+	return append(rrset, signAt(tc.rootKey, tc.rootPriv, rrset, tc.now))
+}
+
+func (tc *testChain) signZone(rrset ...dns.RR) []dns.RR {
+	return append(rrset, signAt(tc.zoneKey, tc.zonePriv, rrset, tc.now))
+}
+
+// keys returns the signed DNSKEY RRsets for both zones
+func (tc *testChain) keys() []dns.RR {
+	return append(tc.signRoot(tc.rootKey), tc.signZone(tc.zoneKey)...)
+}
+
+func (tc *testChain) ds() []dns.RR {
+	return tc.signRoot(tc.zoneKey.ToDS(dns.SHA256))
+}
+
+func (tc *testChain) anchors() []dns.RR {
+	return []dns.RR{tc.rootKey}
+}
+
+func chainA(name string) *dns.A {
+	return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Ttl: 3600}, A: net.IP{1, 2, 3, 4}}
+}
+
+func concat(sets ...[]dns.RR) []dns.RR {
+	out := []dns.RR{}
+	for _, s := range sets {
+		out = append(out, s...)
+	}
+	return out
+}
+
+func TestValidateChain(t *testing.T) {
+	tc := newTestChain()
+	www := tc.signZone(chainA("www.example."))
+	alias := tc.signZone(&dns.CNAME{Hdr: dns.RR_Header{Name: "alias.example.", Rrtype: dns.TypeCNAME, Ttl: 3600}, Target: "www.example."})
+	wwwNSEC := tc.signZone(&dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "www.example.", Rrtype: dns.TypeNSEC, Ttl: 3600},
+		NextDomain: "example.",
+		TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+	})
+	unsignedNSEC := tc.signRoot(&dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "example.", Rrtype: dns.TypeNSEC, Ttl: 3600},
+		NextDomain: ".",
+		TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+	})
+	tampered := tc.signZone(chainA("www.example."))
+	tampered[0].(*dns.A).A = net.IP{5, 6, 7, 8}
+
+	testCases := []struct {
+		name     string
+		q        Question
+		rrs      []dns.RR
+		anchors  []dns.RR
+		now      time.Time
+		expected SecurityStatus
+	}{
+		{"answer", Question{Name: "www.example.", Type: dns.TypeA}, concat(tc.keys(), tc.ds(), www), tc.anchors(), tc.now, Secure},
+		{"mixed case name", Question{Name: "WWW.Example.", Type: dns.TypeA}, concat(tc.keys(), tc.ds(), www), tc.anchors(), tc.now, Secure},
+		{"alias", Question{Name: "alias.example.", Type: dns.TypeA}, concat(tc.keys(), tc.ds(), alias, www), tc.anchors(), tc.now, Secure},
+		{"nodata", Question{Name: "www.example.", Type: dns.TypeTXT}, concat(tc.keys(), tc.ds(), wwwNSEC), tc.anchors(), tc.now, Secure},
+		{"anchor in the zone", Question{Name: "www.example.", Type: dns.TypeA}, concat(tc.signZone(tc.zoneKey), www), []dns.RR{tc.zoneKey.ToDS(dns.SHA1)}, tc.now, Secure},
+		{"unsigned delegation", Question{Name: "www.example.", Type: dns.TypeA}, concat(tc.signRoot(tc.rootKey), unsignedNSEC, []dns.RR{chainA("www.example.")}), tc.anchors(), tc.now, Insecure},
+		{"no anchor", Question{Name: "www.example.", Type: dns.TypeA}, concat(tc.keys(), tc.ds(), www), nil, tc.now, Indeterminate},
+		{"tampered answer", Question{Name: "www.example.", Type: dns.TypeA}, concat(tc.keys(), tc.ds(), tampered), tc.anchors(), tc.now, Bogus},
+		{"missing DS", Question{Name: "www.example.", Type: dns.TypeA}, concat(tc.keys(), www), tc.anchors(), tc.now, Bogus},
+		{"missing DNSKEY", Question{Name: "www.example.", Type: dns.TypeA}, concat(tc.signRoot(tc.rootKey), tc.ds(), www), tc.anchors(), tc.now, Bogus},
+		{"missing denial", Question{Name: "www.example.", Type: dns.TypeTXT}, concat(tc.keys(), tc.ds(), www), tc.anchors(), tc.now, Bogus},
+		{"expired", Question{Name: "www.example.", Type: dns.TypeA}, concat(tc.keys(), tc.ds(), www), tc.anchors(), tc.now.Add(2 * time.Hour), Bogus},
+	}
+	for _, c := range testCases {
+		status, err := ValidateChain(c.q, c.rrs, c.anchors, c.now)
+		if status != c.expected {
+			t.Fatalf("%s: ValidateChain returned %s (%v), expected %s", c.name, status, err, c.expected)
+		}
+		if (status == Bogus) != (err != nil) {
+			t.Fatalf("%s: ValidateChain returned %s with error %v", c.name, status, err)
+		}
+	}
+
+	// the callers records aren't modified
+	rrs := concat(tc.keys(), tc.ds(), www)
+	ttl := rrs[0].Header().Ttl
+	_, err := ValidateChain(Question{Name: "www.example.", Type: dns.TypeA}, rrs, tc.anchors(), tc.now)
+	if err != nil {
+		t.Fatalf("ValidateChain failed: %s", err)
+	}
+	if rrs[0].Header().Ttl != ttl {
+		t.Fatal("ValidateChain modified the records passed to it")
+	}
+}
+
+func TestParseDNSSECChain(t *testing.T) {
+	tc := newTestChain()
+	rrs := concat(tc.keys(), tc.ds(), tc.signZone(chainA("www.example.")))
+	data, err := PackDNSSECChain(3600, rrs)
+	if err != nil {
+		t.Fatalf("PackDNSSECChain failed: %s", err)
+	}
+
+	lifetime, parsed, err := ParseDNSSECChain(data)
+	if err != nil {
+		t.Fatalf("ParseDNSSECChain failed: %s", err)
+	}
+	if lifetime != 3600 {
+		t.Fatalf("ParseDNSSECChain returned wrong lifetime: %d", lifetime)
+	}
+	if len(parsed) != len(rrs) {
+		t.Fatalf("ParseDNSSECChain returned %d records, expected %d", len(parsed), len(rrs))
+	}
+	status, err := ValidateChain(Question{Name: "www.example.", Type: dns.TypeA}, parsed, tc.anchors(), tc.now)
+	if err != nil || status != Secure {
+		t.Fatalf("Parsed chain didn't validate: %s (%v)", status, err)
+	}
+
+	if _, _, err := ParseDNSSECChain(data[:3]); err != ErrInvalidChainData {
+		t.Fatalf("ParseDNSSECChain didn't fail with ErrInvalidChainData: %v", err)
+	}
+	if _, _, err := ParseDNSSECChain(data[:len(data)-1]); err != ErrInvalidChainData {
+		t.Fatalf("ParseDNSSECChain didn't fail with ErrInvalidChainData: %v", err)
+	}
+	if _, _, err := ParseDNSSECChain(append(data, 0)); err != ErrTrailingChainData {
+		t.Fatalf("ParseDNSSECChain didn't fail with ErrTrailingChainData: %v", err)
+	}
+}
+
+func TestAnswerChain(t *testing.T) {
+	tc := newTestChain()
+	a := &Answer{
+		Answer:    tc.signZone(chainA("www.example.")),
+		Authority: []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeNS, Ttl: 3600}, Ns: "ns.example."}},
+		Chain:     concat(tc.keys(), tc.ds(), tc.keys()),
+	}
+	q := Question{Name: "www.example.", Type: dns.TypeA}
+
+	records := a.ChainRecords()
+	if len(records) != 8 {
+		t.Fatalf("ChainRecords returned %d records, expected 8", len(records))
+	}
+
+	parsed := []dns.RR{}
+	for tok := range dns.ParseZone(strings.NewReader(a.ChainZone()), ".", "") {
+		if tok.Error != nil {
+			t.Fatalf("Failed to parse chain zone: %s", tok.Error)
+		}
+		parsed = append(parsed, tok.RR)
+	}
+	if status, err := ValidateChain(q, parsed, tc.anchors(), tc.now); status != Secure {
+		t.Fatalf("Chain from zone file didn't validate: %s (%v)", status, err)
+	}
+
+	data, err := a.PackChain(0)
+	if err != nil {
+		t.Fatalf("PackChain failed: %s", err)
+	}
+	_, parsed, err = ParseDNSSECChain(data)
+	if err != nil {
+		t.Fatalf("ParseDNSSECChain failed: %s", err)
+	}
+	if status, err := ValidateChain(q, parsed, tc.anchors(), tc.now); status != Secure {
+		t.Fatalf("Chain from wire format didn't validate: %s (%v)", status, err)
+	}
+
+	huge := []dns.RR{}
+	for i := 0; i < 1000; i++ {
+		huge = append(huge, tc.rootKey)
+	}
+	if _, err := PackDNSSECChain(0, huge); err != ErrChainTooLarge {
+		t.Fatalf("PackDNSSECChain didn't fail with ErrChainTooLarge: %v", err)
+	}
+}
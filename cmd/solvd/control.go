@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/rolandshoemaker/solvere"
+)
+
+// control serves a HTTP API used to change the configuration of a running
+// resolver
+type control struct {
+	rr          *solvere.RecursiveResolver
+	ntaLifetime time.Duration
+	// cache is nil if the cache used doesn't support being inspected
+	cache solvere.ManagedCache
+}
+
+func (c *control) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nta", c.nta)
+	if c.cache != nil {
+		mux.HandleFunc("/cache", c.cacheEntries)
+		mux.HandleFunc("/cache/stats", c.cacheStats)
+	}
+	return mux
+}
+
+// nta lists (GET), adds (POST) or removes (DELETE) negative trust anchors. The
+// name is passed in the name parameter and the lifetime of a new anchor in the
+// optional lifetime parameter, 0 for forever, e.g.
+// POST /nta?name=example.com.&lifetime=2h
+func (c *control) nta(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		lifetime := c.ntaLifetime
+		if l := r.URL.Query().Get("lifetime"); l != "" {
+			var err error
+			lifetime, err = time.ParseDuration(l)
+			if err != nil || lifetime < 0 {
+				http.Error(w, fmt.Sprintf("Invalid lifetime %q", l), http.StatusBadRequest)
+				return
+			}
+		}
+		err := c.rr.AddNegativeTrustAnchor(name, ntaExpiry(lifetime))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		if name == "" {
+			http.Error(w, "Missing name", http.StatusBadRequest)
+			return
+		}
+		c.rr.RemoveNegativeTrustAnchor(name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.rr.NegativeTrustAnchors())
+}
+
+type cachedAnswer struct {
+	Name             string
+	Type             string
+	Class            string
+	CheckingDisabled bool  `json:",omitempty"`
+	TTL              int64 `json:",omitempty"`
+	Forever          bool  `json:",omitempty"`
+	Rcode            string
+	Security         solvere.SecurityStatus
+	SecurityReason   string `json:",omitempty"`
+	SecurityZone     string `json:",omitempty"`
+	Answer           []string
+}
+
+// cacheEntries lists (GET) the cached answers, or flushes (DELETE) the cached
+// answers and RRsets, for the name parameter, or for it and every name below it
+// if the subtree parameter is true, e.g. DELETE /cache?name=example.com.&subtree=true
+func (c *control) cacheEntries(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing name", http.StatusBadRequest)
+		return
+	}
+	subtree := false
+	if s := r.URL.Query().Get("subtree"); s != "" {
+		var err error
+		subtree, err = strconv.ParseBool(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid subtree %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodGet:
+		now := time.Now()
+		answers := []cachedAnswer{}
+		for _, e := range c.cache.List(name, subtree) {
+			a := cachedAnswer{
+				Name:             e.Question.Name,
+				Type:             dns.TypeToString[e.Question.Type],
+				Class:            dns.ClassToString[dns.ClassINET],
+				CheckingDisabled: e.Question.CheckingDisabled,
+				Forever:          e.Forever,
+				Rcode:            dns.RcodeToString[e.Answer.Rcode],
+				Security:         e.Answer.Security,
+				SecurityReason:   e.Answer.SecurityReason,
+				SecurityZone:     e.Answer.SecurityZone,
+				Answer:           []string{},
+			}
+			if e.Question.Class != 0 {
+				a.Class = dns.ClassToString[e.Question.Class]
+			}
+			if !e.Forever {
+				a.TTL = int64(e.Expires.Sub(now) / time.Second)
+			}
+			for _, rr := range e.Answer.Answer {
+				a.Answer = append(a.Answer, rr.String())
+			}
+			answers = append(answers, a)
+		}
+		sort.Slice(answers, func(i, j int) bool {
+			if answers[i].Name != answers[j].Name {
+				return answers[i].Name < answers[j].Name
+			}
+			return answers[i].Type < answers[j].Type
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(answers)
+	case http.MethodDelete:
+		flushed := c.rr.FlushCache(name, subtree)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct{ Flushed int }{flushed})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// cacheStats returns the cache statistics (GET)
+func (c *control) cacheStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.cache.Stats())
+}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/jmhodges/clock"
 	"github.com/miekg/dns"
 
 	"github.com/rolandshoemaker/solvere"
@@ -13,9 +23,155 @@ import (
 
 func main() {
 	listenAddr := flag.String("listen", "127.0.0.1:53", "")
+	disabledAlgorithms := flag.String("disable-algorithms", "", "Comma separated list of DNSKEY algorithms not to use for validation, e.g. RSASHA1,RSASHA1-NSEC3-SHA1")
+	disabledDigests := flag.String("disable-digests", "", "Comma separated list of DS digest types not to use for validation, e.g. SHA1")
+	clockSkew := flag.Duration("clock-skew", 0, "How far outside of a signature's validity period the current time may be before it is rejected")
+	anchorState := flag.String("trust-anchor-state", "", "File the state of the root trust anchors is kept in between restarts, if empty changes are only tracked while running")
+	anchorRefresh := flag.Duration("trust-anchor-refresh", 12*time.Hour, "How often to check the root DNSKEY RRset for trust anchor changes")
+	anchorFiles := flag.String("trust-anchors", "", "Comma separated list of files containing additional DS or DNSKEY trust anchors, in zone file format or the IANA XML format if the name ends in .xml")
+	stubZones := flag.String("stub-zones", "", "Comma separated list of zones to query the given nameservers for instead of the root, repeat a zone to give it more than one nameserver, e.g. corp.=192.0.2.1,corp.=192.0.2.2")
+	ntas := flag.String("negative-trust-anchors", "", "Comma separated list of names to disable validation at and below, e.g. example.com.")
+	ntaLifetime := flag.Duration("negative-trust-anchor-lifetime", 7*24*time.Hour, "How long negative trust anchors last for, 0 for forever")
+	controlAddr := flag.String("control", "", "Address to serve the HTTP control API on, if empty it isn't served")
+	cacheEntries := flag.Int("cache-max-entries", 0, "Maximum number of answers to cache, 0 for no limit")
+	cacheBytes := flag.Int("cache-max-bytes", 64<<20, "Maximum approximate size of the cached answers in bytes, 0 for no limit")
+	cachePolicy := flag.String("cache-eviction", "2q", "How answers are evicted from a full cache, lru or 2q")
+	cacheFile := flag.String("cache-file", "", "File the cache is saved to periodically and on shutdown and restored from on startup, if empty it isn't saved")
+	cacheSaveInterval := flag.Duration("cache-save-interval", 5*time.Minute, "How often to save the cache to the cache file")
+	cacheMinTTL := flag.Duration("cache-min-ttl", 0, "Minimum time to cache answers for, 0 for no minimum")
+	cacheMaxTTL := flag.Duration("cache-max-ttl", 24*time.Hour, "Maximum time to cache answers for, 0 for no maximum")
+	cacheNegativeMaxTTL := flag.Duration("cache-negative-max-ttl", time.Hour, "Maximum time to cache answers that deny a name or type exists for, 0 for no maximum")
+	cacheZoneTTLs := flag.String("cache-zone-ttls", "", "Comma separated list of zones with their own minimum, maximum and negative maximum cache TTLs, e.g. corp.example.=0s/30s/10s")
 	flag.Parse()
 
-	s := &server{solvere.NewRecursiveResolver(false, true, hints.RootNameservers, hints.RootKeys, solvere.NewBasicCache())}
+	policy := &solvere.AlgorithmPolicy{
+		DisabledAlgorithms: make(map[uint8]bool),
+		DisabledDigests:    make(map[uint8]bool),
+	}
+	for _, name := range splitList(*disabledAlgorithms) {
+		alg, present := dns.StringToAlgorithm[strings.ToUpper(name)]
+		if !present {
+			fmt.Printf("Unknown DNSKEY algorithm %q\n", name)
+			return
+		}
+		policy.DisabledAlgorithms[alg] = true
+	}
+	for _, name := range splitList(*disabledDigests) {
+		digest, present := dns.StringToHash[strings.ToUpper(name)]
+		if !present {
+			fmt.Printf("Unknown DS digest type %q\n", name)
+			return
+		}
+		policy.DisabledDigests[digest] = true
+	}
+
+	ttls := &solvere.TTLPolicy{
+		TTLLimits: solvere.TTLLimits{Min: *cacheMinTTL, Max: *cacheMaxTTL, NegativeMax: *cacheNegativeMaxTTL},
+		Zones:     make(map[string]solvere.TTLLimits),
+	}
+	for _, zoneTTLs := range splitList(*cacheZoneTTLs) {
+		zone, limits, err := parseZoneTTLs(zoneTTLs)
+		if err != nil {
+			fmt.Printf("Invalid zone cache TTLs %q: %s\n", zoneTTLs, err)
+			return
+		}
+		ttls.Zones[zone] = limits
+	}
+
+	var cache interface {
+		solvere.PersistentCache
+		Close()
+	}
+	if *cacheEntries == 0 && *cacheBytes == 0 {
+		cache = solvere.NewShardedCacheWithOptions(solvere.CacheOptions{})
+	} else {
+		var evictionPolicy solvere.EvictionPolicy
+		switch strings.ToLower(*cachePolicy) {
+		case "lru":
+			evictionPolicy = solvere.EvictLRU
+		case "2q":
+			evictionPolicy = solvere.Evict2Q
+		default:
+			fmt.Printf("Unknown cache eviction policy %q\n", *cachePolicy)
+			return
+		}
+		cache = solvere.NewLRUCacheWithOptions(solvere.CacheOptions{
+			MaxEntries: *cacheEntries,
+			MaxBytes:   *cacheBytes,
+			Eviction:   evictionPolicy,
+		})
+	}
+	if *cacheFile != "" {
+		restored, err := loadCache(*cacheFile, cache)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Failed to restore cache from %q: %s\n", *cacheFile, err)
+		} else if err == nil {
+			fmt.Printf("Restored %d cached answers from %q\n", restored, *cacheFile)
+		}
+		go saveCachePeriodically(*cacheFile, cache, *cacheSaveInterval)
+	}
+
+	rr := solvere.NewRecursiveResolver(false, true, hints.RootNameservers, hints.RootKeys, cache)
+	rr.SetAlgorithmPolicy(policy)
+	rr.SetTTLPolicy(ttls)
+	rr.SetClockSkew(*clockSkew)
+	tam, err := solvere.NewTrustAnchorManager(hints.RootKeys, *anchorState, clock.Default())
+	if tam == nil {
+		fmt.Printf("Failed to load trust anchor state: %s\n", err)
+		return
+	} else if err != nil {
+		fmt.Printf("Failed to save trust anchor state, changes won't be kept between restarts: %s\n", err)
+	}
+	rr.SetTrustAnchorManager(tam)
+	go refreshAnchors(tam, rr, *anchorRefresh)
+	for _, path := range splitList(*anchorFiles) {
+		anchors, err := loadTrustAnchors(path)
+		if err != nil {
+			fmt.Printf("Failed to load trust anchors from %q: %s\n", path, err)
+			return
+		}
+		err = rr.AddTrustAnchors(anchors)
+		if err != nil {
+			fmt.Printf("Failed to add trust anchors from %q: %s\n", path, err)
+			return
+		}
+	}
+	stubs := map[string][]string{}
+	for _, stub := range splitList(*stubZones) {
+		fields := strings.SplitN(stub, "=", 2)
+		if len(fields) != 2 {
+			fmt.Printf("Invalid stub zone %q: expected zone=address\n", stub)
+			return
+		}
+		stubs[fields[0]] = append(stubs[fields[0]], fields[1])
+	}
+	for zone, addrs := range stubs {
+		err := rr.AddStubZone(zone, addrs)
+		if err != nil {
+			fmt.Printf("Invalid stub zone %q: %s\n", zone, err)
+			return
+		}
+	}
+	for _, name := range splitList(*ntas) {
+		err := rr.AddNegativeTrustAnchor(name, ntaExpiry(*ntaLifetime))
+		if err != nil {
+			fmt.Printf("Invalid negative trust anchor %q: %s\n", name, err)
+			return
+		}
+	}
+	if *controlAddr != "" {
+		c := &control{rr: rr, ntaLifetime: *ntaLifetime}
+		if mc, ok := cache.(solvere.ManagedCache); ok {
+			c.cache = mc
+		}
+		go func() {
+			err := http.ListenAndServe(*controlAddr, c.mux())
+			if err != nil {
+				fmt.Printf("Control API failed: %s\n", err)
+			}
+		}()
+	}
+	s := &server{rr}
 	dns.HandleFunc(".", s.handler)
 	dnsServer := &dns.Server{
 		Addr:         *listenAddr,
@@ -23,9 +179,126 @@ func main() {
 		ReadTimeout:  time.Millisecond,
 		WriteTimeout: time.Millisecond,
 	}
-	err := dnsServer.ListenAndServe()
-	if err != nil {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- dnsServer.ListenAndServe()
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
 		fmt.Println(err)
-		return
+	case <-signals:
+		dnsServer.Shutdown()
+	}
+	cache.Close()
+	if *cacheFile != "" {
+		err := saveCache(*cacheFile, cache)
+		if err != nil {
+			fmt.Printf("Failed to save cache to %q: %s\n", *cacheFile, err)
+		}
+	}
+}
+
+func loadCache(path string, cache solvere.PersistentCache) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return solvere.LoadCache(f, cache, time.Now())
+}
+
+// saveCache writes the cache to a temporary file and renames it so a crash
+// can't leave a partially written snapshot
+func saveCache(path string, cache solvere.PersistentCache) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	err = solvere.SaveCache(tmp, cache, time.Now())
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func saveCachePeriodically(path string, cache solvere.PersistentCache, interval time.Duration) {
+	for range time.Tick(interval) {
+		err := saveCache(path, cache)
+		if err != nil {
+			fmt.Printf("Failed to save cache to %q: %s\n", path, err)
+		}
+	}
+}
+
+func refreshAnchors(tam *solvere.TrustAnchorManager, rr *solvere.RecursiveResolver, interval time.Duration) {
+	for {
+		err := tam.Refresh(context.Background(), rr)
+		if err != nil {
+			fmt.Printf("Failed to refresh root trust anchors: %s\n", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func loadTrustAnchors(path string) ([]dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if strings.HasSuffix(path, ".xml") {
+		return solvere.ParseTrustAnchorXML(f, time.Now())
+	}
+	return solvere.ParseTrustAnchors(f)
+}
+
+// ntaExpiry returns when a negative trust anchor added now with the given
+// lifetime expires, never if it's 0
+func ntaExpiry(lifetime time.Duration) time.Time {
+	if lifetime == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(lifetime)
+}
+
+var errInvalidZoneTTLs = errors.New("expected zone=min/max/negative-max")
+
+// parseZoneTTLs parses a zone and its cache TTL limits in the form
+// zone=min/max/negative-max, empty limits are 0
+func parseZoneTTLs(s string) (string, solvere.TTLLimits, error) {
+	var limits solvere.TTLLimits
+	fields := strings.SplitN(s, "=", 2)
+	if len(fields) != 2 || fields[0] == "" {
+		return "", limits, errInvalidZoneTTLs
+	}
+	durations := strings.Split(fields[1], "/")
+	if len(durations) != 3 {
+		return "", limits, errInvalidZoneTTLs
+	}
+	for i, limit := range []*time.Duration{&limits.Min, &limits.Max, &limits.NegativeMax} {
+		if durations[i] == "" {
+			continue
+		}
+		d, err := time.ParseDuration(durations[i])
+		if err != nil {
+			return "", limits, err
+		}
+		*limit = d
+	}
+	return dns.Fqdn(fields[0]), limits, nil
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return nil
 	}
+	return strings.Split(list, ",")
 }
@@ -26,7 +26,12 @@ func (s *server) handler(w dns.ResponseWriter, r *dns.Msg) {
 		return
 	}
 
-	q := solvere.Question{r.Question[0].Name, r.Question[0].Qtype}
+	q := solvere.Question{
+		Name:             r.Question[0].Name,
+		Type:             r.Question[0].Qtype,
+		Class:            r.Question[0].Qclass,
+		CheckingDisabled: r.CheckingDisabled,
+	}
 	ctx := context.TODO()
 
 	a, log, err := s.rr.Lookup(ctx, q)
@@ -48,14 +53,38 @@ func (s *server) handler(w dns.ResponseWriter, r *dns.Msg) {
 		// 	err,
 		// )
 		m.Rcode = dns.RcodeServerFailure
+		addEDE(m, r, log.EDE)
 		w.WriteMsg(m)
 		return
 	}
 	m.Rcode = a.Rcode
-	m.AuthenticatedData = a.Authenticated
+	m.AuthenticatedData = a.Security == solvere.Secure
 	m.Answer = a.Answer
 	m.Ns = a.Authority
 	m.Extra = a.Additional
+	addEDE(m, r, a.EDE)
 	w.WriteMsg(m)
 	return
 }
+
+// addEDE adds a Extended DNS Error to the OPT record of m if the query r
+// supports EDNS0
+func addEDE(m, r *dns.Msg, ede *solvere.ExtendedError) {
+	opt := r.IsEdns0()
+	if opt == nil || ede == nil {
+		return
+	}
+	for i, extra := range m.Extra {
+		if extra.Header().Rrtype == dns.TypeOPT {
+			// the OPT record may be shared with the answer so a copy is
+			// modified instead
+			resOpt := dns.Copy(extra).(*dns.OPT)
+			resOpt.Option = append(resOpt.Option, ede.EDNS0())
+			m.Extra = append(append(m.Extra[:i:i], resOpt), m.Extra[i+1:]...)
+			return
+		}
+	}
+	m.SetEdns0(4096, opt.Do())
+	resOpt := m.IsEdns0()
+	resOpt.Option = append(resOpt.Option, ede.EDNS0())
+}
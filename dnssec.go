@@ -3,6 +3,8 @@ package solvere
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -16,20 +18,258 @@ var (
 	ErrNoSignatures           = errors.New("solvere: No RRSIG records for zone that should be signed")
 	ErrMissingDNSKEY          = errors.New("solvere: No matching DNSKEY found for RRSIG records")
 	ErrInvalidSignaturePeriod = errors.New("solvere: Incorrect signature validity period")
+	ErrSignatureNotYetValid   = errors.New("solvere: Signature inception is in the future")
 	ErrBadAnswer              = errors.New("solvere: Response contained a non-zero RCODE")
 	ErrMissingSigned          = errors.New("solvere: Signed records are missing")
+	ErrInvalidLabelCount      = errors.New("solvere: RRSIG label count is larger than the number of labels in the owner name")
+	ErrUnsupportedAlgorithm   = errors.New("solvere: RRset is only signed using unsupported or disabled algorithms")
+
+	ErrTooManySignatures       = errors.New("solvere: Too many signature verifications required to validate response")
+	ErrTooManyKeyTagCollisions = errors.New("solvere: Too many DNSKEYs with the same key tag")
+	ErrTooManyNSEC3Hashes      = errors.New("solvere: Too many NSEC3 hash computations required to validate response")
+)
+
+// Limits on the work done validating a single response so a hostile zone can't
+// exhaust the CPU with large numbers of signatures, colliding key tags, or
+// NSEC3 records (CVE-2023-50387, CVE-2023-50868)
+var (
+	// MaxSignatureValidations is the maximum number of signature verifications
+	// performed while validating a single response
+	MaxSignatureValidations = 32
+	// MaxKeyTagCollisions is the maximum number of DNSKEYs with the same key
+	// tag that will be tried when verifying a signature
+	MaxKeyTagCollisions = 4
+	// MaxNSEC3Hashes is the maximum number of NSEC3 hashes computed while
+	// validating a single response
+	MaxNSEC3Hashes = 128
 )
 
-func (rr *RecursiveResolver) lookupDNSKEY(ctx context.Context, auth *Nameserver) (map[uint16]*dns.DNSKEY, *LookupLog, func(), error) {
+// SecurityStatus describes the DNSSEC security status of a answer as defined
+// in RFC 4035 Section 4.3
+type SecurityStatus int
+
+const (
+	// Indeterminate means there was no trust anchor that could be used to
+	// validate the answer, or validation wasn't performed
+	Indeterminate SecurityStatus = iota
+	// Secure means a unbroken chain of signed DNSKEY and DS records leads from
+	// a trust anchor to the signed answer
+	Secure
+	// Insecure means there is signed proof that no chain of trust exists from
+	// a trust anchor to the answer, e.g. a unsigned delegation from a signed zone
+	Insecure
+	// Bogus means there should have been a chain of trust to the answer but
+	// validation of it failed
+	Bogus
+)
+
+var securityStatusToString = map[SecurityStatus]string{
+	Indeterminate: "Indeterminate",
+	Secure:        "Secure",
+	Insecure:      "Insecure",
+	Bogus:         "Bogus",
+}
+
+func (s SecurityStatus) String() string {
+	if str, present := securityStatusToString[s]; present {
+		return str
+	}
+	return fmt.Sprintf("SecurityStatus(%d)", int(s))
+}
+
+// MarshalText implements encoding.TextMarshaler so statuses are human readable
+// in JSON encoded LookupLogs
+func (s SecurityStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (s *SecurityStatus) UnmarshalText(text []byte) error {
+	for status, str := range securityStatusToString {
+		if str == string(text) {
+			*s = status
+			return nil
+		}
+	}
+	return fmt.Errorf("solvere: Unknown security status %q", text)
+}
+
+// securityRank orders statuses by how strong a guarantee they provide, a
+// answer built from multiple responses is only as strong as its weakest part
+var securityRank = map[SecurityStatus]int{
+	Secure:        0,
+	Insecure:      1,
+	Indeterminate: 2,
+	Bogus:         3,
+}
+
+type securityState struct {
+	status SecurityStatus
+	reason string
+	zone   string
+}
+
+// worse returns the weaker of two states, preferring other if they are equally
+// strong so the details of the most recent part of a answer are kept
+func (ss securityState) worse(other securityState) securityState {
+	if securityRank[other.status] >= securityRank[ss.status] {
+		return other
+	}
+	return ss
+}
+
+// trustAnchorDS converts DNSKEY trust anchors to DS records so they can be
+// used to authenticate a DNSKEY RRset the same way as a DS RRset from a
+// parent zone. DS records are used as is.
+func trustAnchorDS(anchors []dns.RR) []dns.RR {
+	dsSet := []dns.RR{}
+	for _, a := range anchors {
+		switch k := a.(type) {
+		case *dns.DNSKEY:
+			if ds := k.ToDS(dns.SHA256); ds != nil {
+				dsSet = append(dsSet, ds)
+			}
+		case *dns.DS:
+			dsSet = append(dsSet, k)
+		}
+	}
+	return dsSet
+}
+
+// initialSecurity returns the state a delegation chain for q starts in and
+// the DS records the DNSKEY RRset of the zone validation starts at must match.
+// Validation starts at the closest zone enclosing q.Name with trust anchors
+// added by AddTrustAnchors, or the root, which is the zone of the returned
+// state. If checking is disabled for q the chain is Indeterminate from the
+// start and if its name is covered by a negative trust anchor it is Insecure.
+func (rr *RecursiveResolver) initialSecurity(q *Question) (securityState, []dns.RR) {
+	if !rr.useDNSSEC {
+		return securityState{status: Indeterminate, reason: "DNSSEC validation is disabled"}, nil
+	}
+	if q.CheckingDisabled {
+		return securityState{status: Indeterminate, reason: "validation disabled by the CD bit"}, nil
+	}
+	if nta := rr.negativeTrustAnchor(q.Name); nta != nil {
+		return ntaSecurity(nta), nil
+	}
+	if zone, anchors := rr.closestTrustAnchor(q.Name); zone != "" {
+		ds := rr.algorithms.usableDS(anchors)
+		if len(ds) == 0 {
+			return securityState{
+				status: Insecure,
+				reason: fmt.Sprintf("trust anchors for %s only use unsupported or disabled algorithms or digest types", zone),
+				zone:   zone,
+			}, nil
+		}
+		return securityState{status: Secure, zone: zone}, ds
+	}
+	anchors := rr.algorithms.usableDS(rr.rootAnchors())
+	if len(anchors) == 0 {
+		return securityState{status: Indeterminate, reason: "no root trust anchor uses a supported algorithm and digest type"}, nil
+	}
+	return securityState{status: Secure, zone: "."}, anchors
+}
+
+// validator contains the configuration used to validate the signatures in
+// a response and tracks the work done doing so. If now is the zero time the
+// current time is used. A validator should only be used for a single response.
+type validator struct {
+	algorithms *AlgorithmPolicy
+	now        time.Time
+	skew       time.Duration
+	nsec3Cache *nsec3HashCache
+
+	signatures  int
+	nsec3Hashes int
+}
+
+func (rr *RecursiveResolver) validator() *validator {
+	return &validator{algorithms: rr.algorithms, now: rr.now(), skew: rr.clockSkew, nsec3Cache: rr.nsec3Cache}
+}
+
+// verify checks sig over rrset using the keys in keyMap with the same key tag
+// as the signature, counting each attempt against the signature limit
+func (v *validator) verify(sig *dns.RRSIG, keyMap map[uint16][]*dns.DNSKEY, rrset []dns.RR) (*dns.DNSKEY, error) {
+	keys := keyMap[sig.KeyTag]
+	if len(keys) == 0 {
+		return nil, ErrMissingDNSKEY
+	}
+	if len(keys) > MaxKeyTagCollisions {
+		return nil, ErrTooManyKeyTagCollisions
+	}
+	var err error
+	for _, k := range keys {
+		v.signatures++
+		if v.signatures > MaxSignatureValidations {
+			return nil, ErrTooManySignatures
+		}
+		if err = sig.Verify(k, rrset); err == nil {
+			return k, nil
+		}
+	}
+	return nil, err
+}
+
+func (v *validator) time() time.Time {
+	if v.now.IsZero() {
+		return time.Now()
+	}
+	return v.now
+}
+
+// sigTime converts a RRSIG inception or expiration time to a time.Time using
+// serial number arithmetic relative to now (RFC 4034 Section 3.1.5)
+func sigTime(t uint32, now time.Time) time.Time {
+	n := now.UTC().Unix()
+	mod := (int64(t) - n) / year68
+	return time.Unix(int64(t)+(mod*year68), 0)
+}
+
+// checkValidityPeriod checks that the current time, give or take the allowed
+// clock skew, is inside the validity period of sig
+func (v *validator) checkValidityPeriod(sig *dns.RRSIG) error {
+	now := v.time()
+	if now.Add(v.skew).Before(sigTime(sig.Inception, now)) {
+		return ErrSignatureNotYetValid
+	}
+	if now.Add(-v.skew).After(sigTime(sig.Expiration, now)) {
+		return ErrInvalidSignaturePeriod
+	}
+	return nil
+}
+
+// capTTL caps the TTL of a validated RRset and its signature at the original
+// TTL from the signature and the time left until the signature expires so
+// a server can't inflate how long the RRset is cached for (RFC 4035 Section 5.3.3)
+func (v *validator) capTTL(sig *dns.RRSIG, rrset []dns.RR) {
+	now := v.time()
+	ttl := sig.OrigTtl
+	remaining := int64(sigTime(sig.Expiration, now).Sub(now) / time.Second)
+	if remaining < 0 {
+		remaining = 0
+	}
+	if remaining < int64(ttl) {
+		ttl = uint32(remaining)
+	}
+	for _, r := range append(rrset, sig) {
+		if r.Header().Ttl > ttl {
+			r.Header().Ttl = ttl
+		}
+	}
+}
+
+// lookupDNSKEY fetches the DNSKEY RRset for the zone of auth and checks it is
+// signed by a key that matches one of dsSet, either the DS records from the
+// parent zone or a trust anchor. Only once the RRset is authenticated are the
+// rest of the keys in it trusted.
+func (rr *RecursiveResolver) lookupDNSKEY(ctx context.Context, auth *Nameserver, dsSet []dns.RR) (map[uint16][]*dns.DNSKEY, *LookupLog, func(), error) {
 	q := &Question{Name: auth.Zone, Type: dns.TypeDNSKEY}
 	var r *dns.Msg
 	var log *LookupLog
 	var err error
 	if rr.cache != nil {
-
-	}
-	if rr.cache != nil {
-		if a := rr.cache.Get(q); a != nil {
+		// only trust cached keys that were previously authenticated
+		if a := rr.cache.Get(q); a != nil && a.Security == Secure {
 			r = new(dns.Msg)
 			r.Rcode = dns.RcodeSuccess
 			r.Answer = a.Answer
@@ -37,7 +277,8 @@ func (rr *RecursiveResolver) lookupDNSKEY(ctx context.Context, auth *Nameserver)
 			r.Extra = a.Additional
 			log = newLookupLog(q, nil)
 			log.CacheHit = true
-			log.DNSSECValid = a.Authenticated
+			log.Security = a.Security
+			log.SecurityZone = a.SecurityZone
 			log.Rcode = dns.RcodeSuccess
 		}
 	}
@@ -52,62 +293,150 @@ func (rr *RecursiveResolver) lookupDNSKEY(ctx context.Context, auth *Nameserver)
 		}
 	}
 
-	keyMap := make(map[uint16]*dns.DNSKEY)
-	// Extract DNSKEYs based on type
-	for _, a := range r.Answer {
-		if a.Header().Rrtype == dns.TypeDNSKEY {
-			dnskey := a.(*dns.DNSKEY)
-			tag := dnskey.KeyTag()
-			if dnskey.Flags == 256 || dnskey.Flags == 257 {
-				keyMap[tag] = dnskey
-			}
-		}
-	}
-
+	keyMap := zoneKeys(r.Answer)
 	if len(keyMap) == 0 {
 		return nil, log, nil, ErrNoDNSKEY // ???
 	}
 
-	// Verify RRSIGs from the message passed in using the KSK keys
-	if auth.Zone != "." {
-		err = verifyRRSIG(r, keyMap)
+	if !log.CacheHit {
+		sepKeys, err := checkDS(keyMap, dsSet)
 		if err != nil {
 			return nil, log, nil, err
 		}
+		ksk, err := rr.validator().verifyDNSKEYSet(r.Answer, auth.Zone, sepKeys)
+		if err != nil {
+			return nil, log, nil, err
+		}
+		log.DNSSECAlgorithm = dns.AlgorithmToString[ksk.Algorithm]
+		log.DSDigestType = digestName(ksk, dsSet)
 	}
+	log.records = extractRRSet(r.Answer, auth.Zone, dns.TypeDNSKEY, dns.TypeRRSIG)
 
 	addCache := func() {
 		if rr.cache != nil && !log.CacheHit {
-			rr.cache.Add(q, &Answer{r.Answer, r.Ns, r.Extra, dns.RcodeSuccess, true}, false)
+			rr.cache.Add(q, &Answer{
+				Answer:       r.Answer,
+				Authority:    r.Ns,
+				Additional:   r.Extra,
+				Rcode:        dns.RcodeSuccess,
+				Security:     Secure,
+				SecurityZone: auth.Zone,
+			}, false)
 		}
 	}
 
 	return keyMap, log, addCache, nil
 }
 
-func checkDS(keyMap map[uint16]*dns.DNSKEY, parentDSSet []dns.RR) error {
-	for _, r := range parentDSSet {
+// zoneKeys extracts the zone keys from a answer, ignoring any that have been
+// revoked. Multiple keys can have the same key tag so all of them are kept.
+func zoneKeys(answer []dns.RR) map[uint16][]*dns.DNSKEY {
+	keyMap := make(map[uint16][]*dns.DNSKEY)
+	for _, a := range answer {
+		if a.Header().Rrtype == dns.TypeDNSKEY {
+			dnskey := a.(*dns.DNSKEY)
+			tag := dnskey.KeyTag()
+			if dnskey.Flags&dns.ZONE != 0 && dnskey.Flags&dns.REVOKE == 0 {
+				keyMap[tag] = append(keyMap[tag], dnskey)
+			}
+		}
+	}
+	return keyMap
+}
+
+// checkDS returns the keys from keyMap that match one of the DS records in
+// dsSet
+func checkDS(keyMap map[uint16][]*dns.DNSKEY, dsSet []dns.RR) (map[uint16][]*dns.DNSKEY, error) {
+	matched := make(map[uint16][]*dns.DNSKEY)
+	err := ErrMissingKSK
+	for _, r := range dsSet {
 		parentDS := r.(*dns.DS)
-		// This KSK may not actually be of the right type but that
-		// doesn't really matter since it'll serve the same purpose
-		// either way if we find it in the map.
-		ksk, present := keyMap[parentDS.KeyTag]
+		// These KSKs may not actually be of the right type but that
+		// doesn't really matter since they'll serve the same purpose
+		// either way if we find them in the map.
+		keys, present := keyMap[parentDS.KeyTag]
 		if !present {
 			continue
 		}
-		ds := ksk.ToDS(parentDS.DigestType)
-		if ds == nil {
-			return ErrFailedToConvertKSK
+		if len(keys) > MaxKeyTagCollisions {
+			err = ErrTooManyKeyTagCollisions
+			continue
 		}
-		if ds.Digest != parentDS.Digest {
-			return ErrMismatchingDS
+		for _, ksk := range keys {
+			if ksk.Algorithm != parentDS.Algorithm {
+				err = ErrMismatchingDS
+				continue
+			}
+			ds := ksk.ToDS(parentDS.DigestType)
+			if ds == nil {
+				err = ErrFailedToConvertKSK
+				continue
+			}
+			if !strings.EqualFold(ds.Digest, parentDS.Digest) {
+				err = ErrMismatchingDS
+				continue
+			}
+			matched[parentDS.KeyTag] = append(matched[parentDS.KeyTag], ksk)
 		}
-		return nil
 	}
-	return ErrMissingKSK
+	if len(matched) == 0 {
+		return nil, err
+	}
+	return matched, nil
+}
+
+// digestName returns the name of the digest type of the DS record in dsSet
+// that matches k
+func digestName(k *dns.DNSKEY, dsSet []dns.RR) string {
+	tag := k.KeyTag()
+	for _, r := range dsSet {
+		ds := r.(*dns.DS)
+		if ds.KeyTag != tag {
+			continue
+		}
+		if kds := k.ToDS(ds.DigestType); kds != nil && strings.EqualFold(kds.Digest, ds.Digest) {
+			return dns.HashToString[ds.DigestType]
+		}
+	}
+	return ""
 }
 
-func verifyRRSIG(msg *dns.Msg, keyMap map[uint16]*dns.DNSKEY) error {
+// verifyDNSKEYSet checks that the DNSKEY RRset for a zone is signed by at
+// least one of the keys that matched the DS records for the zone and returns
+// the key that signed it
+func (v *validator) verifyDNSKEYSet(answer []dns.RR, zone string, sepKeys map[uint16][]*dns.DNSKEY) (*dns.DNSKEY, error) {
+	keys := extractRRSet(answer, zone, dns.TypeDNSKEY)
+	err := ErrNoSignatures
+	for _, r := range extractRRSet(answer, zone, dns.TypeRRSIG) {
+		sig := r.(*dns.RRSIG)
+		if sig.TypeCovered != dns.TypeDNSKEY {
+			continue
+		}
+		if !v.algorithms.AlgorithmEnabled(sig.Algorithm) {
+			err = ErrUnsupportedAlgorithm
+			continue
+		}
+		var k *dns.DNSKEY
+		k, err = v.verify(sig, sepKeys, keys)
+		if err == ErrTooManySignatures || err == ErrTooManyKeyTagCollisions {
+			return nil, err
+		} else if err != nil {
+			continue
+		}
+		if err = v.checkValidityPeriod(sig); err != nil {
+			continue
+		}
+		v.capTTL(sig, keys)
+		return k, nil
+	}
+	return nil, err
+}
+
+// verifyRRSIG checks the signatures covering the RRsets in the answer and
+// authority sections of msg. Signatures using unsupported or disabled
+// algorithms are ignored (RFC 6840 Section 5.2) but every signed RRset must
+// have at least one signature that can be validated.
+func (v *validator) verifyRRSIG(msg *dns.Msg, keyMap map[uint16][]*dns.DNSKEY) error {
 	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
 		if len(section) == 0 {
 			continue
@@ -116,47 +445,197 @@ func verifyRRSIG(msg *dns.Msg, keyMap map[uint16]*dns.DNSKEY) error {
 		if len(sigs) == 0 {
 			return ErrNoSignatures
 		}
+		verified := map[string]bool{}
 		for _, sigRR := range sigs {
 			sig := sigRR.(*dns.RRSIG)
 			rest := extractRRSet(section, sig.Header().Name, sig.TypeCovered)
 			if len(rest) == 0 {
 				return ErrMissingSigned
 			}
-			k, present := keyMap[sig.KeyTag]
-			if !present {
-				return ErrMissingDNSKEY
+			if int(sig.Labels) > ownerLabels(sig.Hdr.Name) {
+				return ErrInvalidLabelCount
+			}
+			set := rrsetKey(sig.Hdr.Name, sig.TypeCovered)
+			if !v.algorithms.AlgorithmEnabled(sig.Algorithm) {
+				if _, seen := verified[set]; !seen {
+					verified[set] = false
+				}
+				continue
+			}
+			_, err := v.verify(sig, keyMap, rest)
+			if err != nil {
+				return err
 			}
-			err := sig.Verify(k, rest)
+			err = v.checkValidityPeriod(sig)
 			if err != nil {
 				return err
 			}
-			if !sig.ValidityPeriod(time.Time{}) {
-				return ErrInvalidSignaturePeriod
+			v.capTTL(sig, rest)
+			verified[set] = true
+		}
+		for _, ok := range verified {
+			if !ok {
+				return ErrUnsupportedAlgorithm
 			}
 		}
 	}
 	return nil
 }
 
-func (rr *RecursiveResolver) checkSignatures(ctx context.Context, m *dns.Msg, auth *Nameserver, parentDSSet []dns.RR) (*LookupLog, error) {
-	keyMap, log, addCache, err := rr.lookupDNSKEY(ctx, auth)
-	if err != nil {
-		return log, err
+func rrsetKey(name string, t uint16) string {
+	return fmt.Sprintf("%s:%d", strings.ToLower(name), t)
+}
+
+// ownerLabels counts the labels in a owner name not including a leading
+// wildcard label, which is how the RRSIG labels field is calculated
+func ownerLabels(name string) int {
+	labels := dns.SplitDomainName(name)
+	if len(labels) > 0 && labels[0] == "*" {
+		return len(labels) - 1
 	}
+	return len(labels)
+}
 
-	if len(parentDSSet) > 0 {
-		err = checkDS(keyMap, parentDSSet)
-		if err != nil {
-			return log, err
+// wildcardExpansion describes a RRset synthesized from the wildcard directly
+// below encloser
+type wildcardExpansion struct {
+	name     string
+	encloser string
+}
+
+// findWildcardExpansions uses the labels field of RRSIG records to find the
+// RRsets in a section that were synthesized from a wildcard (RFC 4035 Section 5.3.4)
+func findWildcardExpansions(section []dns.RR) []wildcardExpansion {
+	expansions := []wildcardExpansion{}
+	seen := map[string]struct{}{}
+	for _, r := range extractRRSet(section, "", dns.TypeRRSIG) {
+		sig := r.(*dns.RRSIG)
+		if int(sig.Labels) >= ownerLabels(sig.Hdr.Name) {
+			continue
+		}
+		if _, present := seen[sig.Hdr.Name]; present {
+			continue
+		}
+		seen[sig.Hdr.Name] = struct{}{}
+		encloser := "."
+		if sig.Labels > 0 {
+			labels := dns.SplitDomainName(sig.Hdr.Name)
+			encloser = strings.Join(labels[len(labels)-int(sig.Labels):], ".") + "."
+		}
+		expansions = append(expansions, wildcardExpansion{name: sig.Hdr.Name, encloser: encloser})
+	}
+	return expansions
+}
+
+// verifyWildcards checks that every wildcard expansion in a answer section is
+// accompanied by proof that no closer match for the name exists
+func (v *validator) verifyWildcards(answer []dns.RR, nsec []dns.RR) error {
+	for _, we := range findWildcardExpansions(answer) {
+		if err := v.verifyWildcardAnswer(we.name, we.encloser, nsec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signedOnly filters records down to those whose RRset is covered by a RRSIG in
+// section. This is only meaningful once the signatures in section have been
+// verified.
+func signedOnly(section []dns.RR, records []dns.RR) []dns.RR {
+	covered := map[string]struct{}{}
+	for _, r := range extractRRSet(section, "", dns.TypeRRSIG) {
+		sig := r.(*dns.RRSIG)
+		covered[rrsetKey(sig.Hdr.Name, sig.TypeCovered)] = struct{}{}
+	}
+	out := []dns.RR{}
+	for _, r := range records {
+		if _, present := covered[rrsetKey(r.Header().Name, r.Header().Rrtype)]; present {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// signedDenial returns the signed NSEC3 or NSEC records from a section
+func signedDenial(section []dns.RR) []dns.RR {
+	return signedOnly(section, extractDenial(section))
+}
+
+// delegationDS finds the DS records for a zone cut using the DS records in the
+// referral if they are present and otherwise by asking the parent zone for them
+// explicitly. If there are no DS records for the zone signed NSEC/NSEC3 records
+// must prove the delegation is insecure, otherwise it is considered Bogus so
+// stripping the DS records from a referral can't be used to downgrade a signed
+// zone. v is the validator used for the referral.
+func (rr *RecursiveResolver) delegationDS(ctx context.Context, v *validator, zone string, referral *dns.Msg, parent *Nameserver, parentDSSet []dns.RR) ([]dns.RR, *LookupLog, error) {
+	if ds := signedOnly(referral.Ns, extractRRSet(referral.Ns, zone, dns.TypeDS)); len(ds) > 0 {
+		return ds, nil, nil
+	}
+	if nsec := signedDenial(referral.Ns); len(nsec) > 0 {
+		if err := v.verifyDelegation(zone, nsec); err == nil || err == errInsecureNSEC3Iterations {
+			return nil, nil, err
+		}
+	}
+
+	q := &Question{Name: zone, Type: dns.TypeDS}
+	r, log, err := rr.query(ctx, q, parent)
+	if err != nil {
+		log.Error = err.Error()
+		return nil, log, err
+	}
+	if log.CacheHit {
+		if log.Security != Secure {
+			return nil, log, ErrUnsignedDelegation
+		}
+		log.records = dnssecRecords(r.Answer)
+		return extractRRSet(r.Answer, zone, dns.TypeDS), log, nil
+	}
+	v = rr.validator()
+	dkLog, err := rr.checkSignatures(ctx, v, r, parent, parentDSSet)
+	log.Composites = append(log.Composites, dkLog)
+	if err != nil {
+		log.Error = err.Error()
+		return nil, log, err
+	}
+	log.Security = Secure
+	log.SecurityZone = parent.Zone
+	log.records = dkLog.records
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, log, ErrUnsignedDelegation
+	}
+	if ds := signedOnly(r.Answer, extractRRSet(r.Answer, zone, dns.TypeDS)); len(ds) > 0 {
+		if rr.cache != nil {
+			rr.cache.Add(q, &Answer{Answer: r.Answer, Rcode: r.Rcode, Security: Secure, SecurityZone: parent.Zone}, false)
+		}
+		return ds, log, nil
+	}
+	err = v.verifyNODATA(q, signedDenial(r.Ns))
+	if err == errInsecureNSEC3Iterations {
+		return nil, log, err
+	} else if err != nil {
+		log.Error = err.Error()
+		if err != ErrNSEC3Iterations {
+			err = ErrUnsignedDelegation
 		}
+		return nil, log, err
+	}
+	return nil, log, nil
+}
+
+func (rr *RecursiveResolver) checkSignatures(ctx context.Context, v *validator, m *dns.Msg, auth *Nameserver, parentDSSet []dns.RR) (*LookupLog, error) {
+	keyMap, log, addCache, err := rr.lookupDNSKEY(ctx, auth, parentDSSet)
+	if err != nil {
+		return log, err
 	}
 
-	err = verifyRRSIG(m, keyMap)
+	err = v.verifyRRSIG(m, keyMap)
 	if err != nil {
 		return log, err
 	}
 
-	log.DNSSECValid = true
+	log.Security = Secure
+	log.SecurityZone = auth.Zone
+	log.records = append(append(log.records, dnssecRecords(m.Answer)...), dnssecRecords(m.Ns)...)
 
 	// Only add response to cache if it wasn't a cache hit
 	if !log.CacheHit {
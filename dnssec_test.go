@@ -63,6 +63,94 @@ func init() {
 	}
 }
 
+func newTestKey(name string, flags uint16) (*dns.DNSKEY, *rsa.PrivateKey) {
+	k := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Ttl: 3600},
+		Algorithm: dns.RSASHA256,
+		Flags:     flags,
+		Protocol:  3,
+	}
+	pk, err := k.Generate(512)
+	if err != nil {
+		panic(err)
+	}
+	return k, pk.(*rsa.PrivateKey)
+}
+
+func signWith(k *dns.DNSKEY, pk *rsa.PrivateKey, rrset []dns.RR) *dns.RRSIG {
+	return signAt(k, pk, rrset, time.Now())
+}
+
+// signAt signs a RRset with a signature that is valid for a hour either side
+// of now
+func signAt(k *dns.DNSKEY, pk *rsa.PrivateKey, rrset []dns.RR, now time.Time) *dns.RRSIG {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Ttl: 3600},
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+		KeyTag:     k.KeyTag(),
+		SignerName: k.Hdr.Name,
+		Algorithm:  k.Algorithm,
+	}
+	err := sig.Sign(pk, rrset)
+	if err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+// signExample signs a RRset using the 'example.' key
+func signExample(rrset []dns.RR) *dns.RRSIG {
+	return signWith(&exampleKey, (*examplePrivateKey).(*rsa.PrivateKey), rrset)
+}
+
+var (
+	signedKSK, signedKSKPrivate = newTestKey("signed.", 257)
+	signedZSK, signedZSKPrivate = newTestKey("signed.", 256)
+	rogueKSK, _                 = newTestKey("rogue.", 257)
+	rogueZSK, rogueZSKPrivate   = newTestKey("rogue.", 256)
+)
+
+var (
+	exampleChildKey = &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "signed.example.", Rrtype: dns.TypeDNSKEY, Ttl: 3600},
+		Algorithm: dns.RSASHA256,
+		Flags:     257,
+		Protocol:  3,
+		PublicKey: exampleKey.PublicKey,
+	}
+	unsignedNSEC = &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "unsigned.example.", Rrtype: dns.TypeNSEC, Ttl: 3600},
+		NextDomain: "z.example.",
+		TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+	}
+	exampleSOA = &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Ttl: 3600},
+		Ns:     "ns.example.",
+		Mbox:   "master.example.",
+		Serial: 1,
+		Minttl: 60,
+	}
+)
+
+func mockDSResponse(m *dns.Msg, name string) {
+	switch name {
+	case "signed.example.":
+		ds := exampleChildKey.ToDS(dns.SHA256)
+		m.Answer = append(m.Answer, ds, signExample([]dns.RR{ds}))
+	case "unsigned.example.":
+		m.Ns = append(m.Ns, exampleSOA, signExample([]dns.RR{exampleSOA}), unsignedNSEC, signExample([]dns.RR{unsignedNSEC}))
+	case "stripped.example.":
+		m.Ns = append(m.Ns, exampleSOA, signExample([]dns.RR{exampleSOA}))
+	case "forged.example.":
+		m.Ns = append(m.Ns, exampleSOA, signExample([]dns.RR{exampleSOA}), &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: "forged.example.", Rrtype: dns.TypeNSEC, Ttl: 3600},
+			NextDomain: "z.example.",
+			TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+		})
+	}
+}
+
 func mockDNSKEYServer(w dns.ResponseWriter, r *dns.Msg) {
 	m := new(dns.Msg)
 	m.SetReply(r)
@@ -75,6 +163,11 @@ func mockDNSKEYServer(w dns.ResponseWriter, r *dns.Msg) {
 	}
 	eMu.Lock()
 	defer eMu.Unlock()
+	if r.Question[0].Qtype == dns.TypeDS {
+		mockDSResponse(m, r.Question[0].Name)
+		w.WriteMsg(m)
+		return
+	}
 	switch r.Question[0].Name {
 	case "example.":
 		m.Answer = append(m.Answer, &exampleKey, exampleKeySig)
@@ -95,6 +188,13 @@ func mockDNSKEYServer(w dns.ResponseWriter, r *dns.Msg) {
 		})
 	case "out-of-bailiwick.":
 		m.Answer = append(m.Answer, &exampleKey, exampleKeySig)
+	case "signed.":
+		keys := []dns.RR{signedKSK, signedZSK}
+		m.Answer = append(m.Answer, signedKSK, signedZSK, signWith(signedKSK, signedKSKPrivate, keys))
+	case "rogue.":
+		// DNSKEY RRset only signed by a key the parent DS doesn't match
+		keys := []dns.RR{rogueKSK, rogueZSK}
+		m.Answer = append(m.Answer, rogueKSK, rogueZSK, signWith(rogueZSK, rogueZSKPrivate, keys))
 	case "bad-sig.":
 		badSigRR := dns.Copy(exampleKeySig)
 		badSig := badSigRR.(*dns.RRSIG)
@@ -106,14 +206,27 @@ func mockDNSKEYServer(w dns.ResponseWriter, r *dns.Msg) {
 		m.Answer = append(m.Answer, key, badSig)
 	}
 
-	w.WriteMsg(m)
+	// the records are shared with the tests and packing them writes to their
+	// headers, so a copy is written instead
+	w.WriteMsg(m.Copy())
 	return
 }
 
-func TestLookupDNSKEY(t *testing.T) {
+// startMockServer starts a UDP DNS server on 127.0.0.1:9053 using handler and
+// returns a function that stops it
+func startMockServer(t *testing.T, handler dns.HandlerFunc) func() {
 	dnsPort = "9053"
-	dns.HandleFunc(".", mockDNSKEYServer)
-	server := &dns.Server{Addr: "127.0.0.1:9053", Net: "udp", ReadTimeout: time.Second, WriteTimeout: time.Second}
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", handler)
+	started := make(chan struct{})
+	server := &dns.Server{
+		Addr:              "127.0.0.1:9053",
+		Net:               "udp",
+		Handler:           mux,
+		ReadTimeout:       time.Second,
+		WriteTimeout:      time.Second,
+		NotifyStartedFunc: func() { close(started) },
+	}
 	go func() {
 		err := server.ListenAndServe()
 		if err != nil {
@@ -121,70 +234,80 @@ func TestLookupDNSKEY(t *testing.T) {
 			return
 		}
 	}()
-	// wait for things to warm up :/
-	time.Sleep(time.Millisecond * 500)
-	stop := make(chan struct{}, 1)
-	defer func() { stop <- struct{}{} }()
-	go func() {
-		<-stop
+	select {
+	case <-started:
+	case <-time.After(time.Second * 5):
+		t.Fatal("DNS test server failed to start")
+	}
+	return func() {
 		err := server.Shutdown()
 		if err != nil {
 			fmt.Printf("Failed to shutdown DNS test server: %s\n", err)
-			return
 		}
-	}()
+	}
+}
+
+func TestLookupDNSKEY(t *testing.T) {
+	defer startMockServer(t, mockDNSKEYServer)()
 
 	rr := RecursiveResolver{useDNSSEC: true, c: new(dns.Client)}
 	auth := &Nameserver{Zone: "example.", Addr: "127.0.0.1"}
 
+	exampleDS := []dns.RR{exampleKey.ToDS(dns.SHA256)}
+
 	// Valid response
-	keyMap, _, addToCache, err := rr.lookupDNSKEY(context.Background(), auth)
+	keyMap, log, addToCache, err := rr.lookupDNSKEY(context.Background(), auth, exampleDS)
 	if err != nil {
-		t.Fatalf("lookupDNSKEY failed with a valid response with no DS set: %s", err)
+		t.Fatalf("lookupDNSKEY failed with a valid response: %s", err)
+	}
+	if log.DNSSECAlgorithm != "RSASHA256" || log.DSDigestType != "SHA256" {
+		t.Fatalf("lookupDNSKEY log has wrong algorithm or digest type: %q, %q", log.DNSSECAlgorithm, log.DSDigestType)
 	}
 	if len(keyMap) != 1 {
 		t.Fatal("lookupDNSKEY returned incorrect size keyMap for 'example.'")
 	}
-	if k, present := keyMap[exampleKey.KeyTag()]; !present {
+	if keys, present := keyMap[exampleKey.KeyTag()]; !present || len(keys) != 1 {
 		t.Fatal("lookupDNSKEY returned keyMap missing expected key for 'example.'")
-	} else if *k != exampleKey {
+	} else if keys[0].PublicKey != exampleKey.PublicKey || keys[0].Flags != exampleKey.Flags {
 		t.Fatal("lookupDNSKEY returned keyMap containing wrong key with right key tag for 'example.'")
 	}
 	// nothing should happen since cache == nil
 	addToCache()
 
 	// Invalid response, empty answer
-	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: ".", Addr: "127.0.0.1"})
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: ".", Addr: "127.0.0.1"}, exampleDS)
 	if err == nil {
 		t.Fatalf("lookupDNSKEY didn't fail with a empty answer")
 	}
 
 	// Invalid response, bad rcode
-	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "bad.", Addr: "127.0.0.1"})
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "bad.", Addr: "127.0.0.1"}, exampleDS)
 	if err == nil {
 		t.Fatalf("lookupDNSKEY didn't fail with a bad rcode")
 	}
 
 	// Invalid response, wrong types returned
-	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "no-keys-weird.", Addr: "127.0.0.1"})
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "no-keys-weird.", Addr: "127.0.0.1"}, exampleDS)
 	if err == nil {
 		t.Fatalf("lookupDNSKEY didn't fail with a no keys")
 	}
 
 	// Invalid response, bad rcode
-	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "no-keys-weird.", Addr: "127.0.0.1"})
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "no-keys-weird.", Addr: "127.0.0.1"}, exampleDS)
 	if err == nil {
 		t.Fatalf("lookupDNSKEY didn't fail with a no keys")
 	}
 
 	// Invalid response, out of bailiwick records
-	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "out-of-bailiwick.", Addr: "127.0.0.1"})
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "out-of-bailiwick.", Addr: "127.0.0.1"}, exampleDS)
 	if err == nil {
 		t.Fatalf("lookupDNSKEY didn't fail with out of bailiwick records")
 	}
 
 	// Invalid response, invalid signature
-	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "bad-sig.", Addr: "127.0.0.1"})
+	badSigKey := dns.Copy(&exampleKey).(*dns.DNSKEY)
+	badSigKey.Hdr.Name = "bad-sig."
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "bad-sig.", Addr: "127.0.0.1"}, []dns.RR{badSigKey.ToDS(dns.SHA256)})
 	if err == nil {
 		t.Fatalf("lookupDNSKEY didn't fail with bad signature")
 	}
@@ -194,7 +317,7 @@ func TestLookupDNSKEY(t *testing.T) {
 	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc}
 	rr.cache = cache
 
-	_, _, addToCache, err = rr.lookupDNSKEY(context.Background(), auth)
+	_, _, addToCache, err = rr.lookupDNSKEY(context.Background(), auth, exampleDS)
 	if err != nil {
 		t.Fatalf("lookupDNSKEY failed with a valid response: %s", err)
 	}
@@ -205,7 +328,7 @@ func TestLookupDNSKEY(t *testing.T) {
 	eMu.Lock()
 	exampleKeySig.Signature = ""
 	eMu.Unlock()
-	_, _, _, err = rr.lookupDNSKEY(context.Background(), auth)
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), auth, exampleDS)
 	eMu.Lock()
 	exampleKeySig.Signature = goodSig
 	eMu.Unlock()
@@ -214,36 +337,84 @@ func TestLookupDNSKEY(t *testing.T) {
 	}
 }
 
+func TestLookupDNSKEYRequiresDSMatch(t *testing.T) {
+	defer startMockServer(t, mockDNSKEYServer)()
+
+	rr := RecursiveResolver{useDNSSEC: true, c: new(dns.Client)}
+
+	// DNSKEY RRset signed by the KSK matching the DS, ZSK becomes trusted
+	keyMap, _, _, err := rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "signed.", Addr: "127.0.0.1"}, []dns.RR{signedKSK.ToDS(dns.SHA256)})
+	if err != nil {
+		t.Fatalf("lookupDNSKEY failed with DNSKEY RRset signed by DS matched KSK: %s", err)
+	}
+	if _, present := keyMap[signedZSK.KeyTag()]; !present {
+		t.Fatal("lookupDNSKEY didn't return ZSK from authenticated DNSKEY RRset")
+	}
+
+	// No DS records
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "signed.", Addr: "127.0.0.1"}, nil)
+	if err != ErrMissingKSK {
+		t.Fatalf("lookupDNSKEY didn't fail with ErrMissingKSK without DS records: %v", err)
+	}
+
+	// DS matches the ZSK that didn't sign the DNSKEY RRset
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "signed.", Addr: "127.0.0.1"}, []dns.RR{signedZSK.ToDS(dns.SHA256)})
+	if err == nil {
+		t.Fatal("lookupDNSKEY didn't fail when DS matched key didn't sign the DNSKEY RRset")
+	}
+
+	// Rogue ZSK signed the DNSKEY RRset, not the KSK the DS vouches for
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "rogue.", Addr: "127.0.0.1"}, []dns.RR{rogueKSK.ToDS(dns.SHA256)})
+	if err != ErrMissingDNSKEY {
+		t.Fatalf("lookupDNSKEY didn't fail with ErrMissingDNSKEY for DNSKEY RRset signed by rogue ZSK: %v", err)
+	}
+
+	// Trust anchor given as DNSKEY
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "signed.", Addr: "127.0.0.1"}, trustAnchorDS([]dns.RR{signedKSK}))
+	if err != nil {
+		t.Fatalf("lookupDNSKEY failed with DNSKEY trust anchor: %s", err)
+	}
+}
+
 func TestCheckDS(t *testing.T) {
 	k := &dns.DNSKEY{Algorithm: dns.RSASHA256}
 	_, err := k.Generate(512)
 	if err != nil {
 		t.Fatalf("Failed to generate DNSKEY: %s", err)
 	}
-	keyMap := map[uint16]*dns.DNSKEY{}
+	keyMap := map[uint16][]*dns.DNSKEY{}
 	dsSet := []dns.RR{k.ToDS(dns.SHA256)}
 
-	err = checkDS(keyMap, dsSet)
+	_, err = checkDS(keyMap, dsSet)
 	if err == nil {
 		t.Fatal("checkDS did not fail with an empty key map")
 	}
 
-	keyMap[k.KeyTag()] = k
-	err = checkDS(keyMap, dsSet)
+	keyMap[k.KeyTag()] = []*dns.DNSKEY{k}
+	matched, err := checkDS(keyMap, dsSet)
 	if err != nil {
 		t.Fatalf("checkDS failed to verify a valid key and DS combination: %s", err)
 	}
+	if len(matched[k.KeyTag()]) != 1 || matched[k.KeyTag()][0] != k {
+		t.Fatal("checkDS didn't return the key matching the DS record")
+	}
 
 	newDS := k.ToDS(dns.SHA256)
 	newDS.DigestType = dns.SHA1
 	dsSet = []dns.RR{newDS}
-	err = checkDS(keyMap, dsSet)
+	_, err = checkDS(keyMap, dsSet)
 	if err == nil {
 		t.Fatal("checkDS didn't fail with mismatching DS record")
 	}
 
+	// A mismatching DS record doesn't prevent another from matching
+	_, err = checkDS(keyMap, []dns.RR{newDS, k.ToDS(dns.SHA256)})
+	if err != nil {
+		t.Fatalf("checkDS failed with a mismatching and a matching DS record: %s", err)
+	}
+
 	k.PublicKey = "broken"
-	err = checkDS(keyMap, dsSet)
+	_, err = checkDS(keyMap, dsSet)
 	if err == nil {
 		t.Fatal("checkDS didn't fail with malformed KSK record")
 	}
@@ -257,8 +428,9 @@ func TestVerifyRRSIG(t *testing.T) {
 	}
 	rk := pk.(*rsa.PrivateKey)
 
-	keyMap := map[uint16]*dns.DNSKEY{}
-	keyMap[k.KeyTag()] = k
+	keyMap := map[uint16][]*dns.DNSKEY{}
+	keyMap[k.KeyTag()] = []*dns.DNSKEY{k}
+	v := &validator{}
 
 	n := time.Now().UTC().Unix()
 	mod := (n / year68) - 1
@@ -307,28 +479,28 @@ func TestVerifyRRSIG(t *testing.T) {
 
 	// Valid signatures
 	m := &dns.Msg{Answer: append(nsSet, sigB)}
-	err = verifyRRSIG(m, keyMap)
+	err = v.verifyRRSIG(m, keyMap)
 	if err != nil {
 		t.Fatalf("Failed to verify valid RRSIGs: %s", err)
 	}
 
 	// Missing signatures
 	m = &dns.Msg{Answer: aSet}
-	err = verifyRRSIG(m, keyMap)
+	err = v.verifyRRSIG(m, keyMap)
 	if err == nil {
 		t.Fatal("verifyRRSIG didn't fail with missing signatures")
 	}
 
 	// Missing signed records
 	m = &dns.Msg{Answer: []dns.RR{sigA}}
-	err = verifyRRSIG(m, keyMap)
+	err = v.verifyRRSIG(m, keyMap)
 	if err == nil {
 		t.Fatal("verifyRRSIG didn't fail with missing signed records")
 	}
 
 	// Missing key
 	m = &dns.Msg{Answer: append(aSet, sigA)}
-	err = verifyRRSIG(m, make(map[uint16]*dns.DNSKEY))
+	err = v.verifyRRSIG(m, make(map[uint16][]*dns.DNSKEY))
 	if err == nil {
 		t.Fatal("verifyRRSIG didn't fail with missing DNSKEY")
 	}
@@ -336,7 +508,7 @@ func TestVerifyRRSIG(t *testing.T) {
 	// Invalid signature
 	sigA.Signature = ""
 	m = &dns.Msg{Answer: append(aSet, sigA)}
-	err = verifyRRSIG(m, keyMap)
+	err = v.verifyRRSIG(m, keyMap)
 	if err == nil {
 		t.Fatal("verifyRRSIG didn't fail with invalid signature")
 	}
@@ -348,12 +520,331 @@ func TestVerifyRRSIG(t *testing.T) {
 		t.Fatalf("Failed to sign aSet: %s", err)
 	}
 	m = &dns.Msg{Answer: append(aSet, sigA)}
-	err = verifyRRSIG(m, keyMap)
+	err = v.verifyRRSIG(m, keyMap)
 	if err == nil {
 		t.Fatal("verifyRRSIG didn't fail with invalid validity period")
 	}
 }
 
+func TestDelegationDS(t *testing.T) {
+	defer startMockServer(t, mockDNSKEYServer)()
+
+	rr := RecursiveResolver{useDNSSEC: true, c: new(dns.Client)}
+	parent := &Nameserver{Zone: "example.", Addr: "127.0.0.1"}
+	exampleDS := []dns.RR{exampleKey.ToDS(dns.SHA256)}
+
+	// DS records in the referral
+	ds := exampleChildKey.ToDS(dns.SHA256)
+	referral := &dns.Msg{Ns: []dns.RR{ds, signExample([]dns.RR{ds})}}
+	dsSet, _, err := rr.delegationDS(context.Background(), new(validator), "signed.example.", referral, parent, exampleDS)
+	if err != nil {
+		t.Fatalf("delegationDS failed with signed DS records in referral: %s", err)
+	}
+	if len(dsSet) != 1 {
+		t.Fatalf("delegationDS returned wrong number of DS records: expected 1, got %d", len(dsSet))
+	}
+
+	// Signed NSEC in the referral
+	referral = &dns.Msg{Ns: []dns.RR{unsignedNSEC, signExample([]dns.RR{unsignedNSEC})}}
+	dsSet, _, err = rr.delegationDS(context.Background(), new(validator), "unsigned.example.", referral, parent, exampleDS)
+	if err != nil {
+		t.Fatalf("delegationDS failed with signed NSEC records in referral: %s", err)
+	}
+	if len(dsSet) != 0 {
+		t.Fatal("delegationDS returned DS records for insecure delegation")
+	}
+
+	// DS records stripped from the referral, explicit lookup finds them
+	dsSet, _, err = rr.delegationDS(context.Background(), new(validator), "signed.example.", &dns.Msg{}, parent, exampleDS)
+	if err != nil {
+		t.Fatalf("delegationDS failed to lookup DS records missing from referral: %s", err)
+	}
+	if len(dsSet) != 1 {
+		t.Fatalf("delegationDS returned wrong number of DS records: expected 1, got %d", len(dsSet))
+	}
+
+	// Unsigned NSEC in the referral, explicit lookup proves absence
+	referral = &dns.Msg{Ns: []dns.RR{unsignedNSEC}}
+	dsSet, _, err = rr.delegationDS(context.Background(), new(validator), "unsigned.example.", referral, parent, exampleDS)
+	if err != nil {
+		t.Fatalf("delegationDS failed to prove DS absence with explicit lookup: %s", err)
+	}
+	if len(dsSet) != 0 {
+		t.Fatal("delegationDS returned DS records for insecure delegation")
+	}
+
+	// No DS records or proof of their absence
+	_, _, err = rr.delegationDS(context.Background(), new(validator), "stripped.example.", &dns.Msg{}, parent, exampleDS)
+	if err != ErrUnsignedDelegation {
+		t.Fatalf("delegationDS didn't fail with ErrUnsignedDelegation without proof of DS absence: %v", err)
+	}
+
+	// Unsigned NSEC in the DS response
+	_, _, err = rr.delegationDS(context.Background(), new(validator), "forged.example.", &dns.Msg{}, parent, exampleDS)
+	if err != ErrUnsignedDelegation {
+		t.Fatalf("delegationDS didn't fail with ErrUnsignedDelegation with unsigned proof of DS absence: %v", err)
+	}
+}
+
 func TestCheckSignatures(t *testing.T) {
+	defer startMockServer(t, mockDNSKEYServer)()
+
+	rr := RecursiveResolver{useDNSSEC: true, c: new(dns.Client)}
+	auth := &Nameserver{Zone: "example.", Addr: "127.0.0.1"}
+	exampleDS := []dns.RR{exampleKey.ToDS(dns.SHA256)}
+
+	a := &dns.A{Hdr: dns.RR_Header{Name: "www.example.", Rrtype: dns.TypeA, Ttl: 3600}, A: net.IP{1, 2, 3, 4}}
+	sig := signExample([]dns.RR{a})
+	log, err := rr.checkSignatures(context.Background(), new(validator), &dns.Msg{Answer: []dns.RR{a, sig}}, auth, exampleDS)
+	if err != nil {
+		t.Fatalf("checkSignatures failed: %s", err)
+	}
+	if log.Security != Secure || log.SecurityZone != "example." {
+		t.Fatalf("checkSignatures log has wrong security: %s at %q", log.Security, log.SecurityZone)
+	}
+	// the records used are kept for the authentication chain
+	types := map[uint16]int{}
+	for _, r := range log.records {
+		types[r.Header().Rrtype]++
+	}
+	if len(log.records) != 3 || types[dns.TypeDNSKEY] != 1 || types[dns.TypeRRSIG] != 2 {
+		t.Fatalf("checkSignatures kept unexpected records: %v", log.records)
+	}
+
+	_, err = rr.checkSignatures(context.Background(), new(validator), &dns.Msg{Answer: []dns.RR{a}}, auth, exampleDS)
+	if err != ErrNoSignatures {
+		t.Fatalf("checkSignatures didn't fail with ErrNoSignatures for unsigned answer: %v", err)
+	}
+}
+
+func TestSecurityState(t *testing.T) {
+	for _, tc := range []struct {
+		a, b     SecurityStatus
+		expected SecurityStatus
+	}{
+		{Secure, Secure, Secure},
+		{Secure, Insecure, Insecure},
+		{Insecure, Secure, Insecure},
+		{Insecure, Indeterminate, Indeterminate},
+		{Bogus, Secure, Bogus},
+		{Indeterminate, Bogus, Bogus},
+	} {
+		got := securityState{status: tc.a}.worse(securityState{status: tc.b})
+		if got.status != tc.expected {
+			t.Fatalf("worse returned wrong status for %s and %s: expected %s, got %s", tc.a, tc.b, tc.expected, got.status)
+		}
+	}
+
+	text, err := Bogus.MarshalText()
+	if err != nil {
+		t.Fatalf("Failed to marshal SecurityStatus: %s", err)
+	}
+	if string(text) != "Bogus" {
+		t.Fatalf("SecurityStatus marshaled to unexpected text: %q", text)
+	}
+
+	rr := &RecursiveResolver{rootAnchor: trustAnchorDS([]dns.RR{&exampleKey})}
+	if s, _ := rr.initialSecurity(&Question{Name: "example.com."}); s.status != Indeterminate {
+		t.Fatalf("Chain started as %s with DNSSEC disabled", s.status)
+	}
+	rr.useDNSSEC = true
+	if s, ds := rr.initialSecurity(&Question{Name: "example.com."}); s.status != Secure || s.zone != "." || len(ds) != 1 {
+		t.Fatalf("Chain started as %s at %q with %d anchors with DNSSEC enabled", s.status, s.zone, len(ds))
+	}
+	if s, ds := rr.initialSecurity(&Question{Name: "example.com.", CheckingDisabled: true}); s.status != Indeterminate || len(ds) != 0 {
+		t.Fatalf("Chain started as %s with %d anchors with checking disabled", s.status, len(ds))
+	}
+	rr.SetAlgorithmPolicy(&AlgorithmPolicy{DisabledAlgorithms: map[uint8]bool{exampleKey.Algorithm: true}})
+	if s, _ := rr.initialSecurity(&Question{Name: "example.com."}); s.status != Indeterminate {
+		t.Fatalf("Chain started as %s without a usable trust anchor", s.status)
+	}
+}
+
+func TestFindWildcardExpansions(t *testing.T) {
+	answer := []dns.RR{
+		&dns.MX{Hdr: dns.RR_Header{Name: "a.z.w.example.", Rrtype: dns.TypeMX}, Mx: "a.example."},
+		&dns.RRSIG{Hdr: dns.RR_Header{Name: "a.z.w.example.", Rrtype: dns.TypeRRSIG}, TypeCovered: dns.TypeMX, Labels: 2},
+		&dns.A{Hdr: dns.RR_Header{Name: "b.example.", Rrtype: dns.TypeA}},
+		&dns.RRSIG{Hdr: dns.RR_Header{Name: "b.example.", Rrtype: dns.TypeRRSIG}, TypeCovered: dns.TypeA, Labels: 2},
+		&dns.A{Hdr: dns.RR_Header{Name: "*.example.", Rrtype: dns.TypeA}},
+		&dns.RRSIG{Hdr: dns.RR_Header{Name: "*.example.", Rrtype: dns.TypeRRSIG}, TypeCovered: dns.TypeA, Labels: 1},
+	}
+	expansions := findWildcardExpansions(answer)
+	if len(expansions) != 1 {
+		t.Fatalf("findWildcardExpansions returned wrong number of expansions: expected 1, got %d", len(expansions))
+	}
+	if expansions[0].name != "a.z.w.example." || expansions[0].encloser != "w.example." {
+		t.Fatalf("findWildcardExpansions returned unexpected expansion: %#v", expansions[0])
+	}
+
+	// Wildcard answers without proof
+	if err := new(validator).verifyWildcards(answer, nil); err == nil {
+		t.Fatal("verifyWildcards didn't fail without NSEC records")
+	}
+	if err := new(validator).verifyWildcards(answer[2:], nil); err != nil {
+		t.Fatalf("verifyWildcards failed for non-wildcard answer: %s", err)
+	}
+}
+
+func TestVerifyRRSIGLabels(t *testing.T) {
+	k := &dns.DNSKEY{Hdr: dns.RR_Header{Name: "org."}, Algorithm: dns.RSASHA256, Protocol: 3}
+	pk, err := k.Generate(512)
+	if err != nil {
+		t.Fatalf("Failed to generate DNSKEY: %s", err)
+	}
+	keyMap := map[uint16][]*dns.DNSKEY{k.KeyTag(): {k}}
+	v := &validator{}
+	aSet := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.org.", Rrtype: dns.TypeA}, A: net.IP{1, 2, 3, 4}}}
+	sig := &dns.RRSIG{
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		KeyTag:     k.KeyTag(),
+		SignerName: "org.",
+		Algorithm:  dns.RSASHA256,
+	}
+	err = sig.Sign(pk.(*rsa.PrivateKey), aSet)
+	if err != nil {
+		t.Fatalf("Failed to sign aSet: %s", err)
+	}
+	sig.Labels = 3
+	err = v.verifyRRSIG(&dns.Msg{Answer: append(aSet, sig)}, keyMap)
+	if err != ErrInvalidLabelCount {
+		t.Fatalf("verifyRRSIG didn't fail with ErrInvalidLabelCount for too large label count: %v", err)
+	}
+}
+
+func TestVerifyRRSIGAlgorithmPolicy(t *testing.T) {
+	k, pk := newTestKey("org.", dns.ZONE)
+	keyMap := map[uint16][]*dns.DNSKEY{k.KeyTag(): {k}}
+	aSet := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.org.", Rrtype: dns.TypeA}, A: net.IP{1, 2, 3, 4}}}
+	sig := signWith(k, pk, aSet)
+	unknown := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: "a.org.", Rrtype: dns.TypeRRSIG},
+		TypeCovered: dns.TypeA,
+		Algorithm:   15, // Ed25519
+		Labels:      2,
+		KeyTag:      1,
+		SignerName:  "org.",
+	}
+
+	v := &validator{}
+	// Signatures using unknown algorithms are ignored if another validates
+	err := v.verifyRRSIG(&dns.Msg{Answer: append(aSet, sig, unknown)}, keyMap)
+	if err != nil {
+		t.Fatalf("verifyRRSIG failed with additional unknown algorithm signature: %s", err)
+	}
+	err = v.verifyRRSIG(&dns.Msg{Answer: append(aSet, unknown)}, keyMap)
+	if err != ErrUnsupportedAlgorithm {
+		t.Fatalf("verifyRRSIG didn't fail with ErrUnsupportedAlgorithm for RRset only signed with unknown algorithm: %v", err)
+	}
+
+	v = &validator{algorithms: &AlgorithmPolicy{DisabledAlgorithms: map[uint8]bool{k.Algorithm: true}}}
+	err = v.verifyRRSIG(&dns.Msg{Answer: append(aSet, sig)}, keyMap)
+	if err != ErrUnsupportedAlgorithm {
+		t.Fatalf("verifyRRSIG didn't fail with ErrUnsupportedAlgorithm for RRset signed with disabled algorithm: %v", err)
+	}
+}
 
+func TestCheckValidityPeriod(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	sig := &dns.RRSIG{
+		Inception:  uint32(now.Add(time.Minute).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	v := &validator{now: now}
+	if err := v.checkValidityPeriod(sig); err != ErrSignatureNotYetValid {
+		t.Fatalf("checkValidityPeriod didn't fail with ErrSignatureNotYetValid for future inception: %v", err)
+	}
+	v.skew = 2 * time.Minute
+	if err := v.checkValidityPeriod(sig); err != nil {
+		t.Fatalf("checkValidityPeriod failed for inception inside clock skew: %s", err)
+	}
+
+	v = &validator{now: now.Add(time.Hour + time.Minute)}
+	if err := v.checkValidityPeriod(sig); err != ErrInvalidSignaturePeriod {
+		t.Fatalf("checkValidityPeriod didn't fail with ErrInvalidSignaturePeriod for expired signature: %v", err)
+	}
+	v.skew = 2 * time.Minute
+	if err := v.checkValidityPeriod(sig); err != nil {
+		t.Fatalf("checkValidityPeriod failed for expiration inside clock skew: %s", err)
+	}
+}
+
+func TestCapTTL(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: 86400},
+		OrigTtl:    300,
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	rrset := []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Ttl: 86400}},
+		&dns.A{Hdr: dns.RR_Header{Ttl: 60}},
+	}
+	v := &validator{now: now}
+	v.capTTL(sig, rrset)
+	for i, ttl := range []uint32{300, 60} {
+		if rrset[i].Header().Ttl != ttl {
+			t.Fatalf("capTTL set wrong TTL: expected %d, got %d", ttl, rrset[i].Header().Ttl)
+		}
+	}
+	if sig.Hdr.Ttl != 300 {
+		t.Fatalf("capTTL didn't cap signature TTL to the original TTL: got %d", sig.Hdr.Ttl)
+	}
+
+	// Signature expires before the original TTL
+	v.now = now.Add(time.Hour - 10*time.Second)
+	v.capTTL(sig, rrset)
+	if rrset[0].Header().Ttl != 10 {
+		t.Fatalf("capTTL didn't cap TTL to signature expiration: expected 10, got %d", rrset[0].Header().Ttl)
+	}
+}
+
+func TestVerifyKeyTagCollisions(t *testing.T) {
+	k, pk := newTestKey("org.", dns.ZONE)
+	other, _ := newTestKey("org.", dns.ZONE)
+	aSet := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.org.", Rrtype: dns.TypeA}, A: net.IP{1, 2, 3, 4}}}
+	sig := signWith(k, pk, aSet)
+
+	// The signing key is found even if another key is stored with the same tag
+	keyMap := map[uint16][]*dns.DNSKEY{k.KeyTag(): {other, k}}
+	v := &validator{}
+	if err := v.verifyRRSIG(&dns.Msg{Answer: append(aSet, sig)}, keyMap); err != nil {
+		t.Fatalf("verifyRRSIG failed with colliding key tags: %s", err)
+	}
+	if v.signatures != 2 {
+		t.Fatalf("verifyRRSIG didn't count verification attempts: expected 2, got %d", v.signatures)
+	}
+
+	keys := []*dns.DNSKEY{}
+	for i := 0; i <= MaxKeyTagCollisions; i++ {
+		keys = append(keys, other)
+	}
+	keyMap[k.KeyTag()] = append(keys, k)
+	err := (&validator{}).verifyRRSIG(&dns.Msg{Answer: append(aSet, sig)}, keyMap)
+	if err != ErrTooManyKeyTagCollisions {
+		t.Fatalf("verifyRRSIG didn't fail with ErrTooManyKeyTagCollisions: %v", err)
+	}
+	_, err = checkDS(keyMap, []dns.RR{k.ToDS(dns.SHA256)})
+	if err != ErrTooManyKeyTagCollisions {
+		t.Fatalf("checkDS didn't fail with ErrTooManyKeyTagCollisions: %v", err)
+	}
+}
+
+func TestVerifySignatureLimit(t *testing.T) {
+	k, pk := newTestKey("org.", dns.ZONE)
+	keyMap := map[uint16][]*dns.DNSKEY{k.KeyTag(): {k}}
+	answer := []dns.RR{}
+	for i := 0; i <= MaxSignatureValidations; i++ {
+		aSet := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: fmt.Sprintf("%d.org.", i), Rrtype: dns.TypeA}, A: net.IP{1, 2, 3, 4}}}
+		answer = append(answer, aSet[0], signWith(k, pk, aSet))
+	}
+	err := (&validator{}).verifyRRSIG(&dns.Msg{Answer: answer}, keyMap)
+	if err != ErrTooManySignatures {
+		t.Fatalf("verifyRRSIG didn't fail with ErrTooManySignatures: %v", err)
+	}
+	err = (&validator{}).verifyRRSIG(&dns.Msg{Answer: answer[2:]}, keyMap)
+	if err != nil {
+		t.Fatalf("verifyRRSIG failed with MaxSignatureValidations signatures: %s", err)
+	}
 }
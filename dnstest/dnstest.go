@@ -0,0 +1,776 @@
+// Package dnstest serves a simulated DNS hierarchy, optionally signed using
+// DNSSEC, on loopback addresses so resolvers can be tested without network
+// access
+package dnstest
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	ErrNoRootZone    = errors.New("dnstest: Hierarchy has no root zone")
+	ErrDuplicateZone = errors.New("dnstest: Zone is defined more than once")
+	ErrUnknownHost   = errors.New("dnstest: Zone is hosted by a zone that isn't defined or is itself hosted")
+)
+
+// NSEC3Params describes the NSEC3 chain used to deny the existence of names in
+// a zone
+type NSEC3Params struct {
+	Iterations uint16
+	Salt       string
+}
+
+// Zone describes a zone in the hierarchy. SOA, apex NS and nameserver address
+// records are added to every zone, and delegations (NS, glue and DS records) to
+// their parent zones. Every zone is served by its own nameserver,
+// ns.<zone name>, unless it is hosted by another zone's nameserver.
+type Zone struct {
+	// Name is the name of the apex of the zone
+	Name string
+	// Records contains the records in the zone in zone file format, relative
+	// names are relative to Name
+	Records string
+	// Unsigned zones aren't signed and have no DS records in their parent
+	Unsigned bool
+	// NSEC3 causes the zone to use NSEC3 records instead of NSEC records
+	NSEC3 *NSEC3Params
+	// Algorithm is the DNSKEY algorithm used to sign the zone, by default
+	// ECDSAP256SHA256
+	Algorithm uint8
+	// Inception and Expiration set the validity period of the signatures in
+	// the zone, by default a hour before until a day after the hierarchy is
+	// created
+	Inception  time.Time
+	Expiration time.Time
+	// Undelegated zones aren't delegated from their parent zone, so can only be
+	// reached by querying their nameserver directly
+	Undelegated bool
+	// HostedBy is the name of a zone whose nameserver also serves this zone,
+	// instead of it having its own
+	HostedBy string
+}
+
+// Hierarchy is a set of zones served on loopback addresses
+type Hierarchy struct {
+	// Port is the port every nameserver in the hierarchy listens on
+	Port string
+	// Hints contains the NS and A records for the root zone nameserver
+	Hints []dns.RR
+	// TrustAnchors contains the KSK of the root zone, if it is signed
+	TrustAnchors []dns.RR
+
+	zones   map[string]*zone
+	servers []*dns.Server
+}
+
+// server is a nameserver that serves one or more zones
+type server struct {
+	zones []*zone
+}
+
+type zone struct {
+	Zone
+	addr string
+
+	records map[string]map[uint16][]dns.RR
+	sigs    map[string]map[uint16][]dns.RR
+	// cuts contains the names of child zones
+	cuts map[string]struct{}
+	// names contains the owner names in canonical order, including empty
+	// non-terminals
+	names []string
+	// hashes contains the NSEC3 records keyed by the hash of their owner name
+	// and the sorted hashes
+	hashes    map[string]*dns.NSEC3
+	hashOrder []string
+
+	ksk, zsk         *dns.DNSKEY
+	kskPriv, zskPriv crypto.Signer
+}
+
+// maxAddresses is the number of loopback addresses available to nameservers,
+// starting at 127.0.0.2
+const maxAddresses = 250
+
+// New builds the zones, signs them, and starts serving them. The zones must
+// include the root zone.
+func New(zones []Zone) (*Hierarchy, error) {
+	h := &Hierarchy{zones: make(map[string]*zone)}
+	if len(zones) > maxAddresses {
+		return nil, fmt.Errorf("dnstest: Hierarchy can contain at most %d zones", maxAddresses)
+	}
+	now := time.Now()
+	addrs := make(map[string]string, len(zones))
+	for i, zc := range zones {
+		if zc.HostedBy == "" {
+			addrs[strings.ToLower(dns.Fqdn(zc.Name))] = fmt.Sprintf("127.0.0.%d", i+2)
+		}
+	}
+	for _, zc := range zones {
+		host := zc.Name
+		if zc.HostedBy != "" {
+			host = zc.HostedBy
+		}
+		addr, present := addrs[strings.ToLower(dns.Fqdn(host))]
+		if !present {
+			return nil, ErrUnknownHost
+		}
+		z := &zone{
+			Zone:    zc,
+			addr:    addr,
+			records: make(map[string]map[uint16][]dns.RR),
+			sigs:    make(map[string]map[uint16][]dns.RR),
+			cuts:    make(map[string]struct{}),
+		}
+		z.Name = strings.ToLower(dns.Fqdn(zc.Name))
+		if _, present := h.zones[z.Name]; present {
+			return nil, ErrDuplicateZone
+		}
+		if z.Algorithm == 0 {
+			z.Algorithm = dns.ECDSAP256SHA256
+		}
+		if z.Inception.IsZero() {
+			z.Inception = now.Add(-time.Hour)
+		}
+		if z.Expiration.IsZero() {
+			z.Expiration = now.Add(24 * time.Hour)
+		}
+		err := z.load()
+		if err != nil {
+			return nil, err
+		}
+		h.zones[z.Name] = z
+	}
+	root, present := h.zones["."]
+	if !present {
+		return nil, ErrNoRootZone
+	}
+
+	for _, z := range h.zones {
+		if z.Name == "." || z.Undelegated {
+			continue
+		}
+		parent := h.parent(z.Name)
+		parent.delegate(z)
+	}
+	for _, z := range h.zones {
+		err := z.sign()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h.Hints = []dns.RR{
+		&dns.NS{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: nsName(".")},
+		&dns.A{Hdr: dns.RR_Header{Name: nsName("."), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP(root.addr)},
+	}
+	if !root.Unsigned {
+		h.TrustAnchors = []dns.RR{root.ksk}
+	}
+
+	err := h.serve()
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// parent returns the closest zone enclosing name, not including name itself
+func (h *Hierarchy) parent(name string) *zone {
+	for _, a := range ancestors(name) {
+		if z, present := h.zones[a]; present {
+			return z
+		}
+	}
+	return h.zones["."]
+}
+
+// ancestors returns the names above name, closest first
+func ancestors(name string) []string {
+	names := []string{}
+	if name == "." {
+		return names
+	}
+	for _, i := range dns.Split(name)[1:] {
+		names = append(names, name[i:])
+	}
+	return append(names, ".")
+}
+
+// serve starts a nameserver for each address, all using the same port
+func (h *Hierarchy) serve() error {
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		h.Port = "0"
+		err = h.listen()
+		if err == nil {
+			return nil
+		}
+		h.Close()
+		h.servers = nil
+	}
+	return err
+}
+
+func (h *Hierarchy) listen() error {
+	servers := map[string]*server{}
+	for _, z := range h.zones {
+		if servers[z.addr] == nil {
+			servers[z.addr] = &server{}
+		}
+		servers[z.addr].zones = append(servers[z.addr].zones, z)
+	}
+	addrs := []string{}
+	for addr := range servers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		s := servers[addr]
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(addr, h.Port))
+		if err != nil {
+			return err
+		}
+		if h.Port == "0" {
+			_, h.Port, _ = net.SplitHostPort(conn.LocalAddr().String())
+		}
+		started := make(chan struct{})
+		server := &dns.Server{
+			PacketConn:        conn,
+			Handler:           dns.HandlerFunc(s.handle),
+			ReadTimeout:       time.Second,
+			WriteTimeout:      time.Second,
+			NotifyStartedFunc: func() { close(started) },
+		}
+		h.servers = append(h.servers, server)
+		go server.ActivateAndServe()
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			return fmt.Errorf("dnstest: Nameserver at %s failed to start", addr)
+		}
+	}
+	return nil
+}
+
+// Close stops all of the nameservers
+func (h *Hierarchy) Close() {
+	for _, s := range h.servers {
+		s.Shutdown()
+	}
+}
+
+// Address returns the address of the nameserver for a zone
+func (h *Hierarchy) Address(name string) string {
+	if z, present := h.zones[strings.ToLower(dns.Fqdn(name))]; present {
+		return z.addr
+	}
+	return ""
+}
+
+// Keys returns the KSK and ZSK of a signed zone
+func (h *Hierarchy) Keys(name string) (*dns.DNSKEY, *dns.DNSKEY) {
+	if z, present := h.zones[strings.ToLower(dns.Fqdn(name))]; present && !z.Unsigned {
+		return z.ksk, z.zsk
+	}
+	return nil, nil
+}
+
+func nsName(zone string) string {
+	if zone == "." {
+		return "ns."
+	}
+	return "ns." + zone
+}
+
+// load parses the records of the zone and generates its keys
+func (z *zone) load() error {
+	for t := range dns.ParseZone(strings.NewReader(z.Records), z.Name, "") {
+		if t.Error != nil {
+			return t.Error
+		}
+		z.add(t.RR)
+	}
+	if len(z.records[z.Name][dns.TypeSOA]) == 0 {
+		z.add(&dns.SOA{
+			Hdr:     dns.RR_Header{Name: z.Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:      nsName(z.Name),
+			Mbox:    "hostmaster." + strings.TrimPrefix(z.Name, "."),
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  300,
+		})
+	}
+	z.add(&dns.NS{Hdr: dns.RR_Header{Name: z.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: nsName(z.Name)})
+	z.add(&dns.A{Hdr: dns.RR_Header{Name: nsName(z.Name), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP(z.addr)})
+	if z.Unsigned {
+		return nil
+	}
+
+	var err error
+	z.ksk, z.kskPriv, err = z.generateKey(dns.ZONE | dns.SEP)
+	if err != nil {
+		return err
+	}
+	z.zsk, z.zskPriv, err = z.generateKey(dns.ZONE)
+	if err != nil {
+		return err
+	}
+	z.add(z.ksk)
+	z.add(z.zsk)
+	return nil
+}
+
+func (z *zone) generateKey(flags uint16) (*dns.DNSKEY, crypto.Signer, error) {
+	k := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: z.Name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: z.Algorithm,
+	}
+	bits := 256
+	switch z.Algorithm {
+	case dns.ECDSAP384SHA384:
+		bits = 384
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512:
+		bits = 1024
+	}
+	priv, err := k.Generate(bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("dnstest: Algorithm %d can't be used for signing", z.Algorithm)
+	}
+	return k, signer, nil
+}
+
+func (z *zone) add(r dns.RR) {
+	name := strings.ToLower(r.Header().Name)
+	r.Header().Name = name
+	if z.records[name] == nil {
+		z.records[name] = make(map[uint16][]dns.RR)
+	}
+	z.records[name][r.Header().Rrtype] = append(z.records[name][r.Header().Rrtype], r)
+}
+
+// delegate adds the delegation to child, which must be below z
+func (z *zone) delegate(child *zone) {
+	z.cuts[child.Name] = struct{}{}
+	z.add(&dns.NS{Hdr: dns.RR_Header{Name: child.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: nsName(child.Name)})
+	z.add(&dns.A{Hdr: dns.RR_Header{Name: nsName(child.Name), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP(child.addr)})
+	if !child.Unsigned {
+		ds := child.ksk.ToDS(dns.SHA256)
+		ds.Hdr.Ttl = 3600
+		z.add(ds)
+	}
+}
+
+// cut returns the zone cut at or above name if there is one
+func (z *zone) cut(name string) string {
+	labels := dns.Split(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		if _, present := z.cuts[name[labels[i]:]]; present {
+			return name[labels[i]:]
+		}
+	}
+	return ""
+}
+
+// authoritative returns true if the records at name are part of the zone
+// rather than glue below a zone cut
+func (z *zone) authoritative(name string) bool {
+	c := z.cut(name)
+	return c == "" || c == name
+}
+
+func (z *zone) signRRset(rrset []dns.RR) error {
+	key, priv := z.zsk, z.zskPriv
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		key, priv = z.ksk, z.kskPriv
+	}
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Inception:  uint32(z.Inception.Unix()),
+		Expiration: uint32(z.Expiration.Unix()),
+		KeyTag:     key.KeyTag(),
+		SignerName: z.Name,
+		Algorithm:  key.Algorithm,
+	}
+	err := sig.Sign(priv, rrset)
+	if err != nil {
+		return err
+	}
+	name := rrset[0].Header().Name
+	if z.sigs[name] == nil {
+		z.sigs[name] = make(map[uint16][]dns.RR)
+	}
+	z.sigs[name][sig.TypeCovered] = append(z.sigs[name][sig.TypeCovered], sig)
+	return nil
+}
+
+// canonicalLess orders names using the canonical DNS name order defined in
+// RFC 4034 Section 6.1
+func canonicalLess(a, b string) bool {
+	al, bl := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i := 1; i <= len(al) && i <= len(bl); i++ {
+		x, y := strings.ToLower(al[len(al)-i]), strings.ToLower(bl[len(bl)-i])
+		if x != y {
+			return x < y
+		}
+	}
+	return len(al) < len(bl)
+}
+
+// sign builds the denial of existence chain and signs every authoritative RRset
+func (z *zone) sign() error {
+	names := map[string]struct{}{}
+	for name := range z.records {
+		if !z.authoritative(name) {
+			continue
+		}
+		names[name] = struct{}{}
+		// empty non-terminals exist too
+		for _, a := range ancestors(name) {
+			if dns.CountLabel(a) <= dns.CountLabel(z.Name) {
+				break
+			}
+			names[a] = struct{}{}
+		}
+	}
+	for name := range names {
+		z.names = append(z.names, name)
+	}
+	sort.Slice(z.names, func(i, j int) bool { return canonicalLess(z.names[i], z.names[j]) })
+	if z.Unsigned {
+		return nil
+	}
+
+	if z.NSEC3 != nil {
+		z.add(&dns.NSEC3PARAM{
+			Hdr:        dns.RR_Header{Name: z.Name, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: 0},
+			Hash:       dns.SHA1,
+			Iterations: z.NSEC3.Iterations,
+			SaltLength: uint8(len(z.NSEC3.Salt) / 2),
+			Salt:       z.NSEC3.Salt,
+		})
+	}
+
+	for _, name := range z.names {
+		for t, rrset := range z.records[name] {
+			if t == dns.TypeNS && name != z.Name {
+				// delegation NS records aren't signed
+				continue
+			}
+			if err := z.signRRset(rrset); err != nil {
+				return err
+			}
+		}
+	}
+
+	if z.NSEC3 != nil {
+		return z.buildNSEC3()
+	}
+	return z.buildNSEC()
+}
+
+// types returns the types in the bitmap of the NSEC or NSEC3 record for name
+func (z *zone) types(name string) []uint16 {
+	types := []uint16{}
+	for t := range z.records[name] {
+		types = append(types, t)
+	}
+	if len(z.sigs[name]) > 0 {
+		types = append(types, dns.TypeRRSIG)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+func (z *zone) buildNSEC() error {
+	owners := []string{}
+	for _, name := range z.names {
+		if len(z.records[name]) > 0 {
+			owners = append(owners, name)
+		}
+	}
+	for i, name := range owners {
+		types := append(z.types(name), dns.TypeNSEC)
+		if len(z.sigs[name]) == 0 {
+			types = append(types, dns.TypeRRSIG)
+		}
+		sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+		nsec := &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: owners[(i+1)%len(owners)],
+			TypeBitMap: types,
+		}
+		z.add(nsec)
+		if err := z.signRRset([]dns.RR{nsec}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (z *zone) hash(name string) string {
+	return dns.HashName(name, dns.SHA1, z.NSEC3.Iterations, z.NSEC3.Salt)
+}
+
+func (z *zone) buildNSEC3() error {
+	z.hashes = make(map[string]*dns.NSEC3)
+	owners := map[string]string{}
+	for _, name := range z.names {
+		h := z.hash(name)
+		owners[h] = name
+		z.hashOrder = append(z.hashOrder, h)
+	}
+	sort.Strings(z.hashOrder)
+	for i, h := range z.hashOrder {
+		nsec3 := &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(h) + "." + strings.TrimPrefix(z.Name, "."), Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Iterations: z.NSEC3.Iterations,
+			SaltLength: uint8(len(z.NSEC3.Salt) / 2),
+			Salt:       z.NSEC3.Salt,
+			HashLength: 20,
+			NextDomain: z.hashOrder[(i+1)%len(z.hashOrder)],
+			TypeBitMap: z.types(owners[h]),
+		}
+		z.hashes[h] = nsec3
+		if err := z.signRRset([]dns.RR{nsec3}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rrset returns a RRset and, if dnssec is true, its signatures
+func (z *zone) rrset(name string, t uint16, dnssec bool) []dns.RR {
+	rrs := append([]dns.RR{}, z.records[name][t]...)
+	if dnssec && len(rrs) > 0 {
+		rrs = append(rrs, z.sigs[name][t]...)
+	}
+	return rrs
+}
+
+// exists returns true if name owns records or is a empty non-terminal
+func (z *zone) exists(name string) bool {
+	i := sort.Search(len(z.names), func(i int) bool { return !canonicalLess(z.names[i], name) })
+	return i < len(z.names) && z.names[i] == name
+}
+
+// closestEncloser returns the closest existing ancestor of name
+func (z *zone) closestEncloser(name string) string {
+	for _, a := range ancestors(name) {
+		if z.exists(a) {
+			return a
+		}
+	}
+	return z.Name
+}
+
+func wildcard(encloser string) string {
+	if encloser == "." {
+		return "*."
+	}
+	return "*." + encloser
+}
+
+// nsecFor returns the NSEC record that matches or covers name
+func (z *zone) nsecFor(name string) []dns.RR {
+	owners := []string{}
+	for _, n := range z.names {
+		if len(z.records[n][dns.TypeNSEC]) > 0 {
+			owners = append(owners, n)
+		}
+	}
+	owner := owners[len(owners)-1]
+	for _, n := range owners {
+		if canonicalLess(name, n) {
+			break
+		}
+		owner = n
+	}
+	return z.rrset(owner, dns.TypeNSEC, true)
+}
+
+// nsec3For returns the NSEC3 record that matches or covers name
+func (z *zone) nsec3For(name string) []dns.RR {
+	h := z.hash(name)
+	owner := z.hashOrder[len(z.hashOrder)-1]
+	for _, o := range z.hashOrder {
+		if h < o {
+			break
+		}
+		owner = o
+	}
+	nsec3 := z.hashes[owner]
+	return append([]dns.RR{nsec3}, z.sigs[nsec3.Hdr.Name][dns.TypeNSEC3]...)
+}
+
+// denial returns the records proving name doesn't exist, or if it does exist
+// that it doesn't have the requested type. encloser is the closest encloser
+// of name and wildcard is true if a wildcard was used to synthesize a answer.
+func (z *zone) denial(name, encloser string, exists, wildcardAnswer bool) []dns.RR {
+	var rrs []dns.RR
+	if z.NSEC3 == nil {
+		rrs = z.nsecFor(name)
+		if !exists && !wildcardAnswer {
+			rrs = append(rrs, z.nsecFor(wildcard(encloser))...)
+		}
+	} else if exists {
+		rrs = z.nsec3For(name)
+	} else {
+		next := name
+		labels := dns.Split(name)
+		for i := len(labels) - 1; i >= 0; i-- {
+			if dns.CountLabel(name[labels[i]:]) == dns.CountLabel(encloser)+1 {
+				next = name[labels[i]:]
+				break
+			}
+		}
+		rrs = z.nsec3For(next)
+		if !wildcardAnswer {
+			rrs = append(rrs, z.nsec3For(encloser)...)
+			rrs = append(rrs, z.nsec3For(wildcard(encloser))...)
+		}
+	}
+	// the same record may prove more than one thing
+	unique := []dns.RR{}
+	seen := map[string]struct{}{}
+	for _, r := range rrs {
+		key := r.String()
+		if _, present := seen[key]; !present {
+			seen[key] = struct{}{}
+			unique = append(unique, r)
+		}
+	}
+	return unique
+}
+
+// zone returns the zone that should answer a question about name, the
+// closest one enclosing it, except for DS questions which are answered by the
+// parent of a zone if it is served as well (RFC 4035 Section 3.1.4.1)
+func (s *server) zone(name string, qtype uint16) *zone {
+	closest, parent := s.zones[0], (*zone)(nil)
+	for _, z := range s.zones {
+		if !dns.IsSubDomain(z.Name, name) {
+			continue
+		}
+		if !dns.IsSubDomain(closest.Name, name) || dns.CountLabel(z.Name) > dns.CountLabel(closest.Name) {
+			closest = z
+		}
+		if z.Name != name && (parent == nil || dns.CountLabel(z.Name) > dns.CountLabel(parent.Name)) {
+			parent = z
+		}
+	}
+	if qtype == dns.TypeDS && closest.Name == name && parent != nil {
+		return parent
+	}
+	return closest
+}
+
+func (s *server) handle(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if len(r.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		w.WriteMsg(m)
+		return
+	}
+	name := strings.ToLower(r.Question[0].Name)
+	z := s.zone(name, r.Question[0].Qtype)
+	dnssec := false
+	if opt := r.IsEdns0(); opt != nil {
+		dnssec = opt.Do() && !z.Unsigned
+		m.SetEdns0(4096, opt.Do())
+	}
+	z.answer(m, name, r.Question[0].Qtype, dnssec)
+	w.WriteMsg(m)
+}
+
+func (z *zone) answer(m *dns.Msg, name string, qtype uint16, dnssec bool) {
+	if !dns.IsSubDomain(z.Name, name) {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	soa := func() []dns.RR { return z.rrset(z.Name, dns.TypeSOA, dnssec) }
+
+	if c := z.cut(name); c != "" && !(c == name && qtype == dns.TypeDS) {
+		m.Ns = z.rrset(c, dns.TypeNS, false)
+		if dnssec {
+			if ds := z.rrset(c, dns.TypeDS, true); len(ds) > 0 {
+				m.Ns = append(m.Ns, ds...)
+			} else {
+				m.Ns = append(m.Ns, z.denial(c, "", true, false)...)
+			}
+		}
+		for _, ns := range z.records[c][dns.TypeNS] {
+			m.Extra = append(m.Extra, z.rrset(ns.(*dns.NS).Ns, dns.TypeA, false)...)
+		}
+		return
+	}
+	m.Authoritative = true
+
+	if z.exists(name) {
+		if rrs := z.rrset(name, qtype, dnssec); len(rrs) > 0 {
+			m.Answer = rrs
+			return
+		}
+		if rrs := z.rrset(name, dns.TypeCNAME, dnssec); len(rrs) > 0 {
+			m.Answer = rrs
+			return
+		}
+		m.Ns = soa()
+		if dnssec {
+			m.Ns = append(m.Ns, z.denial(name, "", true, false)...)
+		}
+		return
+	}
+
+	encloser := z.closestEncloser(name)
+	source := wildcard(encloser)
+	if !z.exists(source) {
+		m.Rcode = dns.RcodeNameError
+		m.Ns = soa()
+		if dnssec {
+			m.Ns = append(m.Ns, z.denial(name, encloser, false, false)...)
+		}
+		return
+	}
+	t := qtype
+	if len(z.records[source][t]) == 0 {
+		t = dns.TypeCNAME
+	}
+	for _, r := range z.rrset(source, t, dnssec) {
+		synthesized := dns.Copy(r)
+		synthesized.Header().Name = name
+		m.Answer = append(m.Answer, synthesized)
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = soa()
+		if dnssec {
+			m.Ns = append(m.Ns, z.denial(name, encloser, false, false)...)
+			if z.NSEC3 == nil {
+				m.Ns = append(m.Ns, z.nsecFor(source)...)
+			}
+		}
+		return
+	}
+	if dnssec {
+		m.Ns = z.denial(name, encloser, false, true)
+	}
+}
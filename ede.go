@@ -0,0 +1,139 @@
+package solvere
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS0EDE is the EDNS0 option code used for Extended DNS Errors (RFC 8914)
+const EDNS0EDE = 15
+
+// Extended DNS Error info codes (RFC 8914 Section 4)
+const (
+	EDEOther                      = 0
+	EDEUnsupportedDNSKEYAlgorithm = 1
+	EDEUnsupportedDSDigestType    = 2
+	EDEStaleAnswer                = 3
+	EDEForgedAnswer               = 4
+	EDEDNSSECIndeterminate        = 5
+	EDEDNSSECBogus                = 6
+	EDESignatureExpired           = 7
+	EDESignatureNotYetValid       = 8
+	EDEDNSKEYMissing              = 9
+	EDERRSIGsMissing              = 10
+	EDENoZoneKeyBitSet            = 11
+	EDENSECMissing                = 12
+	EDECachedError                = 13
+	EDENotReady                   = 14
+	EDEBlocked                    = 15
+	EDECensored                   = 16
+	EDEFiltered                   = 17
+	EDEProhibited                 = 18
+	EDEStaleNXDOMAINAnswer        = 19
+	EDENotAuthoritative           = 20
+	EDENotSupported               = 21
+	EDENoReachableAuthority       = 22
+	EDENetworkError               = 23
+	EDEInvalidData                = 24
+	// Defined in RFC 9276 Section 3.2
+	EDEUnsupportedNSEC3Iterations = 27
+)
+
+// ExtendedError describes why a lookup failed using an Extended DNS Error
+// info code and some human readable extra text
+type ExtendedError struct {
+	InfoCode  uint16
+	ExtraText string `json:",omitempty"`
+}
+
+func (ee *ExtendedError) String() string {
+	if ee.ExtraText == "" {
+		return fmt.Sprintf("EDE %d", ee.InfoCode)
+	}
+	return fmt.Sprintf("EDE %d: %s", ee.InfoCode, ee.ExtraText)
+}
+
+// EDNS0 returns the wire representation of the error as a EDNS0 option that
+// can be appended to the OPT record of a response
+func (ee *ExtendedError) EDNS0() dns.EDNS0 {
+	data := make([]byte, 2+len(ee.ExtraText))
+	binary.BigEndian.PutUint16(data, ee.InfoCode)
+	copy(data[2:], ee.ExtraText)
+	return &dns.EDNS0_LOCAL{Code: EDNS0EDE, Data: data}
+}
+
+var errorInfoCodes = map[error]uint16{
+	ErrTooManyReferrals:   EDENoReachableAuthority,
+	ErrNoNSAuthorties:     EDENoReachableAuthority,
+	ErrNoAuthorityAddress: EDENoReachableAuthority,
+	ErrOutOfBailiwick:     EDEInvalidData,
+	ErrUnsignedDelegation: EDENSECMissing,
+	dnameTooLong:          EDEInvalidData,
+
+	ErrNoDNSKEY:               EDEDNSKEYMissing,
+	ErrMissingKSK:             EDEDNSKEYMissing,
+	ErrFailedToConvertKSK:     EDEDNSSECBogus,
+	ErrMismatchingDS:          EDEDNSSECBogus,
+	ErrNoSignatures:           EDERRSIGsMissing,
+	ErrMissingDNSKEY:          EDEDNSKEYMissing,
+	ErrInvalidSignaturePeriod: EDESignatureExpired,
+	ErrSignatureNotYetValid:   EDESignatureNotYetValid,
+	ErrMissingSigned:          EDEDNSSECBogus,
+	ErrInvalidLabelCount:      EDEDNSSECBogus,
+	ErrUnsupportedAlgorithm:   EDEUnsupportedDNSKEYAlgorithm,
+
+	ErrTooManySignatures:       EDEDNSSECBogus,
+	ErrTooManyKeyTagCollisions: EDEDNSSECBogus,
+	ErrTooManyNSEC3Hashes:      EDEDNSSECBogus,
+
+	ErrNSECMismatch:         EDEDNSSECBogus,
+	ErrNSECTypeExists:       EDEDNSSECBogus,
+	ErrNSECMultipleCoverage: EDEDNSSECBogus,
+	ErrNSECMissingCoverage:  EDENSECMissing,
+	ErrNSECBadDelegation:    EDEDNSSECBogus,
+	ErrNSECNSMissing:        EDEDNSSECBogus,
+	ErrNSECOptOut:           EDEDNSSECBogus,
+	ErrWildcardMissingProof: EDENSECMissing,
+	ErrNSEC3Iterations:      EDEUnsupportedNSEC3Iterations,
+
+	dns.ErrSig: EDEDNSSECBogus,
+	dns.ErrKey: EDEDNSSECBogus,
+	dns.ErrAlg: EDEUnsupportedDNSKEYAlgorithm,
+}
+
+// extendedErrorFromSecurity returns a Extended DNS Error describing why a
+// answer is Bogus or Indeterminate, or nil for any other status
+func extendedErrorFromSecurity(status SecurityStatus, reason string) *ExtendedError {
+	switch status {
+	case Bogus:
+		return &ExtendedError{InfoCode: EDEDNSSECBogus, ExtraText: reason}
+	case Indeterminate:
+		return &ExtendedError{InfoCode: EDEDNSSECIndeterminate, ExtraText: reason}
+	}
+	return nil
+}
+
+// ExtendedErrorFromError maps a error returned by RecursiveResolver.Lookup to
+// a Extended DNS Error. Errors without a more specific mapping use the Other
+// info code. If err is nil nil is returned.
+func ExtendedErrorFromError(err error) *ExtendedError {
+	if err == nil {
+		return nil
+	}
+	ee := &ExtendedError{InfoCode: EDEOther, ExtraText: err.Error()}
+	if code, present := errorInfoCodes[err]; present {
+		ee.InfoCode = code
+		return ee
+	}
+	if nerr, ok := err.(net.Error); ok {
+		if nerr.Timeout() {
+			ee.InfoCode = EDENoReachableAuthority
+		} else {
+			ee.InfoCode = EDENetworkError
+		}
+	}
+	return ee
+}
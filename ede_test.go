@@ -0,0 +1,85 @@
+package solvere
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestExtendedErrorFromError(t *testing.T) {
+	if ee := ExtendedErrorFromError(nil); ee != nil {
+		t.Fatalf("ExtendedErrorFromError returned non-nil for nil error: %s", ee)
+	}
+	for _, tc := range []struct {
+		err      error
+		infoCode uint16
+	}{
+		{ErrMismatchingDS, EDEDNSSECBogus},
+		{ErrNSECMissingCoverage, EDENSECMissing},
+		{ErrTooManyReferrals, EDENoReachableAuthority},
+		{ErrNoSignatures, EDERRSIGsMissing},
+		{dns.ErrAlg, EDEUnsupportedDNSKEYAlgorithm},
+		{timeoutError{}, EDENoReachableAuthority},
+		{&net.OpError{Op: "read", Err: errors.New("connection refused")}, EDENetworkError},
+		{errors.New("something else"), EDEOther},
+	} {
+		ee := ExtendedErrorFromError(tc.err)
+		if ee.InfoCode != tc.infoCode {
+			t.Fatalf("ExtendedErrorFromError returned wrong info code for %q: expected %d, got %d", tc.err, tc.infoCode, ee.InfoCode)
+		}
+		if ee.ExtraText != tc.err.Error() {
+			t.Fatalf("ExtendedErrorFromError returned wrong extra text: expected %q, got %q", tc.err, ee.ExtraText)
+		}
+	}
+}
+
+func TestExtendedErrorFromSecurity(t *testing.T) {
+	for status, infoCode := range map[SecurityStatus]uint16{Bogus: EDEDNSSECBogus, Indeterminate: EDEDNSSECIndeterminate} {
+		ee := extendedErrorFromSecurity(status, "reason")
+		if ee == nil || ee.InfoCode != infoCode || ee.ExtraText != "reason" {
+			t.Fatalf("extendedErrorFromSecurity returned wrong extended error for %s: %v", status, ee)
+		}
+	}
+	for _, status := range []SecurityStatus{Secure, Insecure} {
+		if ee := extendedErrorFromSecurity(status, ""); ee != nil {
+			t.Fatalf("extendedErrorFromSecurity returned %v for %s", ee, status)
+		}
+	}
+}
+
+func TestExtendedErrorEDNS0(t *testing.T) {
+	ee := &ExtendedError{InfoCode: EDEDNSSECBogus, ExtraText: "bad"}
+	m := new(dns.Msg)
+	m.SetQuestion("example.", dns.TypeA)
+	m.SetEdns0(4096, true)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, ee.EDNS0())
+	wire, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Failed to pack message with EDE option: %s", err)
+	}
+	um := new(dns.Msg)
+	err = um.Unpack(wire)
+	if err != nil {
+		t.Fatalf("Failed to unpack message with EDE option: %s", err)
+	}
+	opt := um.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 {
+		t.Fatal("Unpacked message is missing EDE option")
+	}
+	local, ok := opt.Option[0].(*dns.EDNS0_LOCAL)
+	if !ok || local.Code != EDNS0EDE {
+		t.Fatalf("Unpacked message contains unexpected option: %#v", opt.Option[0])
+	}
+	expected := []byte{0, EDEDNSSECBogus, 'b', 'a', 'd'}
+	if string(local.Data) != string(expected) {
+		t.Fatalf("EDE option has wrong data: expected %v, got %v", expected, local.Data)
+	}
+}
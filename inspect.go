@@ -0,0 +1,221 @@
+package solvere
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// CacheStats describes the contents of a cache and how it has been used since
+// it was created. Evictions counts answers removed to make room for others,
+// Expired answers removed because their TTL or signatures expired, Flushed
+// answers removed by Flush, and Clamped answers added with TTLs clamped by a
+// TTLPolicy.
+type CacheStats struct {
+	Entries   int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Expired   uint64
+	Flushed   uint64
+	Clamped   uint64
+}
+
+// ManagedCache is a QuestionAnswerCache that can be inspected and edited while
+// the resolver is using it
+type ManagedCache interface {
+	QuestionAnswerCache
+	// List returns copies of the unexpired answers to questions about name or,
+	// if subtree is true, about name or any name below it. Like Get, Secure
+	// answers with expired signatures aren't returned.
+	List(name string, subtree bool) []CacheEntry
+	// Flush removes the answers to questions about name or, if subtree is true,
+	// about name or any name below it, returning the number removed. Answers
+	// kept forever aren't removed.
+	Flush(name string, subtree bool) int
+	// Stats returns the number of answers in the cache and how it has been used
+	Stats() CacheStats
+}
+
+// cacheCounters is updated atomically so it should be the first field of the
+// struct it is in to keep it 64-bit aligned
+type cacheCounters struct {
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	expired   uint64
+	flushed   uint64
+	clamped   uint64
+}
+
+func (cc *cacheCounters) stats(entries int) CacheStats {
+	return CacheStats{
+		Entries:   entries,
+		Hits:      atomic.LoadUint64(&cc.hits),
+		Misses:    atomic.LoadUint64(&cc.misses),
+		Evictions: atomic.LoadUint64(&cc.evictions),
+		Expired:   atomic.LoadUint64(&cc.expired),
+		Flushed:   atomic.LoadUint64(&cc.flushed),
+		Clamped:   atomic.LoadUint64(&cc.clamped),
+	}
+}
+
+// matchesName returns true if a question about qname is about name or, if
+// subtree is true, about a name below it
+func matchesName(name, qname string, subtree bool) bool {
+	name, qname = dns.Fqdn(name), dns.Fqdn(qname)
+	if subtree {
+		return isSubDomain(name, qname)
+	}
+	return strings.EqualFold(name, qname)
+}
+
+// List returns copies of the unexpired answers to questions about name or, if
+// subtree is true, about name or any name below it, leaving out Secure answers
+// with expired signatures
+func (bc *BasicCache) List(name string, subtree bool) []CacheEntry {
+	now := bc.clk.Now()
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	entries := []CacheEntry{}
+	for _, ce := range bc.cache {
+		if !matchesName(name, ce.q.Name, subtree) || ce.expired(bc.clk) {
+			continue
+		}
+		if e := ce.entry(now); !(e.Answer.Security == Secure && signaturesExpired(e.Answer, now)) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Flush removes the answers to questions about name or, if subtree is true,
+// about name or any name below it, returning the number removed. Answers kept
+// forever aren't removed.
+func (bc *BasicCache) Flush(name string, subtree bool) int {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	flushed := 0
+	for id, ce := range bc.cache {
+		if !ce.forever && matchesName(name, ce.q.Name, subtree) {
+			delete(bc.cache, id)
+			flushed++
+		}
+	}
+	atomic.AddUint64(&bc.counters.flushed, uint64(flushed))
+	return flushed
+}
+
+// Stats returns the number of answers in the cache and how it has been used
+func (bc *BasicCache) Stats() CacheStats {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.counters.stats(len(bc.cache))
+}
+
+// List returns copies of the unexpired answers to questions about name or, if
+// subtree is true, about name or any name below it, leaving out Secure answers
+// with expired signatures
+func (lc *LRUCache) List(name string, subtree bool) []CacheEntry {
+	now := lc.clk.Now()
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	entries := []CacheEntry{}
+	for _, e := range lc.entries {
+		if !matchesName(name, e.q.Name, subtree) || e.expired(lc.clk) {
+			continue
+		}
+		if ce := e.entry(now); !(ce.Answer.Security == Secure && signaturesExpired(ce.Answer, now)) {
+			entries = append(entries, ce)
+		}
+	}
+	return entries
+}
+
+// Flush removes the answers to questions about name or, if subtree is true,
+// about name or any name below it, returning the number removed. Answers kept
+// forever aren't removed.
+func (lc *LRUCache) Flush(name string, subtree bool) int {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	flushed := 0
+	for _, e := range lc.entries {
+		if !e.forever && matchesName(name, e.q.Name, subtree) {
+			lc.remove(e, false)
+			flushed++
+		}
+	}
+	atomic.AddUint64(&lc.counters.flushed, uint64(flushed))
+	return flushed
+}
+
+// Stats returns the number of answers in the cache and how it has been used
+func (lc *LRUCache) Stats() CacheStats {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.counters.stats(len(lc.entries))
+}
+
+// List returns copies of the unexpired answers to questions about name or, if
+// subtree is true, about name or any name below it, leaving out Secure answers
+// with expired signatures
+func (sc *ShardedCache) List(name string, subtree bool) []CacheEntry {
+	now := sc.clk.Now()
+	entries := []CacheEntry{}
+	for _, s := range sc.shards {
+		s.mu.RLock()
+		for _, e := range s.entries {
+			if matchesName(name, e.q.Name, subtree) && (e.forever || !now.After(e.expires)) && !(e.answer.Security == Secure && signaturesExpired(e.answer, now)) {
+				entries = append(entries, CacheEntry{Question: e.q, Answer: agedAnswer(e.answer, e.added, now, e.forever), Expires: e.expires, Forever: e.forever})
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return entries
+}
+
+// Flush removes the answers to questions about name or, if subtree is true,
+// about name or any name below it, returning the number removed. Answers kept
+// forever aren't removed.
+func (sc *ShardedCache) Flush(name string, subtree bool) int {
+	flushed := 0
+	for _, s := range sc.shards {
+		s.mu.Lock()
+		for _, e := range s.entries {
+			if !e.forever && matchesName(name, e.q.Name, subtree) {
+				s.remove(e)
+				flushed++
+			}
+		}
+		s.mu.Unlock()
+	}
+	atomic.AddUint64(&sc.counters.flushed, uint64(flushed))
+	return flushed
+}
+
+// Stats returns the number of answers in the cache and how it has been used
+func (sc *ShardedCache) Stats() CacheStats {
+	entries := 0
+	for _, s := range sc.shards {
+		s.mu.RLock()
+		entries += len(s.entries)
+		s.mu.RUnlock()
+	}
+	return sc.counters.stats(entries)
+}
+
+// FlushCache removes the cached answers and RRsets for name or, if subtree is
+// true, for name or any name below it, returning the number of answers
+// removed. Answers are only removed if the cache is a ManagedCache and answers
+// kept forever are left alone.
+func (rr *RecursiveResolver) FlushCache(name string, subtree bool) int {
+	flushed := 0
+	if mc, ok := rr.cache.(ManagedCache); ok {
+		flushed = mc.Flush(name, subtree)
+	}
+	if rr.rrsets != nil {
+		rr.rrsets.flush(name, subtree)
+	}
+	return flushed
+}
@@ -0,0 +1,100 @@
+package solvere
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
+)
+
+func TestManagedCache(t *testing.T) {
+	for name, newCache := range testCaches {
+		fc := clock.NewFake()
+		cache := newCache(CacheOptions{Clock: fc, PruneInterval: -1})
+		questions := []Question{
+			{Name: "example.com.", Type: dns.TypeA},
+			{Name: "example.com.", Type: dns.TypeAAAA},
+			{Name: "www.Example.com.", Type: dns.TypeA},
+			{Name: "a.b.example.com.", Type: dns.TypeA},
+			{Name: "example.org.", Type: dns.TypeA},
+		}
+		for _, q := range questions {
+			cache.Add(&q, lruAnswer(60), false)
+		}
+		root := Question{Name: ".", Type: dns.TypeDNSKEY}
+		cache.Add(&root, lruAnswer(60), true)
+		fc.Add(time.Second * 20)
+
+		if entries := cache.List("example.com.", false); len(entries) != 2 {
+			t.Fatalf("%s: List returned %d answers for example.com., expected 2", name, len(entries))
+		}
+		entries := cache.List("EXAMPLE.com", true)
+		if len(entries) != 4 {
+			t.Fatalf("%s: List returned %d answers below example.com., expected 4", name, len(entries))
+		}
+		for _, e := range entries {
+			if remaining := e.Expires.Sub(fc.Now()); remaining != time.Second*40 {
+				t.Fatalf("%s: List returned answer with %s remaining, expected 40s", name, remaining)
+			}
+		}
+		if entries := cache.List(".", true); len(entries) != 6 {
+			t.Fatalf("%s: List returned %d answers below ., expected 6", name, len(entries))
+		}
+
+		cache.Get(&questions[0])
+		cache.Get(&Question{Name: "missing.", Type: dns.TypeA})
+		if n := cache.Flush("www.example.com.", false); n != 1 {
+			t.Fatalf("%s: Flush removed %d answers for www.example.com., expected 1", name, n)
+		}
+		if cache.Get(&questions[2]) != nil {
+			t.Fatalf("%s: Flush didn't remove answer", name)
+		}
+		if n := cache.Flush("example.com.", true); n != 3 {
+			t.Fatalf("%s: Flush removed %d answers below example.com., expected 3", name, n)
+		}
+		if n := cache.Flush(".", true); n != 1 {
+			t.Fatalf("%s: Flush removed %d answers below ., expected 1", name, n)
+		}
+		if cache.Get(&root) == nil {
+			t.Fatalf("%s: Flush removed answer kept forever", name)
+		}
+
+		cache.Add(&questions[0], lruAnswer(60), false)
+		fc.Add(time.Minute * 2)
+		cache.Get(&questions[0])
+		stats := cache.Stats()
+		expected := CacheStats{Entries: 1, Hits: 2, Misses: 3, Expired: 1, Flushed: 5}
+		if stats != expected {
+			t.Fatalf("%s: Stats returned %+v, expected %+v", name, stats, expected)
+		}
+
+		// like Get List leaves out Secure answers with expired signatures, which
+		// can only outlive their TTL if they are kept forever
+		signed := Question{Name: "signed.example.", Type: dns.TypeA}
+		cache.Add(&signed, &Answer{
+			Answer: []dns.RR{
+				&dns.A{Hdr: dns.RR_Header{Name: signed.Name, Rrtype: dns.TypeA, Ttl: 3600}, A: net.IP{1, 2, 3, 4}},
+				&dns.RRSIG{Hdr: dns.RR_Header{Name: signed.Name, Rrtype: dns.TypeRRSIG, Ttl: 3600}, Expiration: uint32(fc.Now().Add(time.Minute).Unix())},
+			},
+			Security: Secure,
+		}, true)
+		if entries := cache.List("signed.example.", false); len(entries) != 1 {
+			t.Fatalf("%s: List returned %d answers with valid signatures, expected 1", name, len(entries))
+		}
+		fc.Add(time.Minute * 2)
+		if entries := cache.List("signed.example.", false); len(entries) != 0 {
+			t.Fatalf("%s: List returned %d answers with expired signatures, expected 0", name, len(entries))
+		}
+	}
+
+	cache := newLRUCache(2, 0, EvictLRU, clock.NewFake())
+	for i := 0; i < 5; i++ {
+		cache.Add(lruQuestion(i), lruAnswer(60), false)
+	}
+	if stats := cache.Stats(); stats.Evictions != 3 || stats.Entries != 2 {
+		t.Fatalf("LRUCache Stats returned %d evictions with %d answers, expected 3 with 2", stats.Evictions, stats.Entries)
+	}
+}
@@ -0,0 +1,444 @@
+package solvere
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"github.com/miekg/dns"
+
+	"github.com/rolandshoemaker/solvere/dnstest"
+)
+
+// newTestHierarchy serves zones using dnstest and returns a resolver that uses
+// them
+func newTestHierarchy(t *testing.T, zones []dnstest.Zone) (*dnstest.Hierarchy, *RecursiveResolver) {
+	h, err := dnstest.New(zones)
+	if err != nil {
+		t.Fatalf("Failed to create test hierarchy: %s", err)
+	}
+	dnsPort = h.Port
+	return h, NewRecursiveResolver(false, true, h.Hints, h.TrustAnchors, nil)
+}
+
+var testZones = []dnstest.Zone{
+	{Name: "."},
+	{Name: "com."},
+	{Name: "org.", Unsigned: true},
+	{Name: "example.com.", Records: `
+www       IN A     192.0.2.1
+alias     IN CNAME www.nsec3.com.
+*.wild    IN A     192.0.2.2
+a.b.c     IN TXT   "empty non-terminals"
+`},
+	{Name: "nsec3.com.", NSEC3: &dnstest.NSEC3Params{Iterations: 0, Salt: "AABB"}, Records: `
+www       IN A     192.0.2.3
+*.wild    IN A     192.0.2.4
+`},
+	{Name: "unsigned.com.", Unsigned: true, Records: `
+www       IN A     192.0.2.5
+`},
+	{Name: "expired.com.", Inception: time.Now().Add(-48 * time.Hour), Expiration: time.Now().Add(-24 * time.Hour), Records: `
+www       IN A     192.0.2.6
+`},
+	{Name: "example.org.", Records: `
+www       IN A     192.0.2.7
+`},
+}
+
+func TestLookupHierarchy(t *testing.T) {
+	h, rr := newTestHierarchy(t, testZones)
+	defer h.Close()
+
+	testCases := []struct {
+		name     string
+		qtype    uint16
+		rcode    int
+		answers  int
+		security SecurityStatus
+	}{
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, 2, Secure},
+		{"WWW.Example.COM.", dns.TypeA, dns.RcodeSuccess, 2, Secure},
+		{"www.example.com.", dns.TypeTXT, dns.RcodeSuccess, 0, Secure},
+		{"missing.example.com.", dns.TypeA, dns.RcodeNameError, 0, Secure},
+		{"b.c.example.com.", dns.TypeTXT, dns.RcodeSuccess, 0, Secure},
+		{"a.wild.example.com.", dns.TypeA, dns.RcodeSuccess, 2, Secure},
+		{"alias.example.com.", dns.TypeA, dns.RcodeSuccess, 3, Secure},
+		{"www.nsec3.com.", dns.TypeA, dns.RcodeSuccess, 2, Secure},
+		{"www.nsec3.com.", dns.TypeTXT, dns.RcodeSuccess, 0, Secure},
+		{"missing.nsec3.com.", dns.TypeA, dns.RcodeNameError, 0, Secure},
+		{"a.wild.nsec3.com.", dns.TypeA, dns.RcodeSuccess, 2, Secure},
+		{"www.unsigned.com.", dns.TypeA, dns.RcodeSuccess, 1, Insecure},
+		{"www.example.org.", dns.TypeA, dns.RcodeSuccess, 2, Insecure},
+	}
+	for _, tc := range testCases {
+		a, ll, err := rr.Lookup(context.Background(), Question{Name: tc.name, Type: tc.qtype})
+		if err != nil {
+			t.Fatalf("Lookup for %s %s failed: %s", tc.name, dns.TypeToString[tc.qtype], err)
+		}
+		if a.Rcode != tc.rcode || len(a.Answer) != tc.answers || a.Security != tc.security {
+			t.Fatalf("Lookup for %s %s returned rcode %s, %d answers, %s (%s), expected rcode %s, %d answers, %s",
+				tc.name, dns.TypeToString[tc.qtype], dns.RcodeToString[a.Rcode], len(a.Answer), a.Security, ll.SecurityReason,
+				dns.RcodeToString[tc.rcode], tc.answers, tc.security)
+		}
+	}
+
+	_, ll, err := rr.Lookup(context.Background(), Question{Name: "www.expired.com.", Type: dns.TypeA})
+	if err == nil || ll.Security != Bogus {
+		t.Fatalf("Lookup with expired signatures didn't fail: %v, %s", err, ll.Security)
+	}
+	if ll.EDE == nil || ll.EDE.InfoCode != EDESignatureExpired {
+		t.Fatalf("Lookup with expired signatures has wrong extended error: %v", ll.EDE)
+	}
+}
+
+func TestLookupCheckingDisabled(t *testing.T) {
+	h, err := dnstest.New(testZones)
+	if err != nil {
+		t.Fatalf("Failed to create test hierarchy: %s", err)
+	}
+	defer h.Close()
+	dnsPort = h.Port
+	rr := NewRecursiveResolver(false, true, h.Hints, h.TrustAnchors, newShardedCache(0, clock.Default()))
+
+	q := Question{Name: "www.expired.com.", Type: dns.TypeA, CheckingDisabled: true}
+	a, _, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup with checking disabled failed: %s", err)
+	}
+	if a.Security != Indeterminate || len(a.Answer) != 2 {
+		t.Fatalf("Lookup with checking disabled returned %s with %d answers", a.Security, len(a.Answer))
+	}
+	if a.EDE != nil {
+		t.Fatalf("Lookup with checking disabled returned extended error %v", a.EDE)
+	}
+
+	// unvalidated answers are cached separately from validated ones
+	q = Question{Name: "www.example.com.", Type: dns.TypeA, CheckingDisabled: true}
+	a, _, err = rr.Lookup(context.Background(), q)
+	if err != nil || a.Security != Indeterminate {
+		t.Fatalf("Lookup with checking disabled returned %v (%v)", a, err)
+	}
+	q.CheckingDisabled = false
+	a, ll, err := rr.Lookup(context.Background(), q)
+	if err != nil || a.Security != Secure || ll.Composites[0].CacheHit {
+		t.Fatalf("Lookup with checking enabled used the unvalidated answer: %v (%v)", a, err)
+	}
+	q = Question{Name: "WWW.Example.com.", Type: dns.TypeA, CheckingDisabled: true}
+	a, ll, err = rr.Lookup(context.Background(), q)
+	if err != nil || a.Security != Indeterminate || !ll.Composites[0].CacheHit {
+		t.Fatalf("Lookup with checking disabled and a differently cased name wasn't answered from the cache: %v (%v)", a, err)
+	}
+}
+
+func TestLookupNegativeTrustAnchor(t *testing.T) {
+	h, rr := newTestHierarchy(t, testZones)
+	defer h.Close()
+
+	err := rr.AddNegativeTrustAnchor("expired.com.", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("AddNegativeTrustAnchor failed: %s", err)
+	}
+	a, ll, err := rr.Lookup(context.Background(), Question{Name: "www.expired.com.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup below negative trust anchor failed: %s", err)
+	}
+	if a.Security != Insecure || ll.SecurityReason == "" {
+		t.Fatalf("Lookup below negative trust anchor returned %s (%q)", a.Security, ll.SecurityReason)
+	}
+}
+
+func TestLookupNegativeTrustAnchorFlushesCache(t *testing.T) {
+	h, err := dnstest.New(testZones)
+	if err != nil {
+		t.Fatalf("Failed to create test hierarchy: %s", err)
+	}
+	defer h.Close()
+	dnsPort = h.Port
+	rr := NewRecursiveResolver(false, true, h.Hints, h.TrustAnchors, newShardedCache(0, clock.Default()))
+
+	q := Question{Name: "www.example.com.", Type: dns.TypeA}
+	if a, _, err := rr.Lookup(context.Background(), q); err != nil || a.Security != Secure {
+		t.Fatalf("Lookup for www.example.com. returned %v (%v)", a, err)
+	}
+	// answers cached before the anchor was added aren't used
+	err = rr.AddNegativeTrustAnchor("Example.com", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("AddNegativeTrustAnchor failed: %s", err)
+	}
+	a, ll, err := rr.Lookup(context.Background(), q)
+	if err != nil || a.Security != Insecure || ll.Composites[0].CacheHit {
+		t.Fatalf("Lookup below new negative trust anchor used the cached answer: %v (%v)", a, err)
+	}
+	// and answers cached while it existed aren't used after it is removed
+	rr.RemoveNegativeTrustAnchor("example.com.")
+	a, ll, err = rr.Lookup(context.Background(), q)
+	if err != nil || a.Security != Secure || ll.Composites[0].CacheHit {
+		t.Fatalf("Lookup below removed negative trust anchor used the cached answer: %v (%v)", a, err)
+	}
+}
+
+func TestLookupNegativeTrustAnchorExpires(t *testing.T) {
+	h, err := dnstest.New(testZones)
+	if err != nil {
+		t.Fatalf("Failed to create test hierarchy: %s", err)
+	}
+	defer h.Close()
+	dnsPort = h.Port
+	fc := clock.NewFake()
+	fc.Set(time.Now())
+	rr := NewRecursiveResolver(false, true, h.Hints, h.TrustAnchors, NewShardedCacheWithOptions(CacheOptions{Clock: fc, PruneInterval: -1}))
+	rr.SetClock(fc)
+
+	err = rr.AddNegativeTrustAnchor("example.com.", fc.Now().Add(time.Minute*10))
+	if err != nil {
+		t.Fatalf("AddNegativeTrustAnchor failed: %s", err)
+	}
+	q := Question{Name: "www.example.com.", Type: dns.TypeA}
+	if a, _, err := rr.Lookup(context.Background(), q); err != nil || a.Security != Insecure {
+		t.Fatalf("Lookup for www.example.com. returned %v (%v)", a, err)
+	}
+	// the answer is still cached but was cached while the anchor existed
+	fc.Add(time.Minute * 10)
+	a, ll, err := rr.Lookup(context.Background(), q)
+	if err != nil || a.Security != Secure || ll.Composites[0].CacheHit {
+		t.Fatalf("Lookup below expired negative trust anchor used the cached answer: %v (%v)", a, err)
+	}
+}
+
+func TestLookupPrivateTrustAnchor(t *testing.T) {
+	h, rr := newTestHierarchy(t, testZones)
+	defer h.Close()
+
+	ksk, _ := h.Keys("example.org.")
+	err := rr.AddTrustAnchors([]dns.RR{ksk})
+	if err != nil {
+		t.Fatalf("AddTrustAnchors failed: %s", err)
+	}
+	a, ll, err := rr.Lookup(context.Background(), Question{Name: "www.example.org.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if a.Security != Secure || a.SecurityZone != "example.org." {
+		t.Fatalf("Lookup below private trust anchor returned %s at %q (%q)", a.Security, a.SecurityZone, ll.SecurityReason)
+	}
+}
+
+func TestLookupTrustAnchorHostedByParent(t *testing.T) {
+	h, rr := newTestHierarchy(t, []dnstest.Zone{
+		{Name: "."},
+		{Name: "org.", Unsigned: true},
+		{Name: "example.org.", HostedBy: "org.", Records: `
+www       IN A     192.0.2.7
+`},
+	})
+	defer h.Close()
+
+	// the org. nameserver answers for example.org. itself so the lookup never
+	// sees a referral to the anchored zone
+	ksk, _ := h.Keys("example.org.")
+	err := rr.AddTrustAnchors([]dns.RR{ksk})
+	if err != nil {
+		t.Fatalf("AddTrustAnchors failed: %s", err)
+	}
+	for _, name := range []string{"www.example.org.", "missing.example.org."} {
+		a, ll, err := rr.Lookup(context.Background(), Question{Name: name, Type: dns.TypeA})
+		if err != nil {
+			t.Fatalf("Lookup for %s failed: %s", name, err)
+		}
+		if a.Security != Secure || a.SecurityZone != "example.org." {
+			t.Fatalf("Lookup for %s returned %s at %q (%q)", name, a.Security, a.SecurityZone, ll.SecurityReason)
+		}
+	}
+}
+
+func TestLookupAuthenticationChain(t *testing.T) {
+	h, rr := newTestHierarchy(t, testZones)
+	defer h.Close()
+	rr.SetAuthenticationChains(true)
+
+	for _, q := range []Question{
+		{Name: "www.example.com.", Type: dns.TypeA},
+		{Name: "missing.nsec3.com.", Type: dns.TypeA},
+	} {
+		a, _, err := rr.Lookup(context.Background(), q)
+		if err != nil {
+			t.Fatalf("Lookup failed: %s", err)
+		}
+		if len(a.Chain) == 0 {
+			t.Fatal("Lookup didn't return a authentication chain")
+		}
+		data, err := a.PackChain(3600)
+		if err != nil {
+			t.Fatalf("PackChain failed: %s", err)
+		}
+		_, rrs, err := ParseDNSSECChain(data)
+		if err != nil {
+			t.Fatalf("ParseDNSSECChain failed: %s", err)
+		}
+		status, err := ValidateChain(q, rrs, h.TrustAnchors, time.Now())
+		if status != Secure {
+			t.Fatalf("Authentication chain for %s didn't validate: %s (%v)", q.Name, status, err)
+		}
+	}
+}
+
+func TestLookupCachedRRsets(t *testing.T) {
+	h, err := dnstest.New(testZones)
+	if err != nil {
+		t.Fatalf("Failed to create test hierarchy: %s", err)
+	}
+	defer h.Close()
+	dnsPort = h.Port
+	rr := NewRecursiveResolver(false, true, h.Hints, h.TrustAnchors, newShardedCache(0, clock.Default()))
+
+	_, _, err = rr.Lookup(context.Background(), Question{Name: "alias.example.com.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup for alias.example.com. failed: %s", err)
+	}
+	// the target of the CNAME was validated while following it so it can be
+	// answered without asking the nameservers again
+	a, ll, err := rr.Lookup(context.Background(), Question{Name: "www.nsec3.com.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup for www.nsec3.com. failed: %s", err)
+	}
+	if a.Security != Secure || len(a.Answer) != 2 || len(ll.Composites) != 1 || !ll.Composites[0].CacheHit {
+		t.Fatalf("Lookup for www.nsec3.com. wasn't answered from cached RRsets: %s with %d answers", a.Security, len(a.Answer))
+	}
+}
+
+func TestLookupFlushCache(t *testing.T) {
+	h, err := dnstest.New(testZones)
+	if err != nil {
+		t.Fatalf("Failed to create test hierarchy: %s", err)
+	}
+	defer h.Close()
+	dnsPort = h.Port
+	rr := NewRecursiveResolver(false, true, h.Hints, h.TrustAnchors, NewShardedCacheWithOptions(CacheOptions{PruneInterval: -1}))
+
+	// looking up alias.example.com. caches the answers to it and www.nsec3.com.
+	// along with the RRsets they're made of, which could be used to answer
+	// them again
+	_, _, err = rr.Lookup(context.Background(), Question{Name: "alias.example.com.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup for alias.example.com. failed: %s", err)
+	}
+	testCases := []struct {
+		name    string
+		subtree bool
+		flushed int
+	}{
+		{"example.com.", true, 1},
+		{"www.nsec3.com.", false, 1},
+	}
+	for _, tc := range testCases {
+		if flushed := rr.FlushCache(tc.name, tc.subtree); flushed != tc.flushed {
+			t.Fatalf("FlushCache for %s removed %d answers, expected %d", tc.name, flushed, tc.flushed)
+		}
+		q := Question{Name: "www.nsec3.com.", Type: dns.TypeA}
+		if tc.subtree {
+			q.Name = "alias.example.com."
+		}
+		_, ll, err := rr.Lookup(context.Background(), q)
+		if err != nil {
+			t.Fatalf("Lookup for %s failed: %s", q.Name, err)
+		}
+		if ll.Composites[0].CacheHit {
+			t.Fatalf("Lookup for %s was answered from the cache after flushing %s", q.Name, tc.name)
+		}
+	}
+}
+
+func TestLookupCachedRRsetsTTLPolicy(t *testing.T) {
+	h, err := dnstest.New(testZones)
+	if err != nil {
+		t.Fatalf("Failed to create test hierarchy: %s", err)
+	}
+	defer h.Close()
+	dnsPort = h.Port
+	rr := NewRecursiveResolver(false, true, h.Hints, h.TrustAnchors, NewShardedCacheWithOptions(CacheOptions{PruneInterval: -1}))
+	rr.SetTTLPolicy(&TTLPolicy{
+		TTLLimits: TTLLimits{Max: time.Minute},
+		Zones:     map[string]TTLLimits{"nsec3.com.": {Max: time.Second * 10}},
+	})
+
+	// the records are served with a TTL of an hour, only the first lookup goes
+	// to the nameservers, www.nsec3.com. is first answered from the RRsets
+	// cached while following the CNAME and then from the question/answer cache
+	testCases := []struct {
+		name string
+		max  uint32
+	}{
+		{"alias.example.com.", 60},
+		{"alias.example.com.", 60},
+		{"www.nsec3.com.", 10},
+		{"www.nsec3.com.", 10},
+	}
+	for i, tc := range testCases {
+		a, ll, err := rr.Lookup(context.Background(), Question{Name: tc.name, Type: dns.TypeA})
+		if err != nil {
+			t.Fatalf("Lookup for %s failed: %s", tc.name, err)
+		}
+		if hit := ll.Composites[len(ll.Composites)-1].CacheHit; hit != (i > 0) {
+			t.Fatalf("Lookup %d for %s returned cache hit %t", i, tc.name, hit)
+		} else if !hit {
+			continue
+		}
+		for _, r := range a.Answer {
+			if r.Header().Ttl > tc.max {
+				t.Fatalf("Lookup %d for %s returned %s with TTL %d, expected at most %d", i, tc.name, dns.TypeToString[r.Header().Rrtype], r.Header().Ttl, tc.max)
+			}
+		}
+	}
+}
+
+func TestLookupNegativeCaching(t *testing.T) {
+	h, err := dnstest.New(testZones)
+	if err != nil {
+		t.Fatalf("Failed to create test hierarchy: %s", err)
+	}
+	defer h.Close()
+	dnsPort = h.Port
+	cache := NewShardedCacheWithOptions(CacheOptions{
+		PruneInterval: -1,
+		TTLs:          &TTLPolicy{TTLLimits: TTLLimits{NegativeMax: time.Minute}},
+	})
+	rr := NewRecursiveResolver(false, true, h.Hints, h.TrustAnchors, cache)
+
+	testCases := []struct {
+		name  string
+		qtype uint16
+		rcode int
+	}{
+		{"missing.example.com.", dns.TypeA, dns.RcodeNameError},
+		{"www.example.com.", dns.TypeTXT, dns.RcodeSuccess},
+		{"missing.nsec3.com.", dns.TypeA, dns.RcodeNameError},
+	}
+	for _, tc := range testCases {
+		q := Question{Name: tc.name, Type: tc.qtype}
+		for i := 0; i < 2; i++ {
+			a, ll, err := rr.Lookup(context.Background(), q)
+			if err != nil {
+				t.Fatalf("Lookup for %s %s failed: %s", tc.name, dns.TypeToString[tc.qtype], err)
+			}
+			if a.Rcode != tc.rcode || len(a.Answer) != 0 || a.Security != Secure {
+				t.Fatalf("Lookup for %s %s returned %s with %d answers (%s)", tc.name, dns.TypeToString[tc.qtype], dns.RcodeToString[a.Rcode], len(a.Answer), a.Security)
+			}
+			if hit := ll.Composites[len(ll.Composites)-1].CacheHit; hit != (i == 1) {
+				t.Fatalf("Lookup %d for %s %s returned cache hit %t", i, tc.name, dns.TypeToString[tc.qtype], hit)
+			}
+		}
+		// the SOA minimum of 300 seconds is clamped by the negative max TTL
+		entries := cache.List(tc.name, false)
+		if len(entries) != 1 {
+			t.Fatalf("%d answers cached for %s, expected 1", len(entries), tc.name)
+		}
+		if remaining := entries[0].Expires.Sub(time.Now()); remaining > time.Minute {
+			t.Fatalf("Negative answer for %s cached for %s, expected at most 1m", tc.name, remaining)
+		}
+		if len(extractRRSet(entries[0].Answer.Authority, "", dns.TypeSOA)) != 1 {
+			t.Fatalf("Negative answer for %s cached without the SOA record", tc.name)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package solvere
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
+)
+
+// EvictionPolicy decides which answers a LRUCache evicts when it is full
+type EvictionPolicy int
+
+const (
+	// EvictLRU evicts the least recently used answer
+	EvictLRU EvictionPolicy = iota
+	// Evict2Q uses the 2Q algorithm: new answers go into a small FIFO queue
+	// and only move to the main LRU queue if their question is asked again
+	// after they have been removed. A flood of unique questions only pushes
+	// answers out of the small queue.
+	Evict2Q
+)
+
+const (
+	// entryOverhead is a rough estimate of the memory a cache entry uses in
+	// addition to its records
+	entryOverhead = 256
+	// recentShare is the fraction (1/recentShare) of the cache limits the 2Q
+	// FIFO queue may use before answers are evicted from it
+	recentShare = 4
+	// ghostShare is the fraction (1/ghostShare) of the entry limit used as the
+	// number of evicted questions 2Q remembers
+	ghostShare = 2
+)
+
+// answerSize returns the approximate number of bytes a cached answer uses
+func answerSize(answer *Answer) int {
+	size := entryOverhead
+	for _, section := range [][]dns.RR{answer.Answer, answer.Authority, answer.Additional, answer.Chain} {
+		for _, r := range section {
+			size += dns.Len(r)
+		}
+	}
+	return size
+}
+
+type lruQueue struct {
+	list.List
+	size int
+}
+
+type lruEntry struct {
+	*cacheEntry
+	id   [sha1.Size]byte
+	size int
+	// queue and elem are nil for entries that are kept forever
+	queue *lruQueue
+	elem  *list.Element
+}
+
+// LRUCache is a implementation of the QuestionAnswerCache interface that is
+// limited by the number of answers it holds and by the approximate number of
+// bytes they use. When either limit is reached answers are evicted according
+// to the EvictionPolicy. Answers added to be kept forever, such as the root
+// trust anchors, are never evicted and don't count towards either limit.
+type LRUCache struct {
+	counters cacheCounters
+	mu       sync.Mutex
+	entries  map[[sha1.Size]byte]*lruEntry
+	// recent is the only queue used by EvictLRU, for Evict2Q it is the FIFO
+	// queue new answers are added to and frequent is the main LRU queue
+	recent     *lruQueue
+	frequent   *lruQueue
+	ghosts     *list.List
+	ghostIndex map[[sha1.Size]byte]*list.Element
+	maxEntries int
+	maxBytes   int
+	policy     EvictionPolicy
+	clk        clock.Clock
+	ttls       *TTLPolicy
+	pruner     *pruner
+}
+
+// NewLRUCache returns a initialized LRUCache that holds at most maxEntries
+// answers using at most roughly maxBytes bytes. A limit of 0 disables it.
+func NewLRUCache(maxEntries, maxBytes int, policy EvictionPolicy) *LRUCache {
+	return NewLRUCacheWithOptions(CacheOptions{MaxEntries: maxEntries, MaxBytes: maxBytes, Eviction: policy})
+}
+
+// NewLRUCacheWithOptions returns a initialized LRUCache configured by opts.
+// Close should be called once the cache is no longer needed to stop pruning
+// it.
+func NewLRUCacheWithOptions(opts CacheOptions) *LRUCache {
+	lc := newLRUCache(opts.MaxEntries, opts.MaxBytes, opts.Eviction, opts.clock())
+	lc.ttls = opts.TTLs
+	lc.pruner = startPruner(opts.pruneInterval(defaultPruneInterval), lc.clk, lc.fullPrune)
+	return lc
+}
+
+// Close stops the removal of expired answers in the background, the cache can
+// still be used afterwards
+func (lc *LRUCache) Close() {
+	lc.pruner.close()
+}
+
+func newLRUCache(maxEntries, maxBytes int, policy EvictionPolicy, clk clock.Clock) *LRUCache {
+	return &LRUCache{
+		entries:    make(map[[sha1.Size]byte]*lruEntry),
+		recent:     &lruQueue{},
+		frequent:   &lruQueue{},
+		ghosts:     list.New(),
+		ghostIndex: make(map[[sha1.Size]byte]*list.Element),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		policy:     policy,
+		clk:        clk,
+	}
+}
+
+func (lc *LRUCache) push(e *lruEntry, queue *lruQueue) {
+	e.queue = queue
+	e.elem = queue.PushFront(e)
+	queue.size += e.size
+}
+
+// remove deletes a entry from the cache, if remember is true and the 2Q policy
+// is used the question is remembered so the answer goes into the main queue
+// if it is added again
+func (lc *LRUCache) remove(e *lruEntry, remember bool) {
+	delete(lc.entries, e.id)
+	if e.queue == nil {
+		return
+	}
+	e.queue.Remove(e.elem)
+	e.queue.size -= e.size
+	e.queue, e.elem = nil, nil
+	if !remember || lc.policy != Evict2Q {
+		return
+	}
+	if g, present := lc.ghostIndex[e.id]; present {
+		lc.ghosts.MoveToFront(g)
+		return
+	}
+	lc.ghostIndex[e.id] = lc.ghosts.PushFront(e.id)
+	limit := lc.maxEntries / ghostShare
+	if lc.maxEntries == 0 {
+		limit = (lc.recent.Len() + lc.frequent.Len()) / ghostShare
+	}
+	for lc.ghosts.Len() > limit && lc.ghosts.Len() > 0 {
+		delete(lc.ghostIndex, lc.ghosts.Remove(lc.ghosts.Back()).([sha1.Size]byte))
+	}
+}
+
+func (lc *LRUCache) over(entries, size, share int) bool {
+	return (lc.maxEntries > 0 && entries > lc.maxEntries/share) || (lc.maxBytes > 0 && size > lc.maxBytes/share)
+}
+
+// evict removes answers until the cache is within its limits
+func (lc *LRUCache) evict() {
+	for lc.over(lc.recent.Len()+lc.frequent.Len(), lc.recent.size+lc.frequent.size, 1) {
+		queue := lc.recent
+		if lc.policy == Evict2Q && (lc.recent.Len() == 0 || (lc.frequent.Len() > 0 && !lc.over(lc.recent.Len(), lc.recent.size, recentShare))) {
+			queue = lc.frequent
+		}
+		lc.remove(queue.Back().Value.(*lruEntry), true)
+		atomic.AddUint64(&lc.counters.evictions, 1)
+	}
+}
+
+func (lc *LRUCache) fullPrune() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	for _, e := range lc.entries {
+		if e.expired(lc.clk) {
+			lc.remove(e, true)
+			atomic.AddUint64(&lc.counters.expired, 1)
+		}
+	}
+}
+
+// SetTTLPolicy sets the policy used to clamp the TTLs of answers added to the
+// cache. It should be called before the cache is used.
+func (lc *LRUCache) SetTTLPolicy(policy *TTLPolicy) {
+	lc.ttls = policy
+}
+
+// Add adds a response to the cache using a index based on the question, with
+// the TTLs of its records clamped by the cache's TTLPolicy, evicting other
+// answers if the cache is full
+func (lc *LRUCache) Add(q *Question, answer *Answer, forever bool) {
+	var ttl int
+	if !forever {
+		var clamped bool
+		answer, clamped = lc.ttls.clamp(q, answer)
+		ttl = minTTL(append(answer.Answer, append(answer.Additional, answer.Authority...)...), lc.clk)
+		if ttl == 0 {
+			return
+		}
+		if clamped {
+			atomic.AddUint64(&lc.counters.clamped, 1)
+		}
+	}
+	lc.add(q, answer, ttl, forever)
+}
+
+func (lc *LRUCache) add(q *Question, answer *Answer, ttl int, forever bool) {
+	id := hashQuestion(q)
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if e, present := lc.entries[id]; present {
+		if e.forever && !forever {
+			// answers kept forever are only replaced by other answers kept
+			// forever
+			return
+		}
+		if e.forever == forever {
+			e.update(answer, ttl, lc.clk)
+			if e.queue != nil {
+				queue := e.queue
+				lc.remove(e, false)
+				e.size = answerSize(answer)
+				lc.entries[id] = e
+				lc.push(e, queue)
+				lc.evict()
+			}
+			return
+		}
+		lc.remove(e, false)
+	}
+	e := &lruEntry{
+		cacheEntry: &cacheEntry{q: *q, answer: answer, ttl: ttl, modified: lc.clk.Now(), forever: forever},
+		id:         id,
+	}
+	lc.entries[id] = e
+	if forever {
+		return
+	}
+	e.size = answerSize(answer)
+	queue := lc.recent
+	if g, present := lc.ghostIndex[id]; present {
+		lc.ghosts.Remove(g)
+		delete(lc.ghostIndex, id)
+		queue = lc.frequent
+	}
+	lc.push(e, queue)
+	lc.evict()
+}
+
+// Get returns a copy of the response for a question if it exists in the cache,
+// with TTLs reduced by the time it has been cached, and marks it as recently
+// used. Secure answers are removed once any of their signatures
+// expire, even if the TTL hasn't.
+func (lc *LRUCache) Get(q *Question) *Answer {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	e, present := lc.entries[hashQuestion(q)]
+	if !present {
+		atomic.AddUint64(&lc.counters.misses, 1)
+		return nil
+	}
+	now := lc.clk.Now()
+	if e.expired(lc.clk) || (e.answer.Security == Secure && signaturesExpired(e.answer, now)) {
+		lc.remove(e, true)
+		atomic.AddUint64(&lc.counters.expired, 1)
+		atomic.AddUint64(&lc.counters.misses, 1)
+		return nil
+	}
+	atomic.AddUint64(&lc.counters.hits, 1)
+	// 2Q leaves answers in the FIFO queue where they are
+	if e.queue == lc.frequent || (e.queue != nil && lc.policy == EvictLRU) {
+		e.queue.MoveToFront(e.elem)
+	}
+	return e.cached(now)
+}
+
+// Entries returns copies of the unexpired answers in the cache, answers kept
+// forever first and then from the least to the most recently used so restoring
+// them in order keeps the same answers at the front of the queues
+func (lc *LRUCache) Entries() []CacheEntry {
+	now := lc.clk.Now()
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	entries := []CacheEntry{}
+	for _, e := range lc.entries {
+		if e.forever {
+			entries = append(entries, e.entry(now))
+		}
+	}
+	for _, queue := range []*lruQueue{lc.frequent, lc.recent} {
+		for elem := queue.Back(); elem != nil; elem = elem.Prev() {
+			if e := elem.Value.(*lruEntry); !e.expired(lc.clk) {
+				entries = append(entries, e.entry(now))
+			}
+		}
+	}
+	return entries
+}
+
+// Restore adds a answer returned by Entries unless it has expired
+func (lc *LRUCache) Restore(entry CacheEntry) {
+	if ttl, ok := restoreTTL(entry, lc.clk); ok {
+		lc.add(&entry.Question, entry.Answer, ttl, entry.Forever)
+	}
+}
@@ -0,0 +1,156 @@
+package solvere
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
+)
+
+func lruAnswer(ttl uint32) *Answer {
+	return &Answer{Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "testing.", Rrtype: dns.TypeA, Ttl: ttl}, A: net.IP{1, 2, 3, 4}}}}
+}
+
+func lruQuestion(i int) *Question {
+	return &Question{Name: fmt.Sprintf("%d.testing.", i), Type: dns.TypeA}
+}
+
+func TestLRUCache(t *testing.T) {
+	fc := clock.NewFake()
+	cache := newLRUCache(3, 0, EvictLRU, fc)
+
+	a := lruAnswer(10)
+	for i := 0; i < 3; i++ {
+		cache.Add(lruQuestion(i), a, false)
+	}
+	if !sameAnswer(cache.Get(lruQuestion(0)), a) {
+		t.Fatal("Cache didn't return answer")
+	}
+	cache.Add(lruQuestion(3), a, false)
+	if cache.Get(lruQuestion(1)) != nil {
+		t.Fatal("Cache didn't evict the least recently used answer")
+	}
+	for _, i := range []int{0, 2, 3} {
+		if cache.Get(lruQuestion(i)) == nil {
+			t.Fatalf("Cache evicted answer %d", i)
+		}
+	}
+
+	// answers added to be kept forever aren't evicted or counted
+	cache.Add(lruQuestion(100), a, true)
+	for i := 4; i < 10; i++ {
+		cache.Add(lruQuestion(i), a, false)
+	}
+	if !sameAnswer(cache.Get(lruQuestion(100)), a) {
+		t.Fatal("Cache evicted answer that should've been kept forever")
+	}
+	if len(cache.entries) != 4 {
+		t.Fatalf("Cache contains %d answers, expected 4", len(cache.entries))
+	}
+
+	fc.Add(time.Second * 30)
+	cache.fullPrune()
+	if len(cache.entries) != 1 || cache.Get(lruQuestion(100)) == nil {
+		t.Fatal("Cache didn't prune expired answers")
+	}
+
+	// updating a answer doesn't add another entry
+	cache.Add(lruQuestion(0), a, false)
+	cache.Add(lruQuestion(0), lruAnswer(20), false)
+	if cache.recent.Len() != 1 || cache.recent.size != answerSize(a) {
+		t.Fatalf("Updated answer was counted twice: %d entries, %d bytes", cache.recent.Len(), cache.recent.size)
+	}
+}
+
+func TestLRUCacheBytes(t *testing.T) {
+	a := lruAnswer(10)
+	size := answerSize(a)
+	cache := newLRUCache(0, size*5, EvictLRU, clock.NewFake())
+	for i := 0; i < 20; i++ {
+		cache.Add(lruQuestion(i), a, false)
+	}
+	if cache.recent.Len() != 5 || cache.recent.size != size*5 {
+		t.Fatalf("Cache contains %d answers using %d bytes, expected 5 using %d", cache.recent.Len(), cache.recent.size, size*5)
+	}
+	for i := 15; i < 20; i++ {
+		if cache.Get(lruQuestion(i)) == nil {
+			t.Fatalf("Cache evicted recent answer %d", i)
+		}
+	}
+}
+
+func TestLRUCache2Q(t *testing.T) {
+	fc := clock.NewFake()
+	cache := newLRUCache(8, 0, Evict2Q, fc)
+	a := lruAnswer(10)
+
+	// answers are promoted to the main queue when they are added again after
+	// being evicted from the FIFO queue
+	for i := 0; i < 4; i++ {
+		cache.Add(lruQuestion(i), a, false)
+	}
+	fc.Add(time.Second * 30)
+	for i := 0; i < 4; i++ {
+		if cache.Get(lruQuestion(i)) != nil {
+			t.Fatalf("Cache returned expired answer %d", i)
+		}
+		cache.Add(lruQuestion(i), a, false)
+	}
+	if cache.frequent.Len() != 4 {
+		t.Fatalf("Main queue contains %d answers, expected 4", cache.frequent.Len())
+	}
+
+	// a flood of unique questions only evicts answers from the FIFO queue
+	for i := 100; i < 200; i++ {
+		cache.Add(lruQuestion(i), a, false)
+	}
+	for i := 0; i < 4; i++ {
+		if cache.Get(lruQuestion(i)) == nil {
+			t.Fatalf("Flood of unique questions evicted frequently used answer %d", i)
+		}
+	}
+	if len(cache.entries) != 8 {
+		t.Fatalf("Cache contains %d answers, expected 8", len(cache.entries))
+	}
+	if cache.ghosts.Len() != 4 || len(cache.ghostIndex) != 4 {
+		t.Fatalf("Cache remembers %d evicted questions, expected 4", cache.ghosts.Len())
+	}
+}
+
+func benchmarkCache(b *testing.B, cache QuestionAnswerCache, names int) {
+	questions := make([]*Question, names)
+	for i := range questions {
+		questions[i] = lruQuestion(i)
+	}
+	a := lruAnswer(3600)
+	var seed int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+		for pb.Next() {
+			q := questions[r.Intn(len(questions))]
+			if cache.Get(q) == nil {
+				cache.Add(q, a, false)
+			}
+		}
+	})
+}
+
+func BenchmarkBasicCache(b *testing.B) {
+	benchmarkCache(b, &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: clock.Default()}, 10000)
+}
+
+func BenchmarkLRUCache(b *testing.B) {
+	benchmarkCache(b, newLRUCache(5000, 0, EvictLRU, clock.Default()), 10000)
+}
+
+func BenchmarkLRUCache2Q(b *testing.B) {
+	benchmarkCache(b, newLRUCache(5000, 0, Evict2Q, clock.Default()), 10000)
+}
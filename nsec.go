@@ -3,21 +3,122 @@ package solvere
 import (
 	"errors"
 	"fmt"
-	// "strings"
+	"strings"
+	"sync"
 
 	"github.com/miekg/dns"
 )
 
 var (
-	ErrNSECMismatch         = errors.New("solvere: NSEC3 record doesn't match question")
-	ErrNSECTypeExists       = errors.New("solvere: NSEC3 record shows question type exists")
+	ErrNSECMismatch         = errors.New("solvere: NSEC/NSEC3 record doesn't match question")
+	ErrNSECTypeExists       = errors.New("solvere: NSEC/NSEC3 record shows question type exists")
 	ErrNSECMultipleCoverage = errors.New("solvere: Multiple NSEC3 records cover next closer/source of synthesis")
-	ErrNSECMissingCoverage  = errors.New("solvere: NSEC3 record missing for expected encloser")
-	ErrNSECBadDelegation    = errors.New("solvere: DS or SOA bit set in NSEC3 type map")
-	ErrNSECNSMissing        = errors.New("solvere: NS bit not set in NSEC3 type map")
+	ErrNSECMissingCoverage  = errors.New("solvere: NSEC/NSEC3 record missing for expected encloser")
+	ErrNSECBadDelegation    = errors.New("solvere: DS or SOA bit set in NSEC/NSEC3 type map")
+	ErrNSECNSMissing        = errors.New("solvere: NS bit not set in NSEC/NSEC3 type map")
 	ErrNSECOptOut           = errors.New("solvere: Opt-Out bit not set for NSEC3 record covering next closer")
+	ErrWildcardMissingProof = errors.New("solvere: No NSEC/NSEC3 records proving wildcard answer was correctly synthesized")
+	ErrNSEC3Iterations      = errors.New("solvere: NSEC3 records use too many iterations")
+
+	// errInsecureNSEC3Iterations is returned when NSEC3 records use more
+	// iterations than NSEC3InsecureIterations, the response should be treated
+	// as Insecure instead of checking the proof
+	errInsecureNSEC3Iterations = errors.New("solvere: NSEC3 records use more iterations than are checked")
+)
+
+// NSEC3 iteration limits (RFC 9276 Section 3.2). Denial of existence proofs
+// using NSEC3 records with more than NSEC3InsecureIterations iterations
+// aren't checked and the response is treated as Insecure, more than
+// NSEC3BogusIterations and the response is Bogus.
+var (
+	NSEC3InsecureIterations uint16 = 100
+	NSEC3BogusIterations    uint16 = 150
 )
 
+// extractDenial returns the NSEC3 records from a section, or if there are none
+// the NSEC records
+func extractDenial(section []dns.RR) []dns.RR {
+	nsec3 := extractRRSet(section, "", dns.TypeNSEC3)
+	if len(nsec3) > 0 {
+		return nsec3
+	}
+	return extractRRSet(section, "", dns.TypeNSEC)
+}
+
+func isNSEC(nsec []dns.RR) bool {
+	return len(nsec) > 0 && nsec[0].Header().Rrtype == dns.TypeNSEC
+}
+
+// checkNSEC3Iterations checks the iteration counts of a set of NSEC3 records
+// against NSEC3InsecureIterations and NSEC3BogusIterations
+func checkNSEC3Iterations(nsec []dns.RR) error {
+	var max uint16
+	for _, r := range nsec {
+		if n, ok := r.(*dns.NSEC3); ok && n.Iterations > max {
+			max = n.Iterations
+		}
+	}
+	if max > NSEC3BogusIterations {
+		return ErrNSEC3Iterations
+	}
+	if max > NSEC3InsecureIterations {
+		return errInsecureNSEC3Iterations
+	}
+	return nil
+}
+
+// verifyNameError verifies NSEC/NSEC3 records from a answer with a NXDOMAIN (3)
+// RCODE prove the question name doesn't exist
+func (v *validator) verifyNameError(q *Question, nsec []dns.RR) error {
+	if isNSEC(nsec) {
+		return verifyNameErrorNSEC(q, nsec)
+	}
+	if err := checkNSEC3Iterations(nsec); err != nil {
+		return err
+	}
+	return v.verifyNameErrorNSEC3(q, nsec)
+}
+
+// verifyNODATA verifies NSEC/NSEC3 records from a answer with a NOERROR (0) RCODE
+// and a empty Answer section
+func (v *validator) verifyNODATA(q *Question, nsec []dns.RR) error {
+	if isNSEC(nsec) {
+		return verifyNODATANSEC(q, nsec)
+	}
+	if err := checkNSEC3Iterations(nsec); err != nil {
+		return err
+	}
+	return v.verifyNODATANSEC3(q, nsec)
+}
+
+// verifyWildcardAnswer verifies NSEC/NSEC3 records prove that no closer match
+// than the wildcard directly below encloser exists for name, which is required
+// for a answer synthesized from a wildcard to be considered valid
+func (v *validator) verifyWildcardAnswer(name, encloser string, nsec []dns.RR) error {
+	if len(nsec) == 0 {
+		return ErrWildcardMissingProof
+	}
+	if isNSEC(nsec) {
+		return verifyWildcardAnswerNSEC(name, encloser, nsec)
+	}
+	if err := checkNSEC3Iterations(nsec); err != nil {
+		return err
+	}
+	return v.verifyWildcardAnswerNSEC3(name, encloser, nsec)
+}
+
+// verifyDelegation verifies NSEC/NSEC3 records from a referral prove the
+// delegation is unsigned
+func (v *validator) verifyDelegation(delegation string, nsec []dns.RR) error {
+	if isNSEC(nsec) {
+		return verifyDelegationNSEC(delegation, nsec)
+	}
+	if err := checkNSEC3Iterations(nsec); err != nil {
+		return err
+	}
+	return v.verifyDelegationNSEC3(delegation, nsec)
+}
+
 func typesSet(set []uint16, types ...uint16) bool {
 	tm := make(map[uint16]struct{}, len(types))
 	for _, t := range types {
@@ -31,40 +132,149 @@ func typesSet(set []uint16, types ...uint16) bool {
 	return false
 }
 
+// nsec3HashCacheSize is the maximum number of hashes kept by a nsec3HashCache
+const nsec3HashCacheSize = 10000
+
+type nsec3HashKey struct {
+	name       string
+	hash       uint8
+	iterations uint16
+	salt       string
+}
+
+// nsec3HashCache caches computed NSEC3 hashes so names that appear in multiple
+// denial of existence proofs aren't rehashed
+type nsec3HashCache struct {
+	mu     sync.Mutex
+	hashes map[nsec3HashKey]string
+}
+
+func newNSEC3HashCache() *nsec3HashCache {
+	return &nsec3HashCache{hashes: make(map[nsec3HashKey]string)}
+}
+
+func (hc *nsec3HashCache) get(key nsec3HashKey) (string, bool) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hash, present := hc.hashes[key]
+	return hash, present
+}
+
+func (hc *nsec3HashCache) add(key nsec3HashKey, hash string) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if len(hc.hashes) >= nsec3HashCacheSize {
+		// just start over instead of tracking which hashes are used
+		hc.hashes = make(map[nsec3HashKey]string)
+	}
+	hc.hashes[key] = hash
+}
+
+// nsec3Hash hashes name using the parameters from n. Hashes that aren't
+// already cached count against the NSEC3 hash limit.
+func (v *validator) nsec3Hash(name string, n *dns.NSEC3) (string, error) {
+	key := nsec3HashKey{strings.ToLower(name), n.Hash, n.Iterations, strings.ToUpper(n.Salt)}
+	if v.nsec3Cache != nil {
+		if hash, present := v.nsec3Cache.get(key); present {
+			return hash, nil
+		}
+	}
+	v.nsec3Hashes++
+	if v.nsec3Hashes > MaxNSEC3Hashes {
+		return "", ErrTooManyNSEC3Hashes
+	}
+	hash := dns.HashName(name, n.Hash, n.Iterations, n.Salt)
+	if v.nsec3Cache != nil {
+		v.nsec3Cache.add(key, hash)
+	}
+	return hash, nil
+}
+
+// nsec3Owner returns the hashed owner name label of a NSEC3 record
+func nsec3Owner(n *dns.NSEC3) string {
+	labels := dns.SplitDomainName(n.Hdr.Name)
+	if len(labels) < 2 {
+		return ""
+	}
+	return strings.ToUpper(labels[0])
+}
+
+// nsec3Matches returns true if the hash of name matches the owner of n
+func (v *validator) nsec3Matches(n *dns.NSEC3, name string) (bool, error) {
+	owner := nsec3Owner(n)
+	if owner == "" {
+		return false, nil
+	}
+	hash, err := v.nsec3Hash(name, n)
+	if err != nil {
+		return false, err
+	}
+	return hash != "" && hash == owner, nil
+}
+
+// nsec3Covers returns true if the hash of name falls strictly between the owner
+// of n and the next hashed owner name, including when n is the last record in
+// the chain and the interval wraps around
+func (v *validator) nsec3Covers(n *dns.NSEC3, name string) (bool, error) {
+	owner := nsec3Owner(n)
+	next := strings.ToUpper(n.NextDomain)
+	if owner == "" || next == "" || owner == next {
+		return false, nil
+	}
+	hash, err := v.nsec3Hash(name, n)
+	if err != nil || hash == "" {
+		return false, err
+	}
+	if owner > next {
+		return hash > owner || hash < next, nil
+	}
+	return hash > owner && hash < next, nil
+}
+
 // findClosestEncloser finds the Closest Encloser and Next Closers for a name
 // in a set of NSEC3 records
-func findClosestEncloser(name string, nsec []dns.RR) (string, string) {
+func (v *validator) findClosestEncloser(name string, nsec []dns.RR) (string, string, error) {
 	// RFC 5155 Section 8.3 (ish)
 	labelIndices := dns.Split(name)
 	nc := name
 	for i := 0; i < len(labelIndices); i++ {
 		z := name[labelIndices[i]:]
-		_, err := findMatching(z, nsec)
-		if err != nil {
+		_, err := v.findMatching(z, nsec)
+		if err == ErrTooManyNSEC3Hashes {
+			return "", "", err
+		} else if err != nil {
 			continue
 		}
 		if i != 0 {
 			nc = name[labelIndices[i-1]:]
 		}
-		return z, nc
+		return z, nc, nil
 	}
-	return "", ""
+	return "", "", ErrNSECMissingCoverage
 }
 
-func findMatching(name string, nsec []dns.RR) ([]uint16, error) {
+func (v *validator) findMatching(name string, nsec []dns.RR) ([]uint16, error) {
 	for _, rr := range nsec {
 		n := rr.(*dns.NSEC3)
-		if n.Match(name) {
+		match, err := v.nsec3Matches(n, name)
+		if err != nil {
+			return nil, err
+		}
+		if match {
 			return n.TypeBitMap, nil
 		}
 	}
 	return nil, ErrNSECMissingCoverage
 }
 
-func findCoverer(name string, nsec []dns.RR) ([]uint16, bool, error) {
+func (v *validator) findCoverer(name string, nsec []dns.RR) ([]uint16, bool, error) {
 	for _, rr := range nsec {
 		n := rr.(*dns.NSEC3)
-		if n.Cover(name) {
+		covers, err := v.nsec3Covers(n, name)
+		if err != nil {
+			return nil, false, err
+		}
+		if covers {
 			return n.TypeBitMap, (n.Flags & 1) == 1, nil
 		}
 	}
@@ -72,39 +282,58 @@ func findCoverer(name string, nsec []dns.RR) ([]uint16, bool, error) {
 }
 
 // RFC 5155 Section 8.4
-func verifyNameError(q *Question, nsec []dns.RR) error {
-	ce, _ := findClosestEncloser(q.Name, nsec)
-	if ce == "" {
-		return ErrNSECMissingCoverage
+func (v *validator) verifyNameErrorNSEC3(q *Question, nsec []dns.RR) error {
+	ce, nc, err := v.findClosestEncloser(q.Name, nsec)
+	if err != nil {
+		return err
+	}
+	if ce == q.Name {
+		// the name itself exists
+		return ErrNSECMismatch
 	}
-	_, _, err := findCoverer(fmt.Sprintf("*.%s", ce), nsec)
+	// the next closer name must not exist, otherwise the closest encloser
+	// could be any name above the real one
+	_, _, err = v.findCoverer(nc, nsec)
+	if err != nil {
+		return err
+	}
+	_, _, err = v.findCoverer(fmt.Sprintf("*.%s", ce), nsec)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// verifyNODATA verifies NSEC/NSEC3 records from a answer with a NOERROR (0) RCODE
-// and a empty Answer section
-func verifyNODATA(q *Question, nsec []dns.RR) error {
+func (v *validator) verifyNODATANSEC3(q *Question, nsec []dns.RR) error {
 	// RFC5155 Section 8.5
-	types, err := findMatching(q.Name, nsec)
-	if err != nil {
-		if q.Type != dns.TypeDS {
+	types, err := v.findMatching(q.Name, nsec)
+	if err == ErrTooManyNSEC3Hashes {
+		return err
+	} else if err != nil {
+		ce, nc, err := v.findClosestEncloser(q.Name, nsec)
+		if err != nil {
+			return err
+		}
+		_, optOut, err := v.findCoverer(nc, nsec)
+		if err != nil {
 			return err
 		}
 
-		// RFC5155 Section 8.6
-		ce, nc := findClosestEncloser(q.Name, nsec)
-		if ce == "" {
-			return ErrNSECMissingCoverage
+		if q.Type == dns.TypeDS {
+			// RFC5155 Section 8.6
+			if !optOut {
+				return ErrNSECOptOut
+			}
+			return nil
 		}
-		_, optOut, err := findCoverer(nc, nsec)
+
+		// RFC5155 Section 8.7
+		wildcardTypes, err := v.findMatching(wildcardName(ce), nsec)
 		if err != nil {
 			return err
 		}
-		if !optOut {
-			return ErrNSECOptOut
+		if typesSet(wildcardTypes, q.Type, dns.TypeCNAME) {
+			return ErrNSECTypeExists
 		}
 		return nil
 	}
@@ -112,37 +341,26 @@ func verifyNODATA(q *Question, nsec []dns.RR) error {
 	if typesSet(types, q.Type, dns.TypeCNAME) {
 		return ErrNSECTypeExists
 	}
-	// BUG(roland): pretty sure this is 100% incorrect, should prob be its own method...
-	// if strings.HasPrefix(q.Name, "*.") {
-	// 	// RFC 5155 Section 8.7
-	// 	ce, _ := findClosestEncloser(q.Name, nsec)
-	// 	if ce == "" {
-	// 		return ErrNSECMissingCoverage
-	// 	}
-	// 	matchTypes, err := findMatching(fmt.Sprintf("*.%s", ce), nsec)
-	// 	if err != nil {
-	// 		return err
-	// 	}
-	// 	if typesSet(matchTypes, q.Type, dns.TypeCNAME) {
-	// 		return ErrNSECTypeExists
-	// 	}
-	// }
 	return nil
 }
 
 // RFC 5155 Section 8.8
-// func verifyWildcardAnswer() {
-// }
+func (v *validator) verifyWildcardAnswerNSEC3(name, encloser string, nsec []dns.RR) error {
+	_, _, err := v.findCoverer(nextCloser(name, encloser), nsec)
+	return err
+}
 
 // RFC 5155 Section 8.9
-func verifyDelegation(delegation string, nsec []dns.RR) error {
-	types, err := findMatching(delegation, nsec)
-	if err != nil {
-		ce, nc := findClosestEncloser(delegation, nsec)
-		if ce == "" {
-			return ErrNSECMissingCoverage
+func (v *validator) verifyDelegationNSEC3(delegation string, nsec []dns.RR) error {
+	types, err := v.findMatching(delegation, nsec)
+	if err == ErrTooManyNSEC3Hashes {
+		return err
+	} else if err != nil {
+		_, nc, err := v.findClosestEncloser(delegation, nsec)
+		if err != nil {
+			return err
 		}
-		_, optOut, err := findCoverer(nc, nsec)
+		_, optOut, err := v.findCoverer(nc, nsec)
 		if err != nil {
 			return err
 		}
@@ -159,3 +377,185 @@ func verifyDelegation(delegation string, nsec []dns.RR) error {
 	}
 	return nil
 }
+
+// canonicalCompare compares two names using the canonical DNS name order
+// defined in RFC 4034 Section 6.1, returning -1, 0, or 1
+func canonicalCompare(a, b string) int {
+	al := dns.SplitDomainName(strings.ToLower(a))
+	bl := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(al) && i <= len(bl); i++ {
+		if c := strings.Compare(al[len(al)-i], bl[len(bl)-i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(al) < len(bl):
+		return -1
+	case len(al) > len(bl):
+		return 1
+	}
+	return 0
+}
+
+func isSubDomain(parent, child string) bool {
+	return dns.IsSubDomain(strings.ToLower(parent), strings.ToLower(child))
+}
+
+// wildcardName returns the wildcard name directly below encloser
+func wildcardName(encloser string) string {
+	if encloser == "." {
+		return "*."
+	}
+	return "*." + encloser
+}
+
+// nextCloser returns the name one label longer than encloser on the way to name
+func nextCloser(name, encloser string) string {
+	labels := dns.SplitDomainName(name)
+	n := dns.CountLabel(encloser) + 1
+	if n > len(labels) {
+		return name
+	}
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
+
+// nsecCovers checks if name falls between the owner and next name of a NSEC
+// record in the canonical ordering
+func nsecCovers(n *dns.NSEC, name string) bool {
+	if canonicalCompare(n.Hdr.Name, name) >= 0 {
+		return false
+	}
+	if canonicalCompare(n.Hdr.Name, n.NextDomain) >= 0 {
+		// last NSEC record in the zone, the next name is the apex
+		return isSubDomain(n.NextDomain, name)
+	}
+	return canonicalCompare(name, n.NextDomain) < 0
+}
+
+func findNSECMatch(name string, nsec []dns.RR) (*dns.NSEC, error) {
+	for _, rr := range nsec {
+		n := rr.(*dns.NSEC)
+		if canonicalCompare(n.Hdr.Name, name) == 0 {
+			return n, nil
+		}
+	}
+	return nil, ErrNSECMissingCoverage
+}
+
+func findNSECCoverer(name string, nsec []dns.RR) (*dns.NSEC, error) {
+	for _, rr := range nsec {
+		n := rr.(*dns.NSEC)
+		if !nsecCovers(n, name) {
+			continue
+		}
+		// RFC 4035 Section 5.4, a NSEC record from the parent side of a
+		// delegation or from a DNAME cannot prove anything about the names
+		// below it
+		if isSubDomain(n.Hdr.Name, name) && (typesSet(n.TypeBitMap, dns.TypeDNAME) ||
+			(typesSet(n.TypeBitMap, dns.TypeNS) && !typesSet(n.TypeBitMap, dns.TypeSOA))) {
+			continue
+		}
+		return n, nil
+	}
+	return nil, ErrNSECMissingCoverage
+}
+
+// nsecClosestEncloser finds the closest encloser of a name using the NSEC
+// record that covers it, this is the longest common ancestor of the name and
+// either the owner or the next name of the record
+func nsecClosestEncloser(name string, n *dns.NSEC) string {
+	labels := dns.SplitDomainName(name)
+	common := dns.CompareDomainName(strings.ToLower(name), strings.ToLower(n.Hdr.Name))
+	if c := dns.CompareDomainName(strings.ToLower(name), strings.ToLower(n.NextDomain)); c > common {
+		common = c
+	}
+	if common == 0 {
+		return "."
+	}
+	return strings.Join(labels[len(labels)-common:], ".") + "."
+}
+
+// RFC 4035 Section 5.4, a NSEC record must prove the name doesn't exist and
+// another that no wildcard could have been used to synthesize a answer
+func verifyNameErrorNSEC(q *Question, nsec []dns.RR) error {
+	n, err := findNSECCoverer(q.Name, nsec)
+	if err != nil {
+		return err
+	}
+	_, err = findNSECCoverer(wildcardName(nsecClosestEncloser(q.Name, n)), nsec)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RFC 4035 Section 5.4 and RFC 6840 Section 4.1
+func verifyNODATANSEC(q *Question, nsec []dns.RR) error {
+	n, err := findNSECMatch(q.Name, nsec)
+	if err == nil {
+		if typesSet(n.TypeBitMap, q.Type, dns.TypeCNAME) {
+			return ErrNSECTypeExists
+		}
+		delegation := typesSet(n.TypeBitMap, dns.TypeNS) && !typesSet(n.TypeBitMap, dns.TypeSOA)
+		if q.Type == dns.TypeDS {
+			// the absence of DS records can only be proven by the parent side
+			// of a zone cut
+			if typesSet(n.TypeBitMap, dns.TypeSOA) {
+				return ErrNSECBadDelegation
+			}
+		} else if delegation {
+			// the parent side of a zone cut can't prove anything about the
+			// data in the child zone
+			return ErrNSECBadDelegation
+		}
+		return nil
+	}
+
+	n, err = findNSECCoverer(q.Name, nsec)
+	if err != nil {
+		return err
+	}
+	if isSubDomain(q.Name, n.NextDomain) {
+		// the name is a empty non-terminal
+		return nil
+	}
+	// wildcard NODATA, a NSEC record must prove the name doesn't exist and
+	// another that the matching wildcard doesn't have the question type
+	w, err := findNSECMatch(wildcardName(nsecClosestEncloser(q.Name, n)), nsec)
+	if err != nil {
+		return err
+	}
+	if typesSet(w.TypeBitMap, q.Type, dns.TypeCNAME) {
+		return ErrNSECTypeExists
+	}
+	return nil
+}
+
+// RFC 4035 Section 5.2, a insecure delegation is proven by a NSEC record for
+// the delegation with the NS bit set and the DS bit unset
+func verifyDelegationNSEC(delegation string, nsec []dns.RR) error {
+	n, err := findNSECMatch(delegation, nsec)
+	if err != nil {
+		return err
+	}
+	if !typesSet(n.TypeBitMap, dns.TypeNS) {
+		return ErrNSECNSMissing
+	}
+	if typesSet(n.TypeBitMap, dns.TypeDS, dns.TypeSOA) {
+		return ErrNSECBadDelegation
+	}
+	return nil
+}
+
+// RFC 4035 Section 5.3.4, a NSEC record must prove the name itself doesn't
+// exist and that the wildcard encloser is its closest encloser
+func verifyWildcardAnswerNSEC(name, encloser string, nsec []dns.RR) error {
+	n, err := findNSECCoverer(name, nsec)
+	if err != nil {
+		return err
+	}
+	if canonicalCompare(nsecClosestEncloser(name, n), encloser) != 0 {
+		return ErrNSECMismatch
+	}
+	return nil
+}
@@ -1,7 +1,7 @@
 package solvere
 
 import (
-	// "fmt"
+	"fmt"
 	"strings"
 	"testing"
 
@@ -47,7 +47,7 @@ func TestVerifyNameError(t *testing.T) {
 	records := []dns.RR{
 		makeNSEC3("example.com.", "", false, nil),
 	}
-	err := verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records)
+	err := new(validator).verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records)
 	if err != nil {
 		t.Fatalf("verifyNameError failed for valid name error response: %s", err)
 	}
@@ -56,25 +56,54 @@ func TestVerifyNameError(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("org.", "", false, nil),
 	}
-	err = verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records)
+	err = new(validator).verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records)
 	if err == nil {
 		t.Fatalf("verifyNameError didn't fail for invalid name error response without CE")
 	}
 
-	// Invalid name error, no source of synthesis coverer
+	// Valid name error, the last NSEC3 in the chain wraps around to cover
+	// both the next closer and source of synthesis
 	records = []dns.RR{
 		makeNSEC3("com.", "", false, nil),
 	}
-	err = verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records)
+	err = new(validator).verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records)
+	if err != nil {
+		t.Fatalf("verifyNameError failed for valid name error response with wrapping NSEC3: %s", err)
+	}
+
+	// Invalid name error, no source of synthesis coverer
+	records = []dns.RR{
+		makeNSEC3("com.", "a.example.com.", false, nil),
+	}
+	err = new(validator).verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records)
 	if err == nil {
 		t.Fatalf("verifyNameError didn't fail for invalid name error response without source of synthesis coverer")
 	}
 
+	// Invalid name error, no next closer coverer
+	records = []dns.RR{
+		makeNSEC3("com.", "com.", false, nil),
+		makeNSEC3("*.example.com.", "", false, nil),
+	}
+	err = new(validator).verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records)
+	if err == nil {
+		t.Fatalf("verifyNameError didn't fail for invalid name error response without next closer coverer")
+	}
+
+	// Invalid name error, the name exists
+	records = []dns.RR{
+		makeNSEC3("a.example.com.", "", false, nil),
+	}
+	err = new(validator).verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records)
+	if err == nil {
+		t.Fatalf("verifyNameError didn't fail for invalid name error response for a name that exists")
+	}
+
 	// RFC5155 Appendix B.1 example
 	records = zoneToRecords(t, `0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example. 3600 IN NSEC3 1 1 12 aabbccdd 2t7b4g4vsa5smi47k61mv5bv1a22bojr MX DNSKEY NS SOA NSEC3PARAM RRSIG
 b4um86eghhds6nea196smvmlo4ors995.example. 3600 IN NSEC3 1 1 12 aabbccdd gjeqe526plbf1g8mklp59enfd789njgi MX RRSIG
 35mthgpgcu1qg68fab165klnsnk3dpvl.example. 3600 IN NSEC3 1 1 12 aabbccdd b4um86eghhds6nea196smvmlo4ors995 NS DS RRSIG`)
-	err = verifyNameError(&Question{Name: "a.c.x.w.example.", Type: dns.TypeA}, records)
+	err = new(validator).verifyNameError(&Question{Name: "a.c.x.w.example.", Type: dns.TypeA}, records)
 	if err != nil {
 		t.Fatalf("verifyNameError failed with RFC5155 Appendix B.1 example: %s", err)
 	}
@@ -85,7 +114,7 @@ func TestVerifyNODATA(t *testing.T) {
 	records := []dns.RR{
 		makeNSEC3("example.com.", "", false, nil),
 	}
-	err := verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeA}, records)
+	err := new(validator).verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeA}, records)
 	if err != nil {
 		t.Fatalf("verifyNODATA failed for valid NODATA: %s", err)
 	}
@@ -94,7 +123,7 @@ func TestVerifyNODATA(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("example.com.", "", false, []uint16{dns.TypeA}),
 	}
-	err = verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeA}, records)
+	err = new(validator).verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeA}, records)
 	if err == nil {
 		t.Fatal("verifyNODATA didn't fail for invalid NODATA with question type bit set")
 	}
@@ -103,7 +132,7 @@ func TestVerifyNODATA(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("example.com.", "", false, []uint16{dns.TypeCNAME}),
 	}
-	err = verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeA}, records)
+	err = new(validator).verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeA}, records)
 	if err == nil {
 		t.Fatal("verifyNODATA didn't fail for invalid NODATA with CNAME bit set")
 	}
@@ -112,7 +141,7 @@ func TestVerifyNODATA(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("example.com.", "", true, nil),
 	}
-	err = verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeDS}, records)
+	err = new(validator).verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeDS}, records)
 	if err != nil {
 		t.Fatalf("verifyNODATA failed for valid NODATA with covered NC: %s", err)
 	}
@@ -121,7 +150,7 @@ func TestVerifyNODATA(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("example.com.", "", false, nil),
 	}
-	err = verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeA}, records)
+	err = new(validator).verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeA}, records)
 	if err == nil {
 		t.Fatalf("verifyNODATA didn't fail for invalid NODATA with covered NC with non-DS question type")
 	}
@@ -130,7 +159,7 @@ func TestVerifyNODATA(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("com.", "", false, nil),
 	}
-	err = verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeDS}, records)
+	err = new(validator).verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeDS}, records)
 	if err == nil {
 		t.Fatalf("verifyNODATA didn't fail for invalid NODATA without covered NC")
 	}
@@ -139,7 +168,7 @@ func TestVerifyNODATA(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("org.", "", false, nil),
 	}
-	err = verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeDS}, records)
+	err = new(validator).verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeDS}, records)
 	if err == nil {
 		t.Fatalf("verifyNODATA didn't fail for invalid NODATA without CE")
 	}
@@ -148,21 +177,21 @@ func TestVerifyNODATA(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("example.com.", "", false, nil),
 	}
-	err = verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeDS}, records)
+	err = new(validator).verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeDS}, records)
 	if err == nil {
 		t.Fatalf("verifyNODATA didn't fail for invalid NODATA with covered NC without opt-out set")
 	}
 
 	// RFC5155 Appendix B.2 example
 	records = zoneToRecords(t, `2t7b4g4vsa5smi47k61mv5bv1a22bojr.example. 3600 IN NSEC3 1 1 12 aabbccdd 2vptu5timamqttgl4luu9kg21e0aor3s A RRSIG`)
-	err = verifyNODATA(&Question{Name: "ns1.example.", Type: dns.TypeMX}, records)
+	err = new(validator).verifyNODATA(&Question{Name: "ns1.example.", Type: dns.TypeMX}, records)
 	if err != nil {
 		t.Fatalf("verifyNODATA failed with RFC5155 Appendix B.2 example: %s", err)
 	}
 
 	// RFC5155 Appendix B.2.1 example
 	records = zoneToRecords(t, `ji6neoaepv8b5o6k4ev33abha8ht9fgc.example. 3600 IN NSEC3 1 1 12 aabbccdd k8udemvp1j2f7eg6jebps17vp3n8i58h`)
-	err = verifyNODATA(&Question{Name: "y.w.example.", Type: dns.TypeA}, records)
+	err = new(validator).verifyNODATA(&Question{Name: "y.w.example.", Type: dns.TypeA}, records)
 	if err != nil {
 		t.Fatalf("verifyNODATA failed with RFC5155 Appendix B.2.1 example: %s", err)
 	}
@@ -176,7 +205,7 @@ func TestVerifyDelegation(t *testing.T) {
 	records := []dns.RR{
 		makeNSEC3("a.b.com.", "b.b.com.", false, []uint16{dns.TypeNS}),
 	}
-	err := verifyDelegation("a.b.com.", records)
+	err := new(validator).verifyDelegation("a.b.com.", records)
 	if err != nil {
 		t.Fatalf("verifyDelegation failed for a direct delegation match: %s", err)
 	}
@@ -185,7 +214,7 @@ func TestVerifyDelegation(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("a.b.com.", "b.b.com.", false, nil),
 	}
-	err = verifyDelegation("a.b.com.", records)
+	err = new(validator).verifyDelegation("a.b.com.", records)
 	if err == nil {
 		t.Fatal("verifyDelegation didn't fail for a direct delegation with NS bit not set")
 	}
@@ -194,7 +223,7 @@ func TestVerifyDelegation(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("a.b.com.", "b.b.com.", false, []uint16{dns.TypeNS, dns.TypeDS}),
 	}
-	err = verifyDelegation("a.b.com.", records)
+	err = new(validator).verifyDelegation("a.b.com.", records)
 	if err == nil {
 		t.Fatal("verifyDelegation didn't fail for a direct delegation with DS bit set")
 	}
@@ -203,7 +232,7 @@ func TestVerifyDelegation(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("a.b.com.", "b.b.com.", false, []uint16{dns.TypeNS, dns.TypeSOA}),
 	}
-	err = verifyDelegation("a.b.com.", records)
+	err = new(validator).verifyDelegation("a.b.com.", records)
 	if err == nil {
 		t.Fatal("verifyDelegation didn't fail for a direct delegation with SOA bit set")
 	}
@@ -213,7 +242,7 @@ func TestVerifyDelegation(t *testing.T) {
 		makeNSEC3("com.", "a.com.", false, []uint16{dns.TypeNS}),  // CE
 		makeNSEC3("a.com.", "e.com.", true, []uint16{dns.TypeNS}), // NC coverer, e.com is a lucky hash, thats not how ordering works
 	}
-	err = verifyDelegation("b.com.", records)
+	err = new(validator).verifyDelegation("b.com.", records)
 	if err != nil {
 		t.Fatalf("verifyDelegation failed for a opt-out delegation match: %s", err)
 	}
@@ -222,7 +251,7 @@ func TestVerifyDelegation(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("com.", "a.com.", false, []uint16{dns.TypeNS}),
 	}
-	err = verifyDelegation("b.com.", records)
+	err = new(validator).verifyDelegation("b.com.", records)
 	if err == nil {
 		t.Fatal("verifyDelegation didn't fail for a direct delegation with no Next Closer")
 	}
@@ -232,14 +261,14 @@ func TestVerifyDelegation(t *testing.T) {
 		makeNSEC3("com.", "a.com.", false, []uint16{dns.TypeNS}),
 		makeNSEC3("a.com.", "e.com.", false, []uint16{dns.TypeNS}),
 	}
-	err = verifyDelegation("b.com.", records)
+	err = new(validator).verifyDelegation("b.com.", records)
 	if err == nil {
 		t.Fatal("verifyDelegation didn't fail for a direct delegation with Opt-Out bit not set on NC")
 	}
 
 	// Invalid Opt-Out delegation, empty NSEC3 set
 	records = []dns.RR{}
-	err = verifyDelegation("b.com.", records)
+	err = new(validator).verifyDelegation("b.com.", records)
 	if err == nil {
 		t.Fatal("verifyDelegation didn't fail for a direct delegation with empty NSEC3 set")
 	}
@@ -247,8 +276,302 @@ func TestVerifyDelegation(t *testing.T) {
 	// RFC5155 Appendix B.3 example
 	records = zoneToRecords(t, `35mthgpgcu1qg68fab165klnsnk3dpvl.example. 3600 IN NSEC3 1 1 12 aabbccdd b4um86eghhds6nea196smvmlo4ors995 NS DS RRSIG
 0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example. 3600 IN NSEC3 1 1 12 aabbccdd 2t7b4g4vsa5smi47k61mv5bv1a22bojr MX DNSKEY NS SOA NSEC3PARAM RRSIG`)
-	err = verifyDelegation("c.example.", records)
+	err = new(validator).verifyDelegation("c.example.", records)
 	if err != nil {
 		t.Fatalf("verifyDelegation failed wtih opt out delegation example from RFC5155: %s", err)
 	}
 }
+
+func TestCanonicalCompare(t *testing.T) {
+	// RFC 4034 Section 6.1 example, minus the names using escaped octets
+	ordered := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"*.z.example.",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			expected := 0
+			if i < j {
+				expected = -1
+			} else if i > j {
+				expected = 1
+			}
+			if c := canonicalCompare(ordered[i], ordered[j]); c != expected {
+				t.Fatalf("canonicalCompare(%q, %q) returned %d, expected %d", ordered[i], ordered[j], c, expected)
+			}
+		}
+	}
+}
+
+// RFC 4035 Appendix A example zone NSEC records
+var exampleNSECZone = `example. 3600 IN NSEC a.example. NS SOA MX RRSIG NSEC DNSKEY
+a.example. 3600 IN NSEC ai.example. NS DS RRSIG NSEC
+ai.example. 3600 IN NSEC b.example. A HINFO AAAA RRSIG NSEC
+b.example. 3600 IN NSEC ns1.example. NS RRSIG NSEC
+ns1.example. 3600 IN NSEC ns2.example. A RRSIG NSEC
+ns2.example. 3600 IN NSEC *.w.example. A RRSIG NSEC
+*.w.example. 3600 IN NSEC x.w.example. MX RRSIG NSEC
+x.w.example. 3600 IN NSEC x.y.w.example. MX RRSIG NSEC
+x.y.w.example. 3600 IN NSEC xx.example. MX RRSIG NSEC
+xx.example. 3600 IN NSEC example. A HINFO AAAA RRSIG NSEC`
+
+func selectNSEC(t *testing.T, owners ...string) []dns.RR {
+	records := []dns.RR{}
+	for _, r := range zoneToRecords(t, exampleNSECZone) {
+		for _, o := range owners {
+			if r.Header().Name == o {
+				records = append(records, r)
+			}
+		}
+	}
+	return records
+}
+
+func TestVerifyNameErrorNSEC(t *testing.T) {
+	// RFC 4035 Appendix B.2
+	err := new(validator).verifyNameError(&Question{Name: "ml.example.", Type: dns.TypeA}, selectNSEC(t, "b.example.", "example."))
+	if err != nil {
+		t.Fatalf("verifyNameError failed with RFC 4035 Appendix B.2 example: %s", err)
+	}
+
+	// Missing wildcard proof
+	err = new(validator).verifyNameError(&Question{Name: "ml.example.", Type: dns.TypeA}, selectNSEC(t, "b.example."))
+	if err == nil {
+		t.Fatal("verifyNameError didn't fail without proof the wildcard doesn't exist")
+	}
+
+	// Name exists
+	err = new(validator).verifyNameError(&Question{Name: "ns1.example.", Type: dns.TypeA}, selectNSEC(t, "ns1.example.", "example."))
+	if err == nil {
+		t.Fatal("verifyNameError didn't fail for a name that exists")
+	}
+
+	// Name below a delegation can't be denied by the parent
+	err = new(validator).verifyNameError(&Question{Name: "c.b.example.", Type: dns.TypeA}, selectNSEC(t, "b.example.", "example."))
+	if err == nil {
+		t.Fatal("verifyNameError didn't fail for a name below a delegation")
+	}
+
+	// Wildcard exists
+	err = new(validator).verifyNameError(&Question{Name: "a.z.w.example.", Type: dns.TypeA}, selectNSEC(t, "x.y.w.example.", "ns2.example.", "*.w.example."))
+	if err == nil {
+		t.Fatal("verifyNameError didn't fail when the wildcard exists")
+	}
+}
+
+func TestVerifyNODATANSEC(t *testing.T) {
+	// RFC 4035 Appendix B.3
+	err := new(validator).verifyNODATA(&Question{Name: "ns1.example.", Type: dns.TypeMX}, selectNSEC(t, "ns1.example."))
+	if err != nil {
+		t.Fatalf("verifyNODATA failed with RFC 4035 Appendix B.3 example: %s", err)
+	}
+
+	// Type exists
+	err = new(validator).verifyNODATA(&Question{Name: "ns1.example.", Type: dns.TypeA}, selectNSEC(t, "ns1.example."))
+	if err == nil {
+		t.Fatal("verifyNODATA didn't fail when the type exists")
+	}
+
+	// Parent side of a delegation
+	err = new(validator).verifyNODATA(&Question{Name: "b.example.", Type: dns.TypeA}, selectNSEC(t, "b.example."))
+	if err == nil {
+		t.Fatal("verifyNODATA didn't fail with the parent side NSEC of a delegation")
+	}
+	err = new(validator).verifyNODATA(&Question{Name: "b.example.", Type: dns.TypeDS}, selectNSEC(t, "b.example."))
+	if err != nil {
+		t.Fatalf("verifyNODATA failed to prove DS absence using the parent side NSEC of a delegation: %s", err)
+	}
+
+	// Empty non-terminal
+	err = new(validator).verifyNODATA(&Question{Name: "w.example.", Type: dns.TypeA}, selectNSEC(t, "ns2.example."))
+	if err != nil {
+		t.Fatalf("verifyNODATA failed for empty non-terminal: %s", err)
+	}
+
+	// RFC 4035 Appendix B.7
+	err = new(validator).verifyNODATA(&Question{Name: "a.z.w.example.", Type: dns.TypeAAAA}, selectNSEC(t, "x.y.w.example.", "*.w.example."))
+	if err != nil {
+		t.Fatalf("verifyNODATA failed with RFC 4035 Appendix B.7 example: %s", err)
+	}
+	err = new(validator).verifyNODATA(&Question{Name: "a.z.w.example.", Type: dns.TypeMX}, selectNSEC(t, "x.y.w.example.", "*.w.example."))
+	if err == nil {
+		t.Fatal("verifyNODATA didn't fail when the wildcard has the question type")
+	}
+	err = new(validator).verifyNODATA(&Question{Name: "a.z.w.example.", Type: dns.TypeAAAA}, selectNSEC(t, "x.y.w.example."))
+	if err == nil {
+		t.Fatal("verifyNODATA didn't fail without the wildcard NSEC")
+	}
+}
+
+func TestVerifyDelegationNSEC(t *testing.T) {
+	// RFC 4035 Appendix B.8
+	err := new(validator).verifyDelegation("b.example.", selectNSEC(t, "b.example."))
+	if err != nil {
+		t.Fatalf("verifyDelegation failed with RFC 4035 Appendix B.8 example: %s", err)
+	}
+
+	// Signed delegation
+	err = new(validator).verifyDelegation("a.example.", selectNSEC(t, "a.example."))
+	if err == nil {
+		t.Fatal("verifyDelegation didn't fail with DS bit set")
+	}
+
+	// Not a delegation
+	err = new(validator).verifyDelegation("ns1.example.", selectNSEC(t, "ns1.example."))
+	if err == nil {
+		t.Fatal("verifyDelegation didn't fail with NS bit unset")
+	}
+
+	// No matching record
+	err = new(validator).verifyDelegation("c.example.", selectNSEC(t, "b.example."))
+	if err == nil {
+		t.Fatal("verifyDelegation didn't fail without a matching NSEC record")
+	}
+}
+
+func TestVerifyWildcardAnswer(t *testing.T) {
+	// RFC 4035 Appendix B.6
+	err := new(validator).verifyWildcardAnswer("a.z.w.example.", "w.example.", selectNSEC(t, "x.y.w.example."))
+	if err != nil {
+		t.Fatalf("verifyWildcardAnswer failed with RFC 4035 Appendix B.6 example: %s", err)
+	}
+
+	// Covering NSEC shows a closer encloser exists
+	err = new(validator).verifyWildcardAnswer("a.x.w.example.", "w.example.", selectNSEC(t, "x.w.example."))
+	if err == nil {
+		t.Fatal("verifyWildcardAnswer didn't fail when a closer encloser exists")
+	}
+
+	// No proof at all
+	err = new(validator).verifyWildcardAnswer("a.z.w.example.", "w.example.", nil)
+	if err != ErrWildcardMissingProof {
+		t.Fatalf("verifyWildcardAnswer didn't fail with ErrWildcardMissingProof without proof: %v", err)
+	}
+
+	// RFC 5155 Appendix B.4
+	records := zoneToRecords(t, `q04jkcevqvmu85r014c7dkba38o0ji5r.example. 3600 IN NSEC3 1 1 12 aabbccdd r53bq7cc2uvmubfu5ocmm6pers9tk9en A RRSIG`)
+	err = new(validator).verifyWildcardAnswer("a.z.w.example.", "w.example.", records)
+	if err != nil {
+		t.Fatalf("verifyWildcardAnswer failed with RFC 5155 Appendix B.4 example: %s", err)
+	}
+	err = new(validator).verifyWildcardAnswer("a.x.w.example.", "w.example.", records)
+	if err == nil {
+		t.Fatal("verifyWildcardAnswer didn't fail when the next closer isn't covered")
+	}
+}
+
+func TestVerifyNODATAWildcardNSEC3(t *testing.T) {
+	// RFC 5155 Appendix B.5
+	records := zoneToRecords(t, `k8udemvp1j2f7eg6jebps17vp3n8i58h.example. 3600 IN NSEC3 1 1 12 aabbccdd kohar7mbb8dc2ce8a9qvl8hon4k53uhi
+q04jkcevqvmu85r014c7dkba38o0ji5r.example. 3600 IN NSEC3 1 1 12 aabbccdd r53bq7cc2uvmubfu5ocmm6pers9tk9en A RRSIG
+r53bq7cc2uvmubfu5ocmm6pers9tk9en.example. 3600 IN NSEC3 1 1 12 aabbccdd t644ebqk9bibcna874givr6joj62mlhv MX RRSIG`)
+	err := new(validator).verifyNODATA(&Question{Name: "a.z.w.example.", Type: dns.TypeAAAA}, records)
+	if err != nil {
+		t.Fatalf("verifyNODATA failed with RFC 5155 Appendix B.5 example: %s", err)
+	}
+	err = new(validator).verifyNODATA(&Question{Name: "a.z.w.example.", Type: dns.TypeMX}, records)
+	if err == nil {
+		t.Fatal("verifyNODATA didn't fail when the wildcard has the question type")
+	}
+	err = new(validator).verifyNODATA(&Question{Name: "a.z.w.example.", Type: dns.TypeAAAA}, records[:2])
+	if err == nil {
+		t.Fatal("verifyNODATA didn't fail without the wildcard NSEC3 record")
+	}
+}
+
+func TestNSEC3Covers(t *testing.T) {
+	// The last record in the chain wraps around to the first, so it covers
+	// hashes after its own owner name and before the first owner name
+	last := makeNSEC3("com.", "example.com.", false, nil)
+	for _, tc := range []struct {
+		name   string
+		covers bool
+	}{
+		{"com.", false},
+		{"example.com.", false},
+		{"a.example.com.", false},
+		{"e.com.", true},
+		{"y.com.", true},
+	} {
+		covers, err := new(validator).nsec3Covers(last, tc.name)
+		if err != nil {
+			t.Fatalf("nsec3Covers failed: %s", err)
+		}
+		if covers != tc.covers {
+			t.Fatalf("nsec3Covers returned %t for %q, expected %t", covers, tc.name, tc.covers)
+		}
+	}
+}
+
+func TestNSEC3HashLimit(t *testing.T) {
+	records := []dns.RR{}
+	for i := 0; i < MaxNSEC3Hashes; i++ {
+		records = append(records, makeNSEC3(fmt.Sprintf("%d.com.", i), "", false, nil))
+	}
+	err := new(validator).verifyNameError(&Question{Name: "a.b.c.example.com.", Type: dns.TypeA}, records)
+	if err != ErrTooManyNSEC3Hashes {
+		t.Fatalf("verifyNameError didn't fail with ErrTooManyNSEC3Hashes: %v", err)
+	}
+}
+
+func TestNSEC3Iterations(t *testing.T) {
+	records := []dns.RR{makeNSEC3("example.com.", "", false, nil)}
+	q := &Question{Name: "a.example.com.", Type: dns.TypeA}
+
+	records[0].(*dns.NSEC3).Iterations = NSEC3InsecureIterations + 1
+	err := new(validator).verifyNameError(q, records)
+	if err != errInsecureNSEC3Iterations {
+		t.Fatalf("verifyNameError didn't fail with errInsecureNSEC3Iterations: %v", err)
+	}
+	state, err := insecureDenial(securityState{status: Secure}, err, "example.com.")
+	if err != nil || state.status != Insecure || state.zone != "example.com." {
+		t.Fatalf("insecureDenial didn't return Insecure state: %#v, %v", state, err)
+	}
+
+	records[0].(*dns.NSEC3).Iterations = NSEC3BogusIterations + 1
+	err = new(validator).verifyNODATA(q, records)
+	if err != ErrNSEC3Iterations {
+		t.Fatalf("verifyNODATA didn't fail with ErrNSEC3Iterations: %v", err)
+	}
+	_, err = insecureDenial(securityState{status: Secure}, err, "example.com.")
+	if err != ErrNSEC3Iterations {
+		t.Fatalf("insecureDenial didn't return ErrNSEC3Iterations: %v", err)
+	}
+	if ee := ExtendedErrorFromError(err); ee.InfoCode != EDEUnsupportedNSEC3Iterations {
+		t.Fatalf("ErrNSEC3Iterations mapped to wrong EDE info code: %d", ee.InfoCode)
+	}
+}
+
+func TestNSEC3HashCache(t *testing.T) {
+	records := []dns.RR{makeNSEC3("example.com.", "", false, nil)}
+	q := &Question{Name: "a.example.com.", Type: dns.TypeA}
+	hc := newNSEC3HashCache()
+
+	v := &validator{nsec3Cache: hc}
+	err := v.verifyNameError(q, records)
+	if err != nil {
+		t.Fatalf("verifyNameError failed for valid name error response: %s", err)
+	}
+	if v.nsec3Hashes == 0 {
+		t.Fatal("verifyNameError didn't compute any hashes")
+	}
+
+	// A second proof for the same name uses the cached hashes
+	v = &validator{nsec3Cache: hc}
+	err = v.verifyNameError(q, records)
+	if err != nil {
+		t.Fatalf("verifyNameError failed for valid name error response: %s", err)
+	}
+	if v.nsec3Hashes != 0 {
+		t.Fatalf("verifyNameError computed %d hashes that should've been cached", v.nsec3Hashes)
+	}
+	hash, present := hc.get(nsec3HashKey{"example.com.", dns.SHA1, 2, "FFFF"})
+	if !present || hash != dns.HashName("example.com.", dns.SHA1, 2, "FFFF") {
+		t.Fatalf("nsec3HashCache contains wrong hash for example.com.: %q", hash)
+	}
+}
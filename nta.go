@@ -0,0 +1,143 @@
+package solvere
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"github.com/miekg/dns"
+)
+
+var ErrInvalidNTAName = errors.New("solvere: Invalid negative trust anchor name")
+
+// NegativeTrustAnchor disables validation at and below Name until Expires, or
+// forever if Expires is zero (RFC 7646). Answers for names it covers are
+// Insecure.
+type NegativeTrustAnchor struct {
+	Name    string
+	Expires time.Time
+}
+
+// AddNegativeTrustAnchor adds a negative trust anchor for name that expires at
+// expires, or never if expires is zero, replacing any existing anchor for the
+// same name. RFC 7646 Section 2 recommends anchors don't last longer than a
+// week. Cached answers for names at or below name are removed so they are
+// looked up again without validation, and again when the anchor expires.
+func (rr *RecursiveResolver) AddNegativeTrustAnchor(name string, expires time.Time) error {
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return ErrInvalidNTAName
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	rr.ntaMu.Lock()
+	if rr.ntas == nil {
+		rr.ntas = make(map[string]time.Time)
+	}
+	rr.ntas[name] = expires
+	rr.ntaMu.Unlock()
+	rr.FlushCache(name, true)
+	return nil
+}
+
+// RemoveNegativeTrustAnchor removes the negative trust anchor for name if one
+// exists. Cached answers for names at or below name are removed so they are
+// looked up and validated again.
+func (rr *RecursiveResolver) RemoveNegativeTrustAnchor(name string) {
+	name = strings.ToLower(dns.Fqdn(name))
+	rr.ntaMu.Lock()
+	delete(rr.ntas, name)
+	rr.ntaMu.Unlock()
+	rr.FlushCache(name, true)
+}
+
+func (rr *RecursiveResolver) now() time.Time {
+	if rr.clk == nil {
+		return clock.Default().Now()
+	}
+	return rr.clk.Now()
+}
+
+// NegativeTrustAnchors returns the negative trust anchors that haven't expired,
+// expired anchors are removed
+func (rr *RecursiveResolver) NegativeTrustAnchors() []NegativeTrustAnchor {
+	now := rr.now()
+	rr.ntaMu.RLock()
+	ntas, expired := []NegativeTrustAnchor{}, []NegativeTrustAnchor{}
+	for name, expires := range rr.ntas {
+		nta := NegativeTrustAnchor{Name: name, Expires: expires}
+		if nta.expired(now) {
+			expired = append(expired, nta)
+			continue
+		}
+		ntas = append(ntas, nta)
+	}
+	rr.ntaMu.RUnlock()
+	rr.removeExpiredNTAs(expired)
+	sort.Slice(ntas, func(i, j int) bool { return ntas[i].Name < ntas[j].Name })
+	return ntas
+}
+
+// negativeTrustAnchor returns the closest unexpired negative trust anchor at
+// or above name. Expired anchors it finds are removed.
+func (rr *RecursiveResolver) negativeTrustAnchor(name string) *NegativeTrustAnchor {
+	now := rr.now()
+	name = strings.ToLower(dns.Fqdn(name))
+	rr.ntaMu.RLock()
+	if len(rr.ntas) == 0 {
+		rr.ntaMu.RUnlock()
+		return nil
+	}
+	var found *NegativeTrustAnchor
+	var expired []NegativeTrustAnchor
+	for _, i := range append(dns.Split(name), len(name)-1) {
+		expires, present := rr.ntas[name[i:]]
+		if !present {
+			continue
+		}
+		nta := NegativeTrustAnchor{Name: name[i:], Expires: expires}
+		if !nta.expired(now) {
+			found = &nta
+			break
+		}
+		expired = append(expired, nta)
+	}
+	rr.ntaMu.RUnlock()
+	rr.removeExpiredNTAs(expired)
+	return found
+}
+
+// removeExpiredNTAs removes expired negative trust anchors, unless they have
+// been replaced, and the answers cached while they were in place
+func (rr *RecursiveResolver) removeExpiredNTAs(ntas []NegativeTrustAnchor) {
+	for _, nta := range ntas {
+		rr.ntaMu.Lock()
+		expires, present := rr.ntas[nta.Name]
+		current := present && expires.Equal(nta.Expires)
+		if current {
+			delete(rr.ntas, nta.Name)
+		}
+		rr.ntaMu.Unlock()
+		if current {
+			rr.FlushCache(nta.Name, true)
+		}
+	}
+}
+
+func (nta *NegativeTrustAnchor) expired(now time.Time) bool {
+	return !nta.Expires.IsZero() && !now.Before(nta.Expires)
+}
+
+// ntaSecurity returns the Insecure state used for names covered by nta
+func ntaSecurity(nta *NegativeTrustAnchor) securityState {
+	reason := fmt.Sprintf("validation disabled by negative trust anchor for %s", nta.Name)
+	if !nta.Expires.IsZero() {
+		reason += fmt.Sprintf(" until %s", nta.Expires.UTC().Format(time.RFC3339))
+	}
+	return securityState{
+		status: Insecure,
+		reason: reason,
+		zone:   nta.Name,
+	}
+}
@@ -0,0 +1,96 @@
+package solvere
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"github.com/miekg/dns"
+)
+
+func TestNegativeTrustAnchors(t *testing.T) {
+	fc := clock.NewFake()
+	rr := &RecursiveResolver{
+		useDNSSEC:  true,
+		rootAnchor: trustAnchorDS([]dns.RR{&exampleKey}),
+		clk:        fc,
+	}
+
+	err := rr.AddNegativeTrustAnchor("Example.com", fc.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("AddNegativeTrustAnchor failed: %s", err)
+	}
+	err = rr.AddNegativeTrustAnchor("org.", fc.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("AddNegativeTrustAnchor failed: %s", err)
+	}
+	err = rr.AddNegativeTrustAnchor("bad..name.", fc.Now().Add(time.Hour))
+	if err != ErrInvalidNTAName {
+		t.Fatalf("AddNegativeTrustAnchor didn't fail with ErrInvalidNTAName: %v", err)
+	}
+
+	testCases := []struct {
+		name    string
+		covered string
+	}{
+		{"example.com.", "example.com."},
+		{"a.b.EXAMPLE.com.", "example.com."},
+		{"notexample.com.", ""},
+		{"com.", ""},
+		{"example.org.", "org."},
+		{".", ""},
+	}
+	for _, tc := range testCases {
+		nta := rr.negativeTrustAnchor(tc.name)
+		if tc.covered == "" {
+			if nta != nil {
+				t.Fatalf("%s is covered by unexpected negative trust anchor %s", tc.name, nta.Name)
+			}
+			continue
+		}
+		if nta == nil || nta.Name != tc.covered {
+			t.Fatalf("%s isn't covered by the negative trust anchor for %s: %v", tc.name, tc.covered, nta)
+		}
+	}
+
+	s, ds := rr.initialSecurity(&Question{Name: "www.example.com."})
+	if s.status != Insecure || s.zone != "example.com." || s.reason == "" || ds != nil {
+		t.Fatalf("Chain for name covered by a negative trust anchor started as %s at %q: %q", s.status, s.zone, s.reason)
+	}
+	if s, _ := rr.initialSecurity(&Question{Name: "example.net."}); s.status != Secure {
+		t.Fatalf("Chain for name not covered by a negative trust anchor started as %s", s.status)
+	}
+
+	if ntas := rr.NegativeTrustAnchors(); len(ntas) != 2 || ntas[0].Name != "example.com." || ntas[1].Name != "org." {
+		t.Fatalf("NegativeTrustAnchors returned unexpected anchors: %v", ntas)
+	}
+
+	// expired anchors are ignored and removed
+	fc.Add(time.Hour)
+	if nta := rr.negativeTrustAnchor("example.com."); nta != nil {
+		t.Fatal("Expired negative trust anchor is still used")
+	}
+	if ntas := rr.NegativeTrustAnchors(); len(ntas) != 1 || ntas[0].Name != "org." {
+		t.Fatalf("NegativeTrustAnchors returned unexpected anchors: %v", ntas)
+	}
+
+	rr.RemoveNegativeTrustAnchor("ORG")
+	if ntas := rr.NegativeTrustAnchors(); len(ntas) != 0 {
+		t.Fatalf("Negative trust anchor wasn't removed: %v", ntas)
+	}
+
+	// anchors with no expiry are kept forever
+	err = rr.AddNegativeTrustAnchor("net.", time.Time{})
+	if err != nil {
+		t.Fatalf("AddNegativeTrustAnchor failed: %s", err)
+	}
+	fc.Add(365 * 24 * time.Hour)
+	if ntas := rr.NegativeTrustAnchors(); len(ntas) != 1 || ntas[0].Name != "net." {
+		t.Fatalf("NegativeTrustAnchors returned unexpected anchors: %v", ntas)
+	}
+	s, _ = rr.initialSecurity(&Question{Name: "example.net."})
+	if s.status != Insecure || strings.Contains(s.reason, "until") {
+		t.Fatalf("Chain for name covered by a permanent negative trust anchor started as %s: %q", s.status, s.reason)
+	}
+}
@@ -0,0 +1,83 @@
+package solvere
+
+import (
+	"github.com/miekg/dns"
+)
+
+// supportedAlgorithms are the DNSKEY algorithms signatures can be validated
+// for. RSAMD5, DSA and ECC-GOST must not be used for validation (RFC 8624
+// Section 3.1) and Ed25519/Ed448 aren't implemented.
+var supportedAlgorithms = map[uint8]bool{
+	dns.RSASHA1:          true,
+	dns.RSASHA1NSEC3SHA1: true,
+	dns.RSASHA256:        true,
+	dns.RSASHA512:        true,
+	dns.ECDSAP256SHA256:  true,
+	dns.ECDSAP384SHA384:  true,
+}
+
+// supportedDigests are the DS digest types that can be validated. GOST R
+// 34.11-94 isn't implemented (RFC 8624 Section 3.3).
+var supportedDigests = map[uint8]bool{
+	dns.SHA1:   true,
+	dns.SHA256: true,
+	dns.SHA384: true,
+}
+
+// AlgorithmPolicy controls which DNSKEY algorithms and DS digest types are used
+// to validate responses. A zone whose DS records only use unsupported or disabled
+// algorithms or digest types is treated as Insecure, as described in RFC 6840
+// Section 5.2. A nil *AlgorithmPolicy enables everything that is supported.
+type AlgorithmPolicy struct {
+	// DisabledAlgorithms contains DNSKEY algorithm numbers that shouldn't be
+	// used, e.g. dns.RSASHA1
+	DisabledAlgorithms map[uint8]bool
+	// DisabledDigests contains DS digest types that shouldn't be used, e.g.
+	// dns.SHA1
+	DisabledDigests map[uint8]bool
+}
+
+// AlgorithmEnabled returns true if alg is supported and not disabled
+func (ap *AlgorithmPolicy) AlgorithmEnabled(alg uint8) bool {
+	if !supportedAlgorithms[alg] {
+		return false
+	}
+	return ap == nil || !ap.DisabledAlgorithms[alg]
+}
+
+// DigestEnabled returns true if digest is supported and not disabled
+func (ap *AlgorithmPolicy) DigestEnabled(digest uint8) bool {
+	if !supportedDigests[digest] {
+		return false
+	}
+	return ap == nil || !ap.DisabledDigests[digest]
+}
+
+// usableDS returns the DS records from dsSet that use a enabled algorithm and
+// digest type. SHA-1 DS records are ignored if there are DS records using a
+// stronger digest type so a attacker can't downgrade the zone to the weaker
+// digest by stripping the others (RFC 4509 Section 3).
+func (ap *AlgorithmPolicy) usableDS(dsSet []dns.RR) []dns.RR {
+	usable := []dns.RR{}
+	stronger := false
+	for _, r := range dsSet {
+		ds, ok := r.(*dns.DS)
+		if !ok || !ap.AlgorithmEnabled(ds.Algorithm) || !ap.DigestEnabled(ds.DigestType) {
+			continue
+		}
+		if ds.DigestType != dns.SHA1 {
+			stronger = true
+		}
+		usable = append(usable, ds)
+	}
+	if !stronger {
+		return usable
+	}
+	filtered := []dns.RR{}
+	for _, r := range usable {
+		if r.(*dns.DS).DigestType != dns.SHA1 {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,55 @@
+package solvere
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAlgorithmPolicy(t *testing.T) {
+	var ap *AlgorithmPolicy
+	if !ap.AlgorithmEnabled(dns.RSASHA1) || !ap.DigestEnabled(dns.SHA1) {
+		t.Fatal("nil AlgorithmPolicy doesn't enable supported algorithms and digests")
+	}
+	if ap.AlgorithmEnabled(dns.RSAMD5) || ap.AlgorithmEnabled(dns.ECCGOST) || ap.DigestEnabled(dns.GOST94) {
+		t.Fatal("nil AlgorithmPolicy enables unsupported algorithms or digests")
+	}
+	ap = &AlgorithmPolicy{
+		DisabledAlgorithms: map[uint8]bool{dns.RSASHA1: true},
+		DisabledDigests:    map[uint8]bool{dns.SHA1: true},
+	}
+	if ap.AlgorithmEnabled(dns.RSASHA1) || ap.DigestEnabled(dns.SHA1) {
+		t.Fatal("AlgorithmPolicy enables disabled algorithm or digest")
+	}
+	if !ap.AlgorithmEnabled(dns.RSASHA256) || !ap.DigestEnabled(dns.SHA256) {
+		t.Fatal("AlgorithmPolicy doesn't enable algorithm or digest that isn't disabled")
+	}
+}
+
+func TestUsableDS(t *testing.T) {
+	sha1DS := &dns.DS{KeyTag: 1, Algorithm: dns.RSASHA256, DigestType: dns.SHA1}
+	sha256DS := &dns.DS{KeyTag: 1, Algorithm: dns.RSASHA256, DigestType: dns.SHA256}
+	gostDS := &dns.DS{KeyTag: 2, Algorithm: dns.RSASHA256, DigestType: dns.GOST94}
+	md5DS := &dns.DS{KeyTag: 3, Algorithm: dns.RSAMD5, DigestType: dns.SHA256}
+
+	var ap *AlgorithmPolicy
+	usable := ap.usableDS([]dns.RR{sha1DS})
+	if len(usable) != 1 {
+		t.Fatalf("usableDS removed SHA-1 DS record without stronger digests present: %v", usable)
+	}
+	// RFC 4509 downgrade protection
+	usable = ap.usableDS([]dns.RR{sha1DS, sha256DS})
+	if len(usable) != 1 || usable[0] != sha256DS {
+		t.Fatalf("usableDS didn't ignore SHA-1 DS record when SHA-256 DS record was present: %v", usable)
+	}
+	usable = ap.usableDS([]dns.RR{gostDS, md5DS})
+	if len(usable) != 0 {
+		t.Fatalf("usableDS returned DS records with unsupported algorithm or digest: %v", usable)
+	}
+
+	ap = &AlgorithmPolicy{DisabledDigests: map[uint8]bool{dns.SHA1: true}}
+	usable = ap.usableDS([]dns.RR{sha1DS})
+	if len(usable) != 0 {
+		t.Fatalf("usableDS returned DS record with disabled digest: %v", usable)
+	}
+}
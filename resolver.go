@@ -13,8 +13,10 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/jmhodges/clock"
 	"github.com/miekg/dns"
 )
 
@@ -45,29 +47,52 @@ var (
 	ErrNoNSAuthorties     = errors.New("solvere: No NS authority records found")
 	ErrNoAuthorityAddress = errors.New("solvere: No A/AAAA records found for the chosen authority")
 	ErrOutOfBailiwick     = errors.New("Out of bailiwick record in message")
+	ErrUnsignedDelegation = errors.New("solvere: Unsigned delegation in signed zone without proof DS records don't exist")
 )
 
-// Question represents a DNS IN question
+// Question represents a DNS question. If Class isn't set the question is in
+// the IN class. If CheckingDisabled is set the answer isn't validated, like a
+// query with the CD bit set (RFC 4035 Section 3.2.2).
 type Question struct {
-	Name string
-	Type uint16
+	Name             string
+	Type             uint16
+	Class            uint16 `json:",omitempty"`
+	CheckingDisabled bool   `json:",omitempty"`
+}
+
+// class returns the class of the question
+func (q *Question) class() uint16 {
+	if q.Class == 0 {
+		return dns.ClassINET
+	}
+	return q.Class
 }
 
 // LookupLog describes how a resolution was performed
 type LookupLog struct {
-	Query       *Question
-	Rcode       int
-	CacheHit    bool `json:",omitempty"`
-	DNSSECValid bool
-	Latency     time.Duration
-	Error       string `json:",omitempty"`
-	Truncated   bool   `json:",omitempty"`
-	Referral    bool   `json:",omitempty"`
-	Started     time.Time
+	Query          *Question
+	Rcode          int
+	CacheHit       bool `json:",omitempty"`
+	Security       SecurityStatus
+	SecurityReason string `json:",omitempty"`
+	SecurityZone   string `json:",omitempty"`
+	Latency        time.Duration
+	Error          string         `json:",omitempty"`
+	EDE            *ExtendedError `json:",omitempty"`
+	Truncated      bool           `json:",omitempty"`
+	// DNSSECAlgorithm and DSDigestType describe the key that authenticated
+	// the DNSKEY RRset of a zone and the DS record it matched
+	DNSSECAlgorithm string `json:",omitempty"`
+	DSDigestType    string `json:",omitempty"`
+	Referral        bool   `json:",omitempty"`
+	Started         time.Time
 
 	NS *Nameserver `json:",omitempty"`
 
 	Composites []*LookupLog `json:",omitempty"`
+
+	// records contains the DNSSEC records used to validate the response
+	records []dns.RR
 }
 
 func newLookupLog(q *Question, ns *Nameserver) *LookupLog {
@@ -78,14 +103,39 @@ func newLookupLog(q *Question, ns *Nameserver) *LookupLog {
 	}
 }
 
+func (ll *LookupLog) setSecurity(state securityState) {
+	ll.Security = state.status
+	ll.SecurityReason = state.reason
+	ll.SecurityZone = state.zone
+}
+
+// failValidation marks both the lookup and the composite log for the response
+// that failed validation as Bogus and returns the validation error
+func failValidation(ll, log *LookupLog, err error, zone string) error {
+	state := securityState{status: Bogus, reason: err.Error(), zone: zone}
+	log.Error = err.Error()
+	log.setSecurity(state)
+	ll.setSecurity(state)
+	return err
+}
+
 // Answer contains the answer to a iterative resolution performed
-// by RecursiveResolver.Lookup
+// by RecursiveResolver.Lookup. Security describes the DNSSEC status of
+// the answer, SecurityReason why a answer isn't Secure, and SecurityZone
+// the zone where the chain of trust ended. If authentication chains are
+// enabled Chain contains the DNSKEY, DS, RRSIG, NSEC and NSEC3 records that
+// were used to validate the answer. EDE describes why the answer is Bogus or
+// Indeterminate if validation was attempted.
 type Answer struct {
-	Answer        []dns.RR
-	Authority     []dns.RR
-	Additional    []dns.RR
-	Rcode         int
-	Authenticated bool
+	Answer         []dns.RR
+	Authority      []dns.RR
+	Additional     []dns.RR
+	Rcode          int
+	Security       SecurityStatus
+	SecurityReason string
+	SecurityZone   string
+	Chain          []dns.RR
+	EDE            *ExtendedError
 }
 
 // Nameserver describes an authoritative nameserver
@@ -103,18 +153,39 @@ type RecursiveResolver struct {
 	c *dns.Client
 
 	cache           QuestionAnswerCache
+	rrsets          *rrsetCache
 	rootNameservers []Nameserver
+	rootAnchor      []dns.RR
+	algorithms      *AlgorithmPolicy
+	clk             clock.Clock
+	clockSkew       time.Duration
+	nsec3Cache      *nsec3HashCache
+	trustAnchors    *TrustAnchorManager
+	extraAnchors    map[string][]dns.RR
+	stubZones       map[string][]Nameserver
+	authChains      bool
+
+	ntaMu sync.RWMutex
+	ntas  map[string]time.Time
 }
 
 // NewRecursiveResolver returns an initialized RecursiveResolver. If cache is nil
-// answers won't be cached.
+// answers won't be cached, otherwise the individual RRsets in responses are
+// also cached so they can be reused by other lookups.
 func NewRecursiveResolver(useIPv6 bool, useDNSSEC bool, rootHints []dns.RR, rootKeys []dns.RR, cache QuestionAnswerCache) *RecursiveResolver {
 	rr := &RecursiveResolver{
-		useIPv6:   useIPv6,
-		useDNSSEC: useDNSSEC,
-		c:         new(dns.Client),
-		cache:     cache,
+		useIPv6:    useIPv6,
+		useDNSSEC:  useDNSSEC,
+		c:          new(dns.Client),
+		cache:      cache,
+		clk:        clock.Default(),
+		nsec3Cache: newNSEC3HashCache(),
 	}
+	if cache != nil {
+		rr.rrsets = newRRsetCache(defaultRRsetCacheSize, rr.clk)
+	}
+	// The DNSKEY RRset for the root zone must be signed by one of these keys
+	rr.rootAnchor = trustAnchorDS(rootKeys)
 	// Initialize root nameservers
 	addrs := extractRRSet(rootHints, "", dns.TypeA)
 	if useIPv6 {
@@ -128,32 +199,92 @@ func NewRecursiveResolver(useIPv6 bool, useDNSSEC bool, rootHints []dns.RR, root
 			rr.rootNameservers = append(rr.rootNameservers, Nameserver{a.Header().Name, r.AAAA.String(), "."})
 		}
 	}
-	// Add root DNSSEC keys to cache indefinitely
-	// XXX: if these keys are expired (how to tell?) should block on fetching
-	//      new ones + verifying the roll-over
-	if rr.cache != nil {
-		rr.cache.Add(&Question{Name: ".", Type: dns.TypeDNSKEY}, &Answer{rootKeys, nil, nil, dns.RcodeSuccess, true}, true)
-	}
 	return rr
 }
 
+// SetAlgorithmPolicy sets the policy used to decide which DNSSEC algorithms
+// and DS digest types are used for validation. It should be called before the
+// resolver is used.
+func (rr *RecursiveResolver) SetAlgorithmPolicy(policy *AlgorithmPolicy) {
+	rr.algorithms = policy
+}
+
+// SetTrustAnchorManager sets a TrustAnchorManager that provides the root trust
+// anchors instead of the static keys passed to NewRecursiveResolver. It should
+// be called before the resolver is used.
+func (rr *RecursiveResolver) SetTrustAnchorManager(tam *TrustAnchorManager) {
+	rr.trustAnchors = tam
+}
+
+// rootAnchors returns the DS records the root DNSKEY RRset must match
+func (rr *RecursiveResolver) rootAnchors() []dns.RR {
+	anchors := rr.rootAnchor
+	if rr.trustAnchors != nil {
+		anchors = trustAnchorDS(rr.trustAnchors.Anchors())
+	}
+	return append(anchors[:len(anchors):len(anchors)], rr.zoneAnchors(".")...)
+}
+
+// SetAuthenticationChains sets whether the records used to validate a answer
+// are returned in Answer.Chain. Chains are also kept in the cache so they are
+// available for cached answers. It should be called before the resolver is
+// used.
+func (rr *RecursiveResolver) SetAuthenticationChains(enabled bool) {
+	rr.authChains = enabled
+}
+
+// SetClockSkew sets how far outside of a signature's validity period the
+// current time may be before the signature is rejected, to tolerate
+// differences between the clocks of the resolver and signers. The default
+// is no tolerance. It should be called before the resolver is used.
+func (rr *RecursiveResolver) SetClockSkew(skew time.Duration) {
+	rr.clockSkew = skew
+}
+
+// SetClock sets the clock used to check signature validity periods, expire
+// negative trust anchors and expire the RRsets the resolver caches, by default
+// the system clock. The question/answer cache uses its own clock. It should be
+// called before the resolver is used.
+func (rr *RecursiveResolver) SetClock(clk clock.Clock) {
+	rr.clk = clk
+	if rr.rrsets != nil {
+		rr.rrsets.clk = clk
+	}
+}
+
+// SetTTLPolicy sets the policy used to clamp the TTLs of the RRsets the
+// resolver caches and of the answers built from them, and of answers added to
+// the question/answer cache if it supports one. It should be called before the
+// resolver is used.
+func (rr *RecursiveResolver) SetTTLPolicy(policy *TTLPolicy) {
+	if rr.rrsets != nil {
+		rr.rrsets.ttls = policy
+	}
+	if c, ok := rr.cache.(interface{ SetTTLPolicy(*TTLPolicy) }); ok {
+		c.SetTTLPolicy(policy)
+	}
+}
+
 func (rr *RecursiveResolver) query(ctx context.Context, q *Question, auth *Nameserver) (*dns.Msg, *LookupLog, error) {
 	ql := newLookupLog(q, auth)
 	s := time.Now()
 	defer func() { ql.Latency = time.Since(s) }()
 	m := new(dns.Msg)
 	m.SetEdns0(4096, rr.useDNSSEC)
-	m.Question = []dns.Question{{Name: q.Name, Qtype: q.Type, Qclass: dns.ClassINET}}
+	m.Question = []dns.Question{{Name: q.Name, Qtype: q.Type, Qclass: q.class()}}
 	if rr.cache != nil {
 		if answer := rr.cache.Get(q); answer != nil {
-			m.Rcode = dns.RcodeSuccess
+			m.Rcode = answer.Rcode
 			m.Answer = answer.Answer
 			m.Ns = answer.Authority
 			m.Extra = answer.Additional
 			ql.CacheHit = true
 			ql.NS = nil
-			ql.DNSSECValid = answer.Authenticated
-			ql.Rcode = dns.RcodeSuccess
+			ql.Security = answer.Security
+			ql.SecurityReason = answer.SecurityReason
+			ql.SecurityZone = answer.SecurityZone
+			ql.Rcode = answer.Rcode
+			ql.records = answer.Chain
 			return m, ql, nil
 		}
 	}
@@ -232,6 +363,12 @@ func (rr *RecursiveResolver) pickAuthority(ctx context.Context, auths []dns.RR,
 		if len(nsToZone) == 0 {
 			return nil, nil, ErrNoNSAuthorties
 		}
+		for ns, z := range nsToZone {
+			// glue from a earlier referral can be reused
+			if addr := rr.cachedAddress(ns); addr != "" {
+				return &Nameserver{ns, addr, z}, nil, nil
+			}
+		}
 		var ns, z string
 		// abuse how ranging over maps works to select a 'random' element
 		for ns, z = range nsToZone {
@@ -253,13 +390,57 @@ func (rr *RecursiveResolver) pickAuthority(ctx context.Context, auths []dns.RR,
 	return nil, nil, ErrNoNSAuthorties
 }
 
-func extractAnswer(m *dns.Msg, authenticated bool) *Answer {
+// insecureDenial turns the error from checking a denial of existence proof
+// that uses too many NSEC3 iterations to check into a Insecure state, any
+// other error is returned as is
+func insecureDenial(state securityState, err error, zone string) (securityState, error) {
+	if err != errInsecureNSEC3Iterations {
+		return state, err
+	}
+	return securityState{
+		status: Insecure,
+		reason: fmt.Sprintf("NSEC3 records from %s use too many iterations to check", zone),
+		zone:   zone,
+	}, nil
+}
+
+// withChain sets the authentication chain of a if chains are enabled
+func (rr *RecursiveResolver) withChain(a *Answer, chain []dns.RR) *Answer {
+	if rr.authChains {
+		a.Chain = uniqueRecords(chain)
+	}
+	return a
+}
+
+// cacheNegative caches a NXDOMAIN or NODATA response to q along with the
+// denial of existence records in its authority section. Like RFC 2308 Section
+// 5 the answer is cached for the lower of the TTL and minimum fields of the
+// SOA record, if there isn't one it isn't cached.
+func (rr *RecursiveResolver) cacheNegative(q *Question, r *dns.Msg, state securityState, authChain []dns.RR) {
+	if rr.cache == nil || len(extractRRSet(r.Ns, "", dns.TypeSOA)) == 0 {
+		return
+	}
+	authority := make([]dns.RR, len(r.Ns))
+	for i, record := range r.Ns {
+		if soa, ok := record.(*dns.SOA); ok && soa.Minttl < soa.Hdr.Ttl {
+			record = dns.Copy(soa)
+			record.Header().Ttl = soa.Minttl
+		}
+		authority[i] = record
+	}
+	answer := extractAnswer(&dns.Msg{MsgHdr: dns.MsgHdr{Rcode: r.Rcode}, Ns: authority}, state)
+	rr.cache.Add(q, rr.withChain(answer, authChain), false)
+}
+
+func extractAnswer(m *dns.Msg, state securityState) *Answer {
 	return &Answer{
-		Answer:        m.Answer,
-		Authority:     m.Ns,
-		Additional:    m.Extra,
-		Rcode:         m.Rcode,
-		Authenticated: authenticated,
+		Answer:         m.Answer,
+		Authority:      m.Ns,
+		Additional:     m.Extra,
+		Rcode:          m.Rcode,
+		Security:       state.status,
+		SecurityReason: state.reason,
+		SecurityZone:   state.zone,
 	}
 }
 
@@ -339,11 +520,22 @@ func isAlias(answer []dns.RR, q Question) (bool, string, []dns.RR, error) {
 // Lookup a Question iteratively. All upstream responses are validated
 // and a DNSSEC chain is built if the RecursiveResolver was initialized to do so.
 // If responses are found in the question/answer cache they will be used instead
-// of sending messages to remote nameservers.
+// of sending messages to remote nameservers. If the lookup fails, or the answer
+// couldn't be validated, the returned LookupLog contains a Extended DNS Error
+// describing why, which is also included in the Answer.
 func (rr *RecursiveResolver) Lookup(ctx context.Context, q Question) (*Answer, *LookupLog, error) {
-	ll := newLookupLog(&q, nil)
+	a, ll, err := rr.lookup(ctx, q)
+	if err != nil {
+		ll.EDE = ExtendedErrorFromError(err)
+	} else if rr.useDNSSEC && !q.CheckingDisabled {
+		a.EDE = extendedErrorFromSecurity(a.Security, a.SecurityReason)
+		ll.EDE = a.EDE
+	}
+	return a, ll, err
+}
 
-	authority := &rr.rootNameservers[mrand.Intn(len(rr.rootNameservers))]
+func (rr *RecursiveResolver) lookup(ctx context.Context, q Question) (*Answer, *LookupLog, error) {
+	ll := newLookupLog(&q, nil)
 
 	defer func() {
 		ll.Latency = time.Since(ll.Started)
@@ -351,7 +543,23 @@ func (rr *RecursiveResolver) Lookup(ctx context.Context, q Question) (*Answer, *
 
 	aliases := map[string]struct{}{}
 	var chased []dns.RR
-	var parentDSSet []dns.RR
+	// authChain collects the records used to validate each response
+	var authChain []dns.RR
+	if a := rr.assembleAnswer(&q); a != nil {
+		log := newLookupLog(&q, nil)
+		log.CacheHit = true
+		log.Rcode = a.Rcode
+		log.setSecurity(securityState{a.Security, a.SecurityReason, a.SecurityZone})
+		ll.Composites = append(ll.Composites, log)
+		ll.Rcode = a.Rcode
+		ll.setSecurity(securityState{a.Security, a.SecurityReason, a.SecurityZone})
+		return a, ll, nil
+	}
+
+	// chain tracks the security of the delegation chain currently being followed
+	// and aliasState the combined security of any aliases that have been chased
+	authority, chain, parentDSSet := rr.startLookup(&q)
+	aliasState := securityState{status: Secure}
 	// XXX: This whole loop could be split off into its own function in order
 	//      to pass through the i when we need to do things like lookupNS which
 	//      are prone to infinitely looping
@@ -365,42 +573,74 @@ func (rr *RecursiveResolver) Lookup(ctx context.Context, q Question) (*Answer, *
 			log.Truncated = true
 		}
 
+		// responses from zones above the trust anchor validation starts at
+		// aren't validated until a referral reaches it, other responses come
+		// from a server that also serves the anchored zone so are validated
+		// as if they came from it
+		aboveAnchor := false
+		if chain.status == Secure && !log.CacheHit && !isSubDomain(chain.zone, authority.Zone) {
+			if zone := referralZone(r); zone != "" && isSubDomain(zone, chain.zone) {
+				aboveAnchor = true
+			} else {
+				authority = &Nameserver{Name: authority.Name, Addr: authority.Addr, Zone: chain.zone}
+			}
+		}
+
 		// validate
-		validated := false
+		state := chain
+		v := rr.validator()
 		if log.CacheHit {
-			validated = log.DNSSECValid
-		}
-		if (i == 0 || len(parentDSSet) > 0) && !log.CacheHit {
-			dkLog, err := rr.checkSignatures(ctx, r, authority, parentDSSet)
+			state = securityState{log.Security, log.SecurityReason, log.SecurityZone}
+			authChain = append(authChain, log.records...)
+		} else if aboveAnchor {
+			state = securityState{
+				status: Indeterminate,
+				reason: fmt.Sprintf("%s is above the trust anchor for %s", authority.Zone, chain.zone),
+				zone:   authority.Zone,
+			}
+		} else if chain.status == Secure {
+			dkLog, err := rr.checkSignatures(ctx, v, r, authority, parentDSSet)
 			log.Composites = append(log.Composites, dkLog)
 			if err != nil {
-				log.Error = err.Error()
-				return nil, ll, err
+				return nil, ll, failValidation(ll, log, err, authority.Zone)
 			}
-			validated = true
+			state.zone = authority.Zone
+			authChain = append(authChain, dkLog.records...)
 		}
-		log.DNSSECValid = validated
-		ll.DNSSECValid = validated
+		log.setSecurity(state)
+		ll.setSecurity(aliasState.worse(state))
 
 		if r.Rcode != dns.RcodeSuccess {
-			// XXX: cache name error?
-			if r.Rcode == dns.RcodeNameError {
-				nsecSet := extractRRSet(r.Ns, "", dns.TypeNSEC3)
-				if len(nsecSet) != 0 { // if the zone is signed and this is missing its a failure...
-					err = verifyNameError(&q, nsecSet)
-					if err != nil {
-						log.Error = err.Error()
-						log.DNSSECValid = false
-						ll.DNSSECValid = false
-						return nil, ll, err
-					}
+			if r.Rcode == dns.RcodeNameError && state.status == Secure && !log.CacheHit {
+				// the zone is signed so the denial must be proven
+				state, err = insecureDenial(state, v.verifyNameError(&q, signedDenial(r.Ns)), authority.Zone)
+				if err != nil {
+					return nil, ll, failValidation(ll, log, err, authority.Zone)
 				}
+				log.setSecurity(state)
+				ll.setSecurity(aliasState.worse(state))
+			}
+			if r.Rcode == dns.RcodeNameError && !log.CacheHit {
+				rr.cacheNegative(&q, r, state, authChain)
 			}
-			return extractAnswer(r, validated), ll, nil
+			return rr.withChain(extractAnswer(r, aliasState.worse(state)), authChain), ll, nil
 		}
 
 		// good response
 		if len(r.Answer) > 0 {
+			if state.status == Secure && !log.CacheHit {
+				// answers synthesized from a wildcard need proof that no
+				// closer match exists
+				state, err = insecureDenial(state, v.verifyWildcards(r.Answer, signedDenial(r.Ns)), authority.Zone)
+				if err != nil {
+					return nil, ll, failValidation(ll, log, err, authority.Zone)
+				}
+				log.setSecurity(state)
+				ll.setSecurity(aliasState.worse(state))
+			}
+			if !log.CacheHit {
+				rr.cacheRRsets(&q, r, authority, state)
+			}
 			if ok, canonicalName, chasedRR, err := isAlias(r.Answer, q); ok {
 				if _, ok := aliases[canonicalName]; ok {
 					err = errors.New("Alias loop detected, aborting")
@@ -409,8 +649,11 @@ func (rr *RecursiveResolver) Lookup(ctx context.Context, q Question) (*Answer, *
 				}
 				aliases[canonicalName] = struct{}{}
 
-				authority = &rr.rootNameservers[mrand.Intn(len(rr.rootNameservers))]
+				// the alias target is resolved from the start so the chain
+				// needs to be rebuilt from scratch
+				aliasState = aliasState.worse(state)
 				q.Name = canonicalName
+				authority, chain, parentDSSet = rr.startLookup(&q)
 				chased = append(chased, chasedRR...)
 				// XXX: cache alias answer
 				continue
@@ -419,36 +662,43 @@ func (rr *RecursiveResolver) Lookup(ctx context.Context, q Question) (*Answer, *
 				return nil, ll, err
 			}
 			if !log.CacheHit && rr.cache != nil {
-				go rr.cache.Add(&q, &Answer{r.Answer, r.Ns, r.Extra, r.Rcode, validated}, false)
+				rr.cache.Add(&q, rr.withChain(extractAnswer(r, state), authChain), false)
 			}
 
 			if len(chased) > 0 {
 				// put aliases at the front of the answer
 				r.Answer = append(chased, r.Answer...)
 			}
-			return extractAnswer(r, validated), ll, nil
+			return rr.withChain(extractAnswer(r, aliasState.worse(state)), authChain), ll, nil
 		}
 
-		nsecSet := extractRRSet(r.Ns, "", dns.TypeNSEC3)
+		nsecSet := signedDenial(r.Ns)
 
-		// NODATA response
-		if len(r.Ns) == 0 || len(nsecSet) == len(r.Ns) {
-			if len(nsecSet) != 0 {
+		// NODATA response, anything without NS records in the authority section
+		// can't be a referral
+		if len(extractRRSet(r.Ns, "", dns.TypeNS)) == 0 {
+			if state.status == Secure && !log.CacheHit {
 				// check for proper coverage
-				err = verifyNODATA(&q, nsecSet)
+				state, err = insecureDenial(state, v.verifyNODATA(&q, nsecSet), authority.Zone)
 				if err != nil {
-					log.Error = err.Error()
-					log.DNSSECValid = false
-					ll.DNSSECValid = false
-					return nil, ll, err
+					return nil, ll, failValidation(ll, log, err, authority.Zone)
 				}
+				log.setSecurity(state)
+				ll.setSecurity(aliasState.worse(state))
+			}
+			if !log.CacheHit {
+				rr.cacheNegative(&q, r, state, authChain)
 			}
 			// ignore anything in additional section (?)
-			return &Answer{Rcode: dns.RcodeSuccess, Authenticated: validated}, ll, nil
+			return rr.withChain(extractAnswer(&dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeSuccess}}, aliasState.worse(state)), authChain), ll, nil
 		}
 
 		// Referral response
 		log.Referral = true
+		if !log.CacheHit {
+			rr.cacheReferral(r, authority)
+		}
+		parent := authority
 		var authLog *LookupLog
 		authority, authLog, err = rr.pickAuthority(ctx, r.Ns, r.Extra)
 		if authLog != nil {
@@ -458,28 +708,62 @@ func (rr *RecursiveResolver) Lookup(ctx context.Context, q Question) (*Answer, *
 			log.Error = err.Error()
 			return nil, ll, err
 		}
-		if len(nsecSet) != 0 {
-			err = verifyDelegation(authority.Zone, nsecSet)
-			if err != nil {
-				log.Error = err.Error()
-				log.DNSSECValid = false
-				ll.DNSSECValid = false
-				return nil, ll, err
+		if aboveAnchor {
+			// the trust anchor is used instead of whatever the parent says
+			// about the anchored zone
+			continue
+		}
+		if chain.status != Secure {
+			// once the chain is broken everything below it is insecure
+			continue
+		}
+		dsSet, dsLog, err := rr.delegationDS(ctx, v, authority.Zone, r, parent, parentDSSet)
+		if dsLog != nil {
+			log.Composites = append(log.Composites, dsLog)
+			authChain = append(authChain, dsLog.records...)
+		}
+		if err == errInsecureNSEC3Iterations {
+			chain = securityState{
+				status: Insecure,
+				reason: fmt.Sprintf("NSEC3 records for the delegation from %s to %s use too many iterations to check", parent.Zone, authority.Zone),
+				zone:   authority.Zone,
 			}
-		} else if len(parentDSSet) > 0 {
-			err := errors.New("unsigned delegation in signed zone without NSEC records")
-			log.Error = err.Error()
-			return nil, ll, err
+			continue
+		} else if err != nil {
+			return nil, ll, failValidation(ll, log, err, parent.Zone)
 		}
-		if i == 0 || len(parentDSSet) > 0 {
-			parentDSSet = extractRRSet(r.Ns, authority.Zone, dns.TypeDS)
-		} else if i > 0 { // XXX: is this right?
-			parentDSSet = nil
+		parentDSSet = rr.algorithms.usableDS(dsSet)
+		if len(dsSet) == 0 {
+			chain = securityState{
+				status: Insecure,
+				reason: fmt.Sprintf("delegation from %s to %s is provably unsigned", parent.Zone, authority.Zone),
+				zone:   authority.Zone,
+			}
+		} else if len(parentDSSet) == 0 {
+			// RFC 4035 Section 5.2, a zone only signed with algorithms we
+			// can't validate is treated the same as a unsigned zone
+			chain = securityState{
+				status: Insecure,
+				reason: fmt.Sprintf("DS records for %s only use unsupported or disabled algorithms or digest types", authority.Zone),
+				zone:   authority.Zone,
+			}
 		}
 	}
 	return nil, ll, ErrTooManyReferrals
 }
 
+// referralZone returns the zone a referral in r delegates to, or a empty
+// string if r isn't a referral
+func referralZone(r *dns.Msg) string {
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) > 0 {
+		return ""
+	}
+	if ns := extractRRSet(r.Ns, "", dns.TypeNS); len(ns) > 0 {
+		return ns[0].Header().Name
+	}
+	return ""
+}
+
 func filterRRSet(in []dns.RR, rrTypes ...uint16) []dns.RR {
 	tMap := make(map[uint16]struct{}, len(rrTypes))
 	for _, rrType := range rrTypes {
@@ -1,9 +1,12 @@
 package solvere
 
 import (
+	"net"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/jmhodges/clock"
 	"github.com/miekg/dns"
 )
 
@@ -217,3 +220,30 @@ func TestIsAlias(t *testing.T) {
 		}
 	}
 }
+
+func TestSetClock(t *testing.T) {
+	fc := clock.NewFake()
+	rr := NewRecursiveResolver(false, true, nil, nil, NewBasicCacheWithOptions(CacheOptions{Clock: fc, PruneInterval: -1}))
+	rr.SetClock(fc)
+	if !rr.now().Equal(fc.Now()) {
+		t.Fatalf("Resolver time is %s, expected %s", rr.now(), fc.Now())
+	}
+
+	// cached RRsets and negative trust anchors expire using the clock
+	rr.rrsets.add([]dns.RR{testA("www.example.com.", 60, net.IP{192, 0, 2, 1})}, nil, trustAuthAnswer, securityState{status: Insecure})
+	err := rr.AddNegativeTrustAnchor("example.com.", fc.Now().Add(time.Minute*10))
+	if err != nil {
+		t.Fatalf("AddNegativeTrustAnchor failed: %s", err)
+	}
+	fc.Add(time.Minute * 5)
+	if rr.rrsets.get("www.example.com.", dns.TypeA, dns.ClassINET) != nil {
+		t.Fatal("Cached RRset didn't expire using the resolver's clock")
+	}
+	if rr.negativeTrustAnchor("www.example.com.") == nil {
+		t.Fatal("Negative trust anchor expired early")
+	}
+	fc.Add(time.Minute * 5)
+	if rr.negativeTrustAnchor("www.example.com.") != nil {
+		t.Fatal("Negative trust anchor didn't expire using the resolver's clock")
+	}
+}
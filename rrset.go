@@ -0,0 +1,365 @@
+package solvere
+
+import (
+	"container/list"
+	mrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
+)
+
+// trustLevel ranks how credible cached data is, based on where in which kind of
+// response it was found (RFC 2181 Section 5.4.1). Data is never replaced by
+// data with a lower trust level until it expires.
+type trustLevel int
+
+const (
+	// trustGlue is data from the authority and additional sections of a
+	// referral
+	trustGlue trustLevel = iota
+	// trustAdditional is data from the additional section of a authoritative
+	// answer or the authority section of a non-authoritative one
+	trustAdditional
+	// trustNonAuthAnswer is data from the answer section of a response without
+	// the AA bit set
+	trustNonAuthAnswer
+	// trustAuthAuthority is data from the authority section of a authoritative
+	// answer
+	trustAuthAuthority
+	// trustAuthAnswer is data from the answer section of a authoritative answer
+	trustAuthAnswer
+	// trustValidated is data from the answer section of a authoritative answer
+	// that was validated
+	trustValidated
+)
+
+// defaultRRsetCacheSize is the number of RRsets kept in the RRset cache
+var defaultRRsetCacheSize = 100000
+
+type rrsetCacheKey struct {
+	name   string
+	rrtype uint16
+	class  uint16
+}
+
+func newRRsetCacheKey(name string, rrtype, class uint16) rrsetCacheKey {
+	return rrsetCacheKey{strings.ToLower(dns.Fqdn(name)), rrtype, class}
+}
+
+// cachedRRset is a RRset along with the signatures that cover it
+type cachedRRset struct {
+	key      rrsetCacheKey
+	rrs      []dns.RR
+	sigs     []dns.RR
+	trust    trustLevel
+	security securityState
+	added    time.Time
+	expires  time.Time
+	elem     *list.Element
+}
+
+// rrsetCache caches individual RRsets from responses so they can be reused by
+// other lookups, e.g. glue from one referral when a later referral doesn't
+// include any, or a answer assembled from RRsets learnt while resolving other
+// questions. It holds at most size RRsets, evicting the least recently used.
+type rrsetCache struct {
+	mu   sync.Mutex
+	sets map[rrsetCacheKey]*cachedRRset
+	lru  *list.List
+	size int
+	clk  clock.Clock
+	ttls *TTLPolicy
+}
+
+func newRRsetCache(size int, clk clock.Clock) *rrsetCache {
+	return &rrsetCache{
+		sets: make(map[rrsetCacheKey]*cachedRRset),
+		lru:  list.New(),
+		size: size,
+		clk:  clk,
+	}
+}
+
+func (c *rrsetCache) remove(set *cachedRRset) {
+	delete(c.sets, set.key)
+	c.lru.Remove(set.elem)
+}
+
+// flush removes the RRsets owned by name or, if subtree is true, by name or
+// any name below it
+func (c *rrsetCache) flush(name string, subtree bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, set := range c.sets {
+		if matchesName(name, key.name, subtree) {
+			c.remove(set)
+		}
+	}
+}
+
+// add caches a RRset and the signatures covering it unless a RRset with a
+// higher trust level is already cached, returning true if it was cached
+func (c *rrsetCache) add(rrs []dns.RR, sigs []dns.RR, trust trustLevel, security securityState) bool {
+	if len(rrs) == 0 {
+		return false
+	}
+	hdr := rrs[0].Header()
+	if clamped, ok := c.ttls.clamp(&Question{Name: hdr.Name, Type: hdr.Rrtype}, &Answer{Answer: append(append([]dns.RR{}, rrs...), sigs...)}); ok {
+		rrs, sigs = clamped.Answer[:len(rrs)], clamped.Answer[len(rrs):]
+	}
+	ttl := minTTL(append(append([]dns.RR{}, rrs...), sigs...), c.clk)
+	if ttl == 0 {
+		return false
+	}
+	now := c.clk.Now()
+	set := &cachedRRset{
+		key:      newRRsetCacheKey(hdr.Name, hdr.Rrtype, hdr.Class),
+		rrs:      rrs,
+		sigs:     sigs,
+		trust:    trust,
+		security: security,
+		added:    now,
+		expires:  now.Add(time.Second * time.Duration(ttl)),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, present := c.sets[set.key]; present {
+		if old.trust > trust && now.Before(old.expires) {
+			return false
+		}
+		c.remove(old)
+	}
+	c.sets[set.key] = set
+	set.elem = c.lru.PushFront(set)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back().Value.(*cachedRRset))
+	}
+	return true
+}
+
+// get returns a copy of a cached RRset with TTLs reduced by the time it has
+// been cached, or nil if there isn't one
+func (c *rrsetCache) get(name string, rrtype, class uint16) *cachedRRset {
+	now := c.clk.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	set, present := c.sets[newRRsetCacheKey(name, rrtype, class)]
+	if !present {
+		return nil
+	}
+	if !now.Before(set.expires) || (set.security.status == Secure && signaturesExpired(&Answer{Answer: set.sigs}, now)) {
+		c.remove(set)
+		return nil
+	}
+	c.lru.MoveToFront(set.elem)
+	elapsed := uint32(now.Sub(set.added) / time.Second)
+	aged := *set
+	aged.rrs = agedRecords(set.rrs, elapsed)
+	aged.sigs = agedRecords(set.sigs, elapsed)
+	aged.elem = nil
+	return &aged
+}
+
+// splitRRsets groups the records in a section into RRsets along with the
+// signatures that cover each of them
+func splitRRsets(section []dns.RR) ([][]dns.RR, map[rrsetCacheKey][]dns.RR) {
+	sets := [][]dns.RR{}
+	index := map[rrsetCacheKey]int{}
+	sigs := map[rrsetCacheKey][]dns.RR{}
+	for _, r := range section {
+		hdr := r.Header()
+		if sig, ok := r.(*dns.RRSIG); ok {
+			key := newRRsetCacheKey(hdr.Name, sig.TypeCovered, hdr.Class)
+			sigs[key] = append(sigs[key], r)
+			continue
+		}
+		key := newRRsetCacheKey(hdr.Name, hdr.Rrtype, hdr.Class)
+		if i, present := index[key]; present {
+			sets[i] = append(sets[i], r)
+			continue
+		}
+		index[key] = len(sets)
+		sets = append(sets, []dns.RR{r})
+	}
+	return sets, sigs
+}
+
+// addSection caches the RRsets of the given types in a section, or all of them
+// if no types are given, ignoring any not at or below zone
+func (c *rrsetCache) addSection(section []dns.RR, zone string, trust trustLevel, security securityState, types ...uint16) {
+	sets, sigs := splitRRsets(section)
+	for _, set := range sets {
+		hdr := set[0].Header()
+		if hdr.Rrtype == dns.TypeOPT || !isSubDomain(zone, hdr.Name) {
+			continue
+		}
+		if len(types) > 0 && len(extractRRSet(set[:1], "", types...)) == 0 {
+			continue
+		}
+		c.add(set, sigs[newRRsetCacheKey(hdr.Name, hdr.Rrtype, hdr.Class)], trust, security)
+	}
+}
+
+// unvalidated is the state RRsets that weren't validated are cached with
+var unvalidated = securityState{status: Indeterminate, reason: "cached data wasn't validated"}
+
+// answerChain returns the keys of the RRsets in a answer section that answer q,
+// the ones at q.Name and at the targets of any CNAMEs followed from it
+func answerChain(q *Question, answer []dns.RR) map[rrsetCacheKey]bool {
+	chain := map[rrsetCacheKey]bool{}
+	name := q.Name
+	for i := 0; i <= maxChainAliases; i++ {
+		chain[newRRsetCacheKey(name, q.Type, q.class())] = true
+		chain[newRRsetCacheKey(name, dns.TypeCNAME, q.class())] = true
+		next := ""
+		for _, r := range answer {
+			if cname, ok := r.(*dns.CNAME); ok && strings.EqualFold(dns.Fqdn(cname.Hdr.Name), dns.Fqdn(name)) {
+				next = cname.Target
+				break
+			}
+		}
+		if next == "" || chain[newRRsetCacheKey(next, dns.TypeCNAME, q.class())] {
+			break
+		}
+		name = next
+	}
+	return chain
+}
+
+// cacheRRsets caches the RRsets from a answer sent by auth to q. Only the
+// RRsets in the answer section that answer q are trusted as answers (RFC 2181
+// Section 5.4.1) and of those only the ones with a verified signature from the
+// zone are cached as Secure, anything else in the response is ranked as
+// additional data and isn't considered validated.
+func (rr *RecursiveResolver) cacheRRsets(q *Question, r *dns.Msg, auth *Nameserver, state securityState) {
+	if rr.rrsets == nil {
+		return
+	}
+	trust, extra := trustNonAuthAnswer, trustAdditional
+	if r.Authoritative {
+		trust, extra = trustAuthAnswer, trustAuthAuthority
+	}
+	if state.status == Secure || state.status == Insecure {
+		// a answer that wasn't validated because checking was disabled or a
+		// negative trust anchor could claim to be Insecure when it isn't
+		if q.CheckingDisabled || rr.negativeTrustAnchor(q.Name) != nil {
+			state = unvalidated
+		}
+	}
+	// when the response is Secure every RRSIG in it has been verified using
+	// the keys of the zone, but RRsets without one are let through
+	signed := map[rrsetCacheKey]bool{}
+	if state.status == Secure {
+		for _, r := range extractRRSet(r.Answer, "", dns.TypeRRSIG) {
+			if sig := r.(*dns.RRSIG); strings.EqualFold(dns.Fqdn(sig.SignerName), dns.Fqdn(auth.Zone)) {
+				signed[newRRsetCacheKey(sig.Hdr.Name, sig.TypeCovered, sig.Hdr.Class)] = true
+			}
+		}
+	}
+	chain := answerChain(q, r.Answer)
+	sets, sigs := splitRRsets(r.Answer)
+	for _, set := range sets {
+		hdr := set[0].Header()
+		key := newRRsetCacheKey(hdr.Name, hdr.Rrtype, hdr.Class)
+		if hdr.Rrtype == dns.TypeOPT || !isSubDomain(auth.Zone, hdr.Name) {
+			continue
+		}
+		switch {
+		case !chain[key]:
+			rr.rrsets.add(set, sigs[key], trustAdditional, unvalidated)
+		case state.status != Secure:
+			rr.rrsets.add(set, sigs[key], trust, state)
+		case signed[key] && r.Authoritative:
+			rr.rrsets.add(set, sigs[key], trustValidated, state)
+		case signed[key]:
+			rr.rrsets.add(set, sigs[key], trust, state)
+		default:
+			rr.rrsets.add(set, sigs[key], trustAdditional, unvalidated)
+		}
+	}
+	rr.rrsets.addSection(r.Ns, auth.Zone, extra, unvalidated, dns.TypeNS)
+	rr.rrsets.addSection(r.Extra, auth.Zone, trustAdditional, unvalidated, dns.TypeA, dns.TypeAAAA)
+}
+
+// cacheReferral caches the NS records and glue in a referral from auth
+func (rr *RecursiveResolver) cacheReferral(r *dns.Msg, auth *Nameserver) {
+	if rr.rrsets == nil {
+		return
+	}
+	rr.rrsets.addSection(r.Ns, auth.Zone, trustGlue, unvalidated, dns.TypeNS)
+	rr.rrsets.addSection(r.Extra, auth.Zone, trustGlue, unvalidated, dns.TypeA, dns.TypeAAAA)
+}
+
+// cachedAddress returns a cached address for the nameserver name, including
+// glue learnt from earlier referrals
+func (rr *RecursiveResolver) cachedAddress(name string) string {
+	if rr.rrsets == nil {
+		return ""
+	}
+	types := []uint16{dns.TypeA}
+	if rr.useIPv6 {
+		types = append(types, dns.TypeAAAA)
+	}
+	for _, t := range types {
+		set := rr.rrsets.get(name, t, dns.ClassINET)
+		if set == nil {
+			continue
+		}
+		switch a := set.rrs[mrand.Intn(len(set.rrs))].(type) {
+		case *dns.A:
+			return a.A.String()
+		case *dns.AAAA:
+			return a.AAAA.String()
+		}
+	}
+	return ""
+}
+
+// assembleAnswer builds the answer to q from cached RRsets that came from the
+// answer section of authoritative answers, following any CNAMEs. If validation
+// is enabled for q every RRset must have been validated or be Insecure. It
+// returns nil if any RRset needed isn't cached.
+func (rr *RecursiveResolver) assembleAnswer(q *Question) *Answer {
+	if rr.rrsets == nil || rr.authChains {
+		// cached RRsets don't keep the chain used to validate them
+		return nil
+	}
+	initial, _ := rr.initialSecurity(q)
+	validating := initial.status == Secure
+	state := securityState{status: Secure}
+	answer := []dns.RR{}
+	name := q.Name
+	for i := 0; i < maxChainAliases; i++ {
+		set := rr.rrsets.get(name, q.Type, q.class())
+		if set == nil && q.Type != dns.TypeCNAME {
+			set = rr.rrsets.get(name, dns.TypeCNAME, q.class())
+		}
+		if set == nil || set.trust < trustAuthAnswer {
+			return nil
+		}
+		if validating && set.security.status != Secure && set.security.status != Insecure {
+			return nil
+		}
+		state = state.worse(set.security)
+		answer = append(append(answer, set.rrs...), set.sigs...)
+		cname, ok := set.rrs[0].(*dns.CNAME)
+		if !ok || q.Type == dns.TypeCNAME {
+			if !validating {
+				state = initial
+			}
+			return rr.rrsets.ttls.lower(q, &Answer{
+				Answer:         answer,
+				Rcode:          dns.RcodeSuccess,
+				Security:       state.status,
+				SecurityReason: state.reason,
+				SecurityZone:   state.zone,
+			})
+		}
+		name = cname.Target
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package solvere
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"github.com/miekg/dns"
+)
+
+func testA(name string, ttl uint32, addr net.IP) *dns.A {
+	return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: addr}
+}
+
+func TestRRsetCache(t *testing.T) {
+	fc := clock.NewFake()
+	c := newRRsetCache(2, fc)
+
+	auth := []dns.RR{testA("www.example.com.", 60, net.IP{192, 0, 2, 1})}
+	if !c.add(auth, nil, trustAuthAnswer, unvalidated) {
+		t.Fatal("add didn't cache RRset")
+	}
+	glue := []dns.RR{testA("WWW.example.com.", 300, net.IP{192, 0, 2, 2})}
+	if c.add(glue, nil, trustGlue, unvalidated) {
+		t.Fatal("add replaced RRset with one with a lower trust level")
+	}
+	fc.Add(time.Second * 10)
+	set := c.get("www.example.com", dns.TypeA, dns.ClassINET)
+	if set == nil || set.trust != trustAuthAnswer {
+		t.Fatalf("get returned wrong RRset: %#v", set)
+	}
+	if ttl := set.rrs[0].Header().Ttl; ttl != 50 {
+		t.Fatalf("get returned RRset with TTL %d, expected 50", ttl)
+	}
+	if auth[0].Header().Ttl != 60 {
+		t.Fatal("get modified the cached RRset")
+	}
+
+	// once the RRset expires it can be replaced by anything
+	fc.Add(time.Minute)
+	if !c.add(glue, nil, trustGlue, unvalidated) {
+		t.Fatal("add didn't replace expired RRset")
+	}
+	validated := []dns.RR{testA("www.example.com.", 60, net.IP{192, 0, 2, 3})}
+	if !c.add(validated, nil, trustValidated, securityState{status: Secure}) {
+		t.Fatal("add didn't replace RRset with one with a higher trust level")
+	}
+
+	c.add([]dns.RR{testA("a.example.com.", 60, net.IP{192, 0, 2, 4})}, nil, trustGlue, unvalidated)
+	c.add([]dns.RR{testA("b.example.com.", 60, net.IP{192, 0, 2, 5})}, nil, trustGlue, unvalidated)
+	if c.get("www.example.com.", dns.TypeA, dns.ClassINET) != nil {
+		t.Fatal("add didn't evict least recently used RRset")
+	}
+	if c.get("a.example.com.", dns.TypeA, dns.ClassINET) == nil || c.get("b.example.com.", dns.TypeA, dns.ClassINET) == nil {
+		t.Fatal("add evicted wrong RRset")
+	}
+}
+
+func TestRRsetCacheAddSection(t *testing.T) {
+	c := newRRsetCache(10, clock.NewFake())
+	section := []dns.RR{
+		testA("ns1.example.com.", 60, net.IP{192, 0, 2, 1}),
+		&dns.RRSIG{Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 60}, TypeCovered: dns.TypeA, Expiration: uint32(time.Now().Add(time.Hour).Unix())},
+		testA("ns1.example.com.", 60, net.IP{192, 0, 2, 2}),
+		&dns.TXT{Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: []string{"a"}},
+		testA("ns1.example.org.", 60, net.IP{192, 0, 2, 3}),
+	}
+	sets, sigs := splitRRsets(section)
+	if len(sets) != 3 || len(sets[0]) != 2 || len(sigs[newRRsetCacheKey("ns1.example.com.", dns.TypeA, dns.ClassINET)]) != 1 {
+		t.Fatalf("splitRRsets returned wrong RRsets: %v %v", sets, sigs)
+	}
+
+	c.addSection(section, "example.com.", trustGlue, unvalidated, dns.TypeA)
+	set := c.get("ns1.example.com.", dns.TypeA, dns.ClassINET)
+	if set == nil || len(set.rrs) != 2 || len(set.sigs) != 1 {
+		t.Fatalf("addSection didn't cache RRset with its signatures: %#v", set)
+	}
+	if c.get("ns1.example.com.", dns.TypeTXT, dns.ClassINET) != nil {
+		t.Fatal("addSection cached RRset of a type that wasn't asked for")
+	}
+	if c.get("ns1.example.org.", dns.TypeA, dns.ClassINET) != nil {
+		t.Fatal("addSection cached RRset outside of the zone")
+	}
+}
+
+func TestAssembleAnswer(t *testing.T) {
+	fc := clock.NewFake()
+	rr := NewRecursiveResolver(false, false, nil, nil, newShardedCache(1, fc))
+	rr.rrsets = newRRsetCache(10, fc)
+
+	alias := []dns.RR{&dns.CNAME{Hdr: dns.RR_Header{Name: "alias.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: "www.example.org."}}
+	rr.rrsets.add(alias, nil, trustAuthAnswer, unvalidated)
+	q := &Question{Name: "Alias.example.com.", Type: dns.TypeA}
+	if rr.assembleAnswer(q) != nil {
+		t.Fatal("assembleAnswer returned answer without the target of the CNAME")
+	}
+	rr.rrsets.add([]dns.RR{testA("www.example.org.", 60, net.IP{192, 0, 2, 1})}, nil, trustAdditional, unvalidated)
+	if rr.assembleAnswer(q) != nil {
+		t.Fatal("assembleAnswer used additional data")
+	}
+	rr.rrsets.add([]dns.RR{testA("www.example.org.", 60, net.IP{192, 0, 2, 1})}, nil, trustNonAuthAnswer, unvalidated)
+	if rr.assembleAnswer(q) != nil {
+		t.Fatal("assembleAnswer used non-authoritative data")
+	}
+	rr.rrsets.add([]dns.RR{testA("www.example.org.", 60, net.IP{192, 0, 2, 1})}, nil, trustAuthAnswer, unvalidated)
+	a := rr.assembleAnswer(q)
+	if a == nil || len(a.Answer) != 2 || a.Rcode != dns.RcodeSuccess || a.Security != Indeterminate {
+		t.Fatalf("assembleAnswer returned wrong answer: %#v", a)
+	}
+	if a := rr.assembleAnswer(&Question{Name: "alias.example.com.", Type: dns.TypeCNAME}); a == nil || len(a.Answer) != 1 {
+		t.Fatalf("assembleAnswer returned wrong answer for CNAME question: %#v", a)
+	}
+
+	// when validating only RRsets that were validated, or are provably
+	// insecure, can be used
+	rr.useDNSSEC = true
+	rr.rootAnchor = []dns.RR{&dns.DS{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET}, Algorithm: dns.RSASHA256, DigestType: dns.SHA256}}
+	if rr.assembleAnswer(q) != nil {
+		t.Fatal("assembleAnswer used unvalidated RRsets when validating")
+	}
+	if a := rr.assembleAnswer(&Question{Name: q.Name, Type: q.Type, CheckingDisabled: true}); a == nil || a.Security != Indeterminate {
+		t.Fatalf("assembleAnswer didn't use unvalidated RRsets with checking disabled: %#v", a)
+	}
+	rr.rrsets.add(alias, nil, trustValidated, securityState{status: Secure, zone: "example.com."})
+	rr.rrsets.add([]dns.RR{testA("www.example.org.", 60, net.IP{192, 0, 2, 1})}, nil, trustAuthAnswer, securityState{status: Insecure, reason: "unsigned", zone: "org."})
+	a = rr.assembleAnswer(q)
+	if a == nil || a.Security != Insecure || a.SecurityZone != "org." {
+		t.Fatalf("assembleAnswer returned wrong answer from validated RRsets: %#v", a)
+	}
+}
+
+func TestPickAuthorityCachedGlue(t *testing.T) {
+	fc := clock.NewFake()
+	rr := NewRecursiveResolver(false, false, nil, nil, newShardedCache(1, fc))
+	rr.rrsets = newRRsetCache(10, fc)
+
+	auth := &Nameserver{"a.root-servers.net.", "192.0.2.53", "."}
+	rr.cacheReferral(&dns.Msg{
+		Ns:    []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns.example.net."}},
+		Extra: []dns.RR{testA("ns.example.net.", 60, net.IP{192, 0, 2, 1})},
+	}, auth)
+
+	// a later referral for a different zone that doesn't include any glue
+	ns, _, err := rr.pickAuthority(context.Background(), []dns.RR{
+		&dns.NS{Hdr: dns.RR_Header{Name: "org.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns.example.net."},
+	}, nil)
+	if err != nil {
+		t.Fatalf("pickAuthority failed: %s", err)
+	}
+	if ns.Addr != "192.0.2.1" || ns.Zone != "org." {
+		t.Fatalf("pickAuthority didn't use cached glue: %#v", ns)
+	}
+}
+
+func TestCacheRRsetsUnsignedInjection(t *testing.T) {
+	fc := clock.NewFake()
+	fc.Set(time.Unix(time.Now().Unix(), 0))
+	rr := NewRecursiveResolver(false, true, nil, nil, newShardedCache(1, fc))
+	rr.rrsets = newRRsetCache(10, fc)
+	rr.rootAnchor = []dns.RR{&dns.DS{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET}, Algorithm: dns.RSASHA256, DigestType: dns.SHA256}}
+
+	sig := func(name string, covered uint16, signer string) *dns.RRSIG {
+		return &dns.RRSIG{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 60}, TypeCovered: covered, SignerName: signer, Expiration: uint32(fc.Now().Add(time.Hour).Unix())}
+	}
+	// a signed answer for www.example.com. carrying extra RRsets that aren't
+	// needed to answer the question, one unsigned and one signed by another
+	// zone
+	r := new(dns.Msg)
+	r.Authoritative = true
+	r.Answer = []dns.RR{
+		testA("www.example.com.", 60, net.IP{192, 0, 2, 1}),
+		sig("www.example.com.", dns.TypeA, "example.com."),
+		testA("injected.example.com.", 60, net.IP{192, 0, 2, 66}),
+		testA("other.example.com.", 60, net.IP{192, 0, 2, 67}),
+		sig("other.example.com.", dns.TypeA, "com."),
+	}
+	secure := securityState{status: Secure, zone: "example.com."}
+	q := &Question{Name: "www.example.com.", Type: dns.TypeA}
+	rr.cacheRRsets(q, r, &Nameserver{"ns.example.com.", "192.0.2.53", "example.com."}, secure)
+
+	set := rr.rrsets.get("www.example.com.", dns.TypeA, dns.ClassINET)
+	if set == nil || set.trust != trustValidated || set.security.status != Secure {
+		t.Fatalf("cacheRRsets didn't cache the answer as validated: %#v", set)
+	}
+	for _, name := range []string{"injected.example.com.", "other.example.com."} {
+		set := rr.rrsets.get(name, dns.TypeA, dns.ClassINET)
+		if set == nil {
+			t.Fatalf("cacheRRsets didn't cache %s as additional data", name)
+		}
+		if set.trust != trustAdditional || set.security.status == Secure {
+			t.Fatalf("cacheRRsets cached RRset that doesn't answer the question as %d (%s)", set.trust, set.security.status)
+		}
+		for _, cd := range []bool{false, true} {
+			if a := rr.assembleAnswer(&Question{Name: name, Type: dns.TypeA, CheckingDisabled: cd}); a != nil {
+				t.Fatalf("assembleAnswer served RRset that doesn't answer the question as %s", a.Security)
+			}
+		}
+	}
+
+	// a RRset on the chain without a signature isn't Secure either
+	r.Answer = []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "alias.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: "target.example.com."},
+		sig("alias.example.com.", dns.TypeCNAME, "example.com."),
+		testA("target.example.com.", 60, net.IP{192, 0, 2, 68}),
+	}
+	rr.cacheRRsets(&Question{Name: "alias.example.com.", Type: dns.TypeA}, r, &Nameserver{"ns.example.com.", "192.0.2.53", "example.com."}, secure)
+	if set := rr.rrsets.get("alias.example.com.", dns.TypeCNAME, dns.ClassINET); set == nil || set.security.status != Secure {
+		t.Fatal("cacheRRsets didn't cache signed CNAME as Secure")
+	}
+	if set := rr.rrsets.get("target.example.com.", dns.TypeA, dns.ClassINET); set == nil || set.security.status == Secure {
+		t.Fatal("cacheRRsets cached unsigned target of CNAME as Secure")
+	}
+	if a := rr.assembleAnswer(&Question{Name: "alias.example.com.", Type: dns.TypeA}); a != nil {
+		t.Fatalf("assembleAnswer served unsigned target of CNAME as %s", a.Security)
+	}
+}
@@ -0,0 +1,253 @@
+package solvere
+
+import (
+	"container/heap"
+	"crypto/sha1"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmhodges/clock"
+)
+
+const (
+	defaultShards = 64
+	// pruneBatch is the maximum number of expired answers removed from a shard
+	// each time its lock is taken
+	pruneBatch = 256
+)
+
+var shardedPruneInterval = time.Second
+
+// shardEntry is never modified once it has been added to a shard, updating a
+// answer replaces the entry, so it can be read without holding any locks
+type shardEntry struct {
+	id      [sha1.Size]byte
+	q       Question
+	answer  *Answer
+	added   time.Time
+	expires time.Time
+	forever bool
+	// index is the position of the entry in the expiry heap
+	index int
+}
+
+// expiryHeap orders entries by when they expire so expired answers can be
+// removed without scanning every entry
+type expiryHeap []*shardEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*shardEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+type cacheShard struct {
+	mu      sync.RWMutex
+	entries map[[sha1.Size]byte]*shardEntry
+	expiry  expiryHeap
+}
+
+// remove deletes e, the caller must hold the write lock
+func (s *cacheShard) remove(e *shardEntry) {
+	delete(s.entries, e.id)
+	if !e.forever {
+		heap.Remove(&s.expiry, e.index)
+	}
+}
+
+// removeEntry deletes e if it hasn't already been replaced or removed,
+// returning true if it was deleted
+func (s *cacheShard) removeEntry(e *shardEntry) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries[e.id] != e {
+		return false
+	}
+	s.remove(e)
+	return true
+}
+
+// prune removes up to pruneBatch answers that expired before now, returning
+// the number removed
+func (s *cacheShard) prune(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < pruneBatch; i++ {
+		if len(s.expiry) == 0 || !now.After(s.expiry[0].expires) {
+			return i
+		}
+		delete(s.entries, heap.Pop(&s.expiry).(*shardEntry).id)
+	}
+	return pruneBatch
+}
+
+// ShardedCache is a implementation of the QuestionAnswerCache interface for
+// resolvers handling a lot of concurrent queries. Answers are split between
+// shards that each have their own lock and Get only takes a read lock. Each
+// shard keeps a heap of when its answers expire so pruning only touches the
+// answers that have expired.
+type ShardedCache struct {
+	counters cacheCounters
+	shards   []*cacheShard
+	mask     uint32
+	clk      clock.Clock
+	ttls     *TTLPolicy
+	pruner   *pruner
+}
+
+// NewShardedCache returns a initialized ShardedCache, the number of shards is
+// rounded up to a power of two and defaults to 64 if it isn't positive
+func NewShardedCache(shards int) *ShardedCache {
+	return NewShardedCacheWithOptions(CacheOptions{Shards: shards})
+}
+
+// NewShardedCacheWithOptions returns a initialized ShardedCache configured by
+// opts. Close should be called once the cache is no longer needed to stop
+// pruning it.
+func NewShardedCacheWithOptions(opts CacheOptions) *ShardedCache {
+	sc := newShardedCache(opts.Shards, opts.clock())
+	sc.ttls = opts.TTLs
+	sc.pruner = startPruner(opts.pruneInterval(shardedPruneInterval), sc.clk, sc.prune)
+	return sc
+}
+
+// Close stops the removal of expired answers in the background, the cache can
+// still be used afterwards
+func (sc *ShardedCache) Close() {
+	sc.pruner.close()
+}
+
+func newShardedCache(shards int, clk clock.Clock) *ShardedCache {
+	if shards <= 0 {
+		shards = defaultShards
+	}
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	sc := &ShardedCache{shards: make([]*cacheShard, n), mask: uint32(n - 1), clk: clk}
+	for i := range sc.shards {
+		sc.shards[i] = &cacheShard{entries: make(map[[sha1.Size]byte]*shardEntry)}
+	}
+	return sc
+}
+
+func (sc *ShardedCache) shard(id [sha1.Size]byte) *cacheShard {
+	return sc.shards[binary.BigEndian.Uint32(id[:4])&sc.mask]
+}
+
+func (sc *ShardedCache) prune() {
+	now := sc.clk.Now()
+	for _, s := range sc.shards {
+		for {
+			pruned := s.prune(now)
+			atomic.AddUint64(&sc.counters.expired, uint64(pruned))
+			if pruned < pruneBatch {
+				break
+			}
+		}
+	}
+}
+
+// SetTTLPolicy sets the policy used to clamp the TTLs of answers added to the
+// cache. It should be called before the cache is used.
+func (sc *ShardedCache) SetTTLPolicy(policy *TTLPolicy) {
+	sc.ttls = policy
+}
+
+// Add adds a response to the cache using a index based on the question, with
+// the TTLs of its records clamped by the cache's TTLPolicy
+func (sc *ShardedCache) Add(q *Question, answer *Answer, forever bool) {
+	e := &shardEntry{id: hashQuestion(q), q: *q, answer: answer, added: sc.clk.Now(), forever: forever}
+	if !forever {
+		var clamped bool
+		e.answer, clamped = sc.ttls.clamp(q, answer)
+		ttl := minTTL(append(e.answer.Answer, append(e.answer.Additional, e.answer.Authority...)...), sc.clk)
+		if ttl == 0 {
+			return
+		}
+		if clamped {
+			atomic.AddUint64(&sc.counters.clamped, 1)
+		}
+		e.expires = e.added.Add(time.Second * time.Duration(ttl))
+	}
+	sc.add(e)
+}
+
+func (sc *ShardedCache) add(e *shardEntry) {
+	s := sc.shard(e.id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, present := s.entries[e.id]; present {
+		if old.forever && !e.forever {
+			// like BasicCache answers kept forever are only replaced by
+			// other answers kept forever
+			return
+		}
+		s.remove(old)
+	}
+	s.entries[e.id] = e
+	if !e.forever {
+		heap.Push(&s.expiry, e)
+	}
+}
+
+// Get returns a copy of the response for a question if it exists in the cache,
+// with TTLs reduced by the time it has been cached. Secure answers are removed
+// once any of their signatures expire, even if the TTL hasn't.
+func (sc *ShardedCache) Get(q *Question) *Answer {
+	id := hashQuestion(q)
+	s := sc.shard(id)
+	s.mu.RLock()
+	e, present := s.entries[id]
+	s.mu.RUnlock()
+	if !present {
+		atomic.AddUint64(&sc.counters.misses, 1)
+		return nil
+	}
+	now := sc.clk.Now()
+	if (!e.forever && now.After(e.expires)) || (e.answer.Security == Secure && signaturesExpired(e.answer, now)) {
+		if s.removeEntry(e) {
+			atomic.AddUint64(&sc.counters.expired, 1)
+		}
+		atomic.AddUint64(&sc.counters.misses, 1)
+		return nil
+	}
+	atomic.AddUint64(&sc.counters.hits, 1)
+	return agedAnswer(e.answer, e.added, now, e.forever)
+}
+
+// Entries returns copies of the unexpired answers in the cache
+func (sc *ShardedCache) Entries() []CacheEntry {
+	return sc.List(".", true)
+}
+
+// Restore adds a answer returned by Entries unless it has expired
+func (sc *ShardedCache) Restore(entry CacheEntry) {
+	if !entry.Forever && !sc.clk.Now().Before(entry.Expires) {
+		return
+	}
+	e := &shardEntry{id: hashQuestion(&entry.Question), q: entry.Question, answer: entry.Answer, added: sc.clk.Now(), forever: entry.Forever}
+	if !e.forever {
+		e.expires = entry.Expires
+	}
+	sc.add(e)
+}
@@ -0,0 +1,120 @@
+package solvere
+
+import (
+	"crypto/sha1"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
+)
+
+func shardedLen(sc *ShardedCache) (int, int) {
+	entries, expiring := 0, 0
+	for _, s := range sc.shards {
+		entries += len(s.entries)
+		expiring += len(s.expiry)
+	}
+	return entries, expiring
+}
+
+func TestShardedCache(t *testing.T) {
+	fc := clock.NewFake()
+	cache := newShardedCache(3, fc)
+	if len(cache.shards) != 4 {
+		t.Fatalf("Cache has %d shards, expected 4", len(cache.shards))
+	}
+
+	q := Question{Name: "testing", Type: dns.TypeA}
+	if ca := cache.Get(&q); ca != nil {
+		t.Fatalf("Empty cache returned non-nil Answer: %#v", ca)
+	}
+
+	a := lruAnswer(5)
+	cache.Add(&q, a, true)
+	if ca := cache.Get(&q); !sameAnswer(ca, a) {
+		t.Fatalf("Cache returned incorrect answer: expected %#v, got %#v", a, ca)
+	}
+	// updating a pinned answer keeps it pinned
+	cache.Add(&q, a, false)
+	fc.Add(time.Second * 30)
+	cache.prune()
+	if cache.Get(&q) == nil {
+		t.Fatal("Cache pruned q/a that should've been kept forever")
+	}
+
+	for i := 0; i < 1000; i++ {
+		cache.Add(lruQuestion(i), lruAnswer(uint32(i%10+1)), false)
+	}
+	if entries, expiring := shardedLen(cache); entries != 1001 || expiring != 1000 {
+		t.Fatalf("Cache contains %d answers with %d expiring, expected 1001 with 1000 expiring", entries, expiring)
+	}
+	fc.Add(time.Second*5 + time.Millisecond)
+	cache.prune()
+	if entries, expiring := shardedLen(cache); entries != 501 || expiring != 500 {
+		t.Fatalf("Cache contains %d answers with %d expiring after pruning, expected 501 with 500 expiring", entries, expiring)
+	}
+	if cache.Get(lruQuestion(4)) != nil || cache.Get(lruQuestion(5)) == nil {
+		t.Fatal("Cache pruned the wrong answers")
+	}
+
+	// updating a answer resets when it expires
+	q = Question{Name: "testing-2", Type: dns.TypeA}
+	cache.Add(&q, lruAnswer(2), false)
+	fc.Add(time.Second)
+	cache.Add(&q, lruAnswer(10), false)
+	fc.Add(time.Second * 5)
+	cache.prune()
+	if cache.Get(&q) == nil {
+		t.Fatal("Cache pruned updated answer using its old TTL")
+	}
+	fc.Add(time.Second * 10)
+	if cache.Get(&q) != nil {
+		t.Fatal("Cache returned expired answer")
+	}
+
+	cache.Add(&q, lruAnswer(0), false)
+	if ca := cache.Get(&q); ca != nil {
+		t.Fatalf("Answer with 0 minTTL stored/returned: %#v", ca)
+	}
+}
+
+func TestShardedCacheExpiredSignatures(t *testing.T) {
+	fc := clock.NewFake()
+	fc.Set(time.Unix(time.Now().Unix(), 0))
+	cache := newShardedCache(1, fc)
+
+	q := Question{Name: "testing", Type: dns.TypeA}
+	a := &Answer{
+		Answer: []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Ttl: 3600}, A: net.IP{1, 2, 3, 4}},
+			&dns.RRSIG{Hdr: dns.RR_Header{Ttl: 3600}, Expiration: uint32(fc.Now().Add(time.Minute).Unix())},
+		},
+		Security: Secure,
+	}
+	cache.Add(&q, a, false)
+	if cache.Get(&q) == nil {
+		t.Fatal("Cache didn't return answer with valid signatures")
+	}
+	fc.Add(2 * time.Minute)
+	if ca := cache.Get(&q); ca != nil {
+		t.Fatalf("Cache returned Secure answer with expired signatures: %#v", ca)
+	}
+	if entries, expiring := shardedLen(cache); entries != 0 || expiring != 0 {
+		t.Fatalf("Answer with expired signatures wasn't removed: %d answers, %d expiring", entries, expiring)
+	}
+}
+
+func BenchmarkShardedCache(b *testing.B) {
+	benchmarkCache(b, newShardedCache(0, clock.Default()), 10000)
+}
+
+func BenchmarkBasicCacheAdd(b *testing.B) {
+	benchmarkCache(b, &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: clock.Default()}, 1<<20)
+}
+
+func BenchmarkShardedCacheAdd(b *testing.B) {
+	benchmarkCache(b, newShardedCache(0, clock.Default()), 1<<20)
+}
@@ -0,0 +1,190 @@
+package solvere
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
+)
+
+var (
+	ErrUnknownSnapshotVersion = errors.New("solvere: Unknown cache snapshot version")
+	ErrInvalidSnapshotRecords = errors.New("solvere: Malformed records in cache snapshot")
+)
+
+// CacheEntry is a answer stored in a cache along with the question it answers
+type CacheEntry struct {
+	Question Question
+	Answer   *Answer
+	// Expires is ignored if the answer is kept forever
+	Expires time.Time
+	Forever bool
+}
+
+// PersistentCache is a QuestionAnswerCache whose contents can be written out
+// with SaveCache and read back in with LoadCache. Like Get, Entries returns
+// copies of the answers with TTLs reduced by the time they have been cached.
+type PersistentCache interface {
+	QuestionAnswerCache
+	Entries() []CacheEntry
+	Restore(entry CacheEntry)
+}
+
+// restoreTTL returns the number of seconds left before entry expires, or false
+// if it already has
+func restoreTTL(entry CacheEntry, clk clock.Clock) (int, bool) {
+	if entry.Forever {
+		return 0, true
+	}
+	ttl := int(entry.Expires.Sub(clk.Now()) / time.Second)
+	return ttl, ttl > 0
+}
+
+const cacheSnapshotVersion = 1
+
+// snapshotEntry is a CacheEntry as stored in a snapshot, the sections of the
+// answer are in uncompressed wire format and TTL is the number of seconds
+// left before the answer expired when the snapshot was saved
+type snapshotEntry struct {
+	Name             string
+	Type             uint16
+	Class            uint16 `json:",omitempty"`
+	CheckingDisabled bool   `json:",omitempty"`
+	TTL              int64  `json:",omitempty"`
+	Forever          bool   `json:",omitempty"`
+	Rcode            int
+	Security         SecurityStatus
+	SecurityReason   string `json:",omitempty"`
+	SecurityZone     string `json:",omitempty"`
+	Answer           []byte `json:",omitempty"`
+	Authority        []byte `json:",omitempty"`
+	Additional       []byte `json:",omitempty"`
+	Chain            []byte `json:",omitempty"`
+}
+
+type cacheSnapshot struct {
+	Version int
+	Saved   time.Time
+	Entries []snapshotEntry
+}
+
+func packSection(rrs []dns.RR) ([]byte, error) {
+	length := 0
+	for _, r := range rrs {
+		length += dns.Len(r)
+	}
+	buf := make([]byte, length)
+	off := 0
+	for _, r := range rrs {
+		var err error
+		off, err = dns.PackRR(r, buf, off, nil, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf[:off], nil
+}
+
+func unpackSection(data []byte) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for off := 0; off < len(data); {
+		r, next, err := dns.UnpackRR(data, off)
+		if err != nil {
+			return nil, err
+		}
+		if next <= off {
+			return nil, ErrInvalidSnapshotRecords
+		}
+		rrs = append(rrs, r)
+		off = next
+	}
+	return rrs, nil
+}
+
+// SaveCache writes the answers in cache to w in a versioned format that can be
+// read by LoadCache, along with how long each has left before it expires
+func SaveCache(w io.Writer, cache PersistentCache, now time.Time) error {
+	snapshot := cacheSnapshot{Version: cacheSnapshotVersion, Saved: now, Entries: []snapshotEntry{}}
+	for _, e := range cache.Entries() {
+		se := snapshotEntry{
+			Name:             e.Question.Name,
+			Type:             e.Question.Type,
+			Class:            e.Question.Class,
+			CheckingDisabled: e.Question.CheckingDisabled,
+			Forever:          e.Forever,
+			Rcode:            e.Answer.Rcode,
+			Security:         e.Answer.Security,
+			SecurityReason:   e.Answer.SecurityReason,
+			SecurityZone:     e.Answer.SecurityZone,
+		}
+		if !e.Forever {
+			se.TTL = int64(e.Expires.Sub(now) / time.Second)
+			if se.TTL <= 0 {
+				continue
+			}
+		}
+		sections := []*[]byte{&se.Answer, &se.Authority, &se.Additional, &se.Chain}
+		for i, rrs := range [][]dns.RR{e.Answer.Answer, e.Answer.Authority, e.Answer.Additional, e.Answer.Chain} {
+			data, err := packSection(rrs)
+			if err != nil {
+				return err
+			}
+			*sections[i] = data
+		}
+		snapshot.Entries = append(snapshot.Entries, se)
+	}
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
+// LoadCache reads answers written by SaveCache from r and restores them into
+// cache, dropping any that expired since the snapshot was saved. It returns the
+// number of answers that were restored.
+func LoadCache(r io.Reader, cache PersistentCache, now time.Time) (int, error) {
+	var snapshot cacheSnapshot
+	err := json.NewDecoder(r).Decode(&snapshot)
+	if err != nil {
+		return 0, err
+	}
+	if snapshot.Version != cacheSnapshotVersion {
+		return 0, ErrUnknownSnapshotVersion
+	}
+	elapsed := now.Sub(snapshot.Saved)
+	restored := 0
+	for _, se := range snapshot.Entries {
+		entry := CacheEntry{
+			Question: Question{Name: se.Name, Type: se.Type, Class: se.Class, CheckingDisabled: se.CheckingDisabled},
+			Answer: &Answer{
+				Rcode:          se.Rcode,
+				Security:       se.Security,
+				SecurityReason: se.SecurityReason,
+				SecurityZone:   se.SecurityZone,
+			},
+			Forever: se.Forever,
+		}
+		if !se.Forever {
+			remaining := time.Duration(se.TTL)*time.Second - elapsed
+			if remaining <= 0 {
+				continue
+			}
+			entry.Expires = now.Add(remaining)
+		}
+		sections := []*[]dns.RR{&entry.Answer.Answer, &entry.Answer.Authority, &entry.Answer.Additional, &entry.Answer.Chain}
+		for i, data := range [][]byte{se.Answer, se.Authority, se.Additional, se.Chain} {
+			rrs, err := unpackSection(data)
+			if err != nil {
+				return restored, err
+			}
+			if !se.Forever && elapsed > 0 {
+				rrs = agedRecords(rrs, uint32(elapsed/time.Second))
+			}
+			*sections[i] = rrs
+		}
+		cache.Restore(entry)
+		restored++
+	}
+	return restored, nil
+}
@@ -0,0 +1,89 @@
+package solvere
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	for name, newCache := range testCaches {
+		fc := clock.NewFake()
+		fc.Set(time.Unix(time.Now().Unix(), 0))
+		opts := CacheOptions{Clock: fc, PruneInterval: -1, Eviction: Evict2Q}
+		cache := newCache(opts)
+
+		pinned := Question{Name: "pinned.", Type: dns.TypeDNSKEY}
+		cache.Add(&pinned, lruAnswer(5), true)
+		long := Question{Name: "long.", Type: dns.TypeA}
+		cache.Add(&long, &Answer{
+			Answer: []dns.RR{
+				&dns.A{Hdr: dns.RR_Header{Name: "long.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.IP{1, 2, 3, 4}},
+				&dns.RRSIG{Hdr: dns.RR_Header{Name: "long.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600}, TypeCovered: dns.TypeA, SignerName: ".", Expiration: uint32(fc.Now().Add(time.Hour * 2).Unix()), Signature: "AAAA"},
+			},
+			Authority:    []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: "a.root-servers.net."}},
+			Security:     Secure,
+			SecurityZone: ".",
+		}, false)
+		short := Question{Name: "short.", Type: dns.TypeA}
+		cache.Add(&short, lruAnswer(30), false)
+
+		buf := new(bytes.Buffer)
+		fc.Add(time.Second * 10)
+		err := SaveCache(buf, cache, fc.Now())
+		if err != nil {
+			t.Fatalf("%s: SaveCache failed: %s", name, err)
+		}
+
+		// answers that expire while the resolver isn't running are dropped
+		fc.Add(time.Minute)
+		restored := newCache(opts)
+		n, err := LoadCache(bytes.NewReader(buf.Bytes()), restored, fc.Now())
+		if err != nil {
+			t.Fatalf("%s: LoadCache failed: %s", name, err)
+		}
+		if n != 2 {
+			t.Fatalf("%s: LoadCache restored %d answers, expected 2", name, n)
+		}
+		if restored.Get(&short) != nil {
+			t.Fatalf("%s: LoadCache restored expired answer", name)
+		}
+		if restored.Get(&pinned) == nil {
+			t.Fatalf("%s: LoadCache didn't restore answer kept forever", name)
+		}
+		a := restored.Get(&long)
+		if a == nil {
+			t.Fatalf("%s: LoadCache didn't restore answer", name)
+		}
+		if len(a.Answer) != 2 || len(a.Authority) != 1 || a.Security != Secure || a.SecurityZone != "." {
+			t.Fatalf("%s: LoadCache restored wrong answer: %#v", name, a)
+		}
+		if ttl := a.Answer[0].Header().Ttl; ttl != 3600-70 {
+			t.Fatalf("%s: Restored answer has TTL %d, expected %d", name, ttl, 3600-70)
+		}
+		for _, e := range restored.Entries() {
+			if e.Question == long && e.Expires != fc.Now().Add(time.Second*(3600-70)) {
+				t.Fatalf("%s: Restored answer expires at %s, expected %s", name, e.Expires, fc.Now().Add(time.Second*(3600-70)))
+			}
+		}
+		fc.Add(time.Hour)
+		if restored.Get(&long) != nil {
+			t.Fatalf("%s: Restored answer didn't expire", name)
+		}
+	}
+
+	_, err := LoadCache(strings.NewReader(`{"Version": 2}`), newShardedCache(1, clock.NewFake()), time.Now())
+	if err != ErrUnknownSnapshotVersion {
+		t.Fatalf("LoadCache didn't fail with ErrUnknownSnapshotVersion: %v", err)
+	}
+	_, err = LoadCache(strings.NewReader(`{"Version": 1, "Entries": [{"Name": "a.", "Forever": true, "Answer": "AAAA"}]}`), newShardedCache(1, clock.NewFake()), time.Now())
+	if err == nil {
+		t.Fatal("LoadCache didn't fail with malformed records")
+	}
+}
@@ -0,0 +1,69 @@
+package solvere
+
+import (
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var ErrInvalidStubZone = errors.New("solvere: Stub zones need a valid name and at least one nameserver address")
+
+// AddStubZone makes lookups for names at or below zone start by querying the
+// nameservers at addrs, which must be authoritative for it, instead of
+// following referrals from the root. This allows resolving zones that aren't
+// delegated from the root. Answers from a stub zone can only be Secure if
+// trust anchors for it, or a zone below it, have been added with
+// AddTrustAnchors. It should be called before the resolver is used.
+func (rr *RecursiveResolver) AddStubZone(zone string, addrs []string) error {
+	if _, ok := dns.IsDomainName(zone); !ok || zone == "" || len(addrs) == 0 {
+		return ErrInvalidStubZone
+	}
+	zone = strings.ToLower(dns.Fqdn(zone))
+	nameservers := make([]Nameserver, len(addrs))
+	for i, addr := range addrs {
+		if net.ParseIP(addr) == nil {
+			return ErrInvalidStubZone
+		}
+		nameservers[i] = Nameserver{Name: addr, Addr: addr, Zone: zone}
+	}
+	if rr.stubZones == nil {
+		rr.stubZones = make(map[string][]Nameserver)
+	}
+	rr.stubZones[zone] = nameservers
+	return nil
+}
+
+// startAuthority returns the nameserver a lookup for name starts at, one of
+// the nameservers for the closest stub zone enclosing it or a root nameserver
+func (rr *RecursiveResolver) startAuthority(name string) *Nameserver {
+	if len(rr.stubZones) > 0 {
+		name = strings.ToLower(dns.Fqdn(name))
+		for _, i := range append(dns.Split(name), len(name)-1) {
+			if nameservers := rr.stubZones[name[i:]]; len(nameservers) > 0 {
+				return &nameservers[mrand.Intn(len(nameservers))]
+			}
+		}
+	}
+	return &rr.rootNameservers[mrand.Intn(len(rr.rootNameservers))]
+}
+
+// startLookup returns the nameserver a lookup for q starts at along with the
+// initial security state and DS records from initialSecurity. If the lookup
+// starts at a stub zone below the zone validation would start at the zones
+// in between are never seen so the answer can't be validated.
+func (rr *RecursiveResolver) startLookup(q *Question) (*Nameserver, securityState, []dns.RR) {
+	authority := rr.startAuthority(q.Name)
+	chain, parentDSSet := rr.initialSecurity(q)
+	if chain.status == Secure && !isSubDomain(authority.Zone, chain.zone) {
+		return authority, securityState{
+			status: Indeterminate,
+			reason: fmt.Sprintf("no trust anchor for the stub zone %s", authority.Zone),
+			zone:   authority.Zone,
+		}, nil
+	}
+	return authority, chain, parentDSSet
+}
@@ -0,0 +1,90 @@
+package solvere
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/rolandshoemaker/solvere/dnstest"
+)
+
+var stubZones = []dnstest.Zone{
+	{Name: "."},
+	{Name: "com."},
+	{Name: "corp.", Undelegated: true, Records: `
+www       IN A     192.0.2.1
+`},
+	{Name: "dev.corp.", Records: `
+www       IN A     192.0.2.2
+`},
+}
+
+func TestAddStubZone(t *testing.T) {
+	rr := &RecursiveResolver{}
+	for _, tc := range []struct {
+		zone  string
+		addrs []string
+	}{
+		{"", []string{"192.0.2.1"}},
+		{"corp.", nil},
+		{"corp.", []string{"ns.corp."}},
+	} {
+		if err := rr.AddStubZone(tc.zone, tc.addrs); err != ErrInvalidStubZone {
+			t.Fatalf("AddStubZone(%q, %v) returned %v, expected ErrInvalidStubZone", tc.zone, tc.addrs, err)
+		}
+	}
+	if err := rr.AddStubZone("Corp", []string{"192.0.2.1", "2001:db8::1"}); err != nil {
+		t.Fatalf("AddStubZone failed: %s", err)
+	}
+	if ns := rr.startAuthority("www.dev.corp."); ns.Zone != "corp." {
+		t.Fatalf("startAuthority returned a nameserver for %q, expected corp.", ns.Zone)
+	}
+}
+
+func TestLookupStubZone(t *testing.T) {
+	testCases := []struct {
+		name     string
+		anchor   string
+		qname    string
+		rcode    int
+		security SecurityStatus
+		zone     string
+	}{
+		{"no anchor", "", "www.corp.", dns.RcodeSuccess, Indeterminate, "corp."},
+		{"no anchor", "", "www.dev.corp.", dns.RcodeSuccess, Indeterminate, "corp."},
+		{"stub anchor", "corp.", "www.corp.", dns.RcodeSuccess, Secure, "corp."},
+		{"stub anchor", "corp.", "missing.corp.", dns.RcodeNameError, Secure, "corp."},
+		{"stub anchor", "corp.", "www.dev.corp.", dns.RcodeSuccess, Secure, "dev.corp."},
+		{"child anchor", "dev.corp.", "www.dev.corp.", dns.RcodeSuccess, Secure, "dev.corp."},
+		{"child anchor", "dev.corp.", "www.corp.", dns.RcodeSuccess, Indeterminate, "corp."},
+	}
+	h, _ := newTestHierarchy(t, stubZones)
+	defer h.Close()
+	for _, tc := range testCases {
+		rr := NewRecursiveResolver(false, true, h.Hints, h.TrustAnchors, nil)
+		if err := rr.AddStubZone("corp.", []string{h.Address("corp.")}); err != nil {
+			t.Fatalf("AddStubZone failed: %s", err)
+		}
+		if tc.anchor != "" {
+			ksk, _ := h.Keys(tc.anchor)
+			if err := rr.AddTrustAnchors([]dns.RR{ksk}); err != nil {
+				t.Fatalf("AddTrustAnchors failed: %s", err)
+			}
+		}
+		a, ll, err := rr.Lookup(context.Background(), Question{Name: tc.qname, Type: dns.TypeA})
+		if err != nil {
+			t.Fatalf("%s: Lookup for %s failed: %s", tc.name, tc.qname, err)
+		}
+		if a.Rcode != tc.rcode || a.Security != tc.security || a.SecurityZone != tc.zone {
+			t.Fatalf("%s: Lookup for %s returned %s, %s at %q (%q), expected %s, %s at %q", tc.name, tc.qname,
+				dns.RcodeToString[a.Rcode], a.Security, a.SecurityZone, ll.SecurityReason,
+				dns.RcodeToString[tc.rcode], tc.security, tc.zone)
+		}
+		if tc.security == Indeterminate && (a.EDE == nil || a.EDE.InfoCode != EDEDNSSECIndeterminate || ll.EDE != a.EDE) {
+			t.Fatalf("%s: Lookup for %s returned a Indeterminate answer with extended error %v", tc.name, tc.qname, a.EDE)
+		} else if tc.security == Secure && a.EDE != nil {
+			t.Fatalf("%s: Lookup for %s returned a Secure answer with extended error %v", tc.name, tc.qname, a.EDE)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package solvere
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"github.com/miekg/dns"
+)
+
+var (
+	ErrNoTrustAnchors        = errors.New("solvere: No valid trust anchors")
+	ErrUnknownStateVersion   = errors.New("solvere: Unknown trust anchor state file version")
+	ErrInvalidTrustAnchorKey = errors.New("solvere: Trust anchor state contains a invalid DNSKEY")
+)
+
+// TrustAnchorState is the state of a trust anchor as defined in RFC 5011
+// Section 4
+type TrustAnchorState int
+
+const (
+	// AddPending means a new key has been seen but hasn't been present for
+	// the add hold-down time yet
+	AddPending TrustAnchorState = iota + 1
+	// Valid means the key is used as a trust anchor
+	Valid
+	// Missing means a valid key is no longer in the DNSKEY RRset but wasn't
+	// revoked, it is still used as a trust anchor
+	Missing
+	// Revoked means the key has been revoked and is no longer used as a trust
+	// anchor, after the remove hold-down time it is removed
+	Revoked
+)
+
+var trustAnchorStateToString = map[TrustAnchorState]string{
+	AddPending: "AddPending",
+	Valid:      "Valid",
+	Missing:    "Missing",
+	Revoked:    "Revoked",
+}
+
+var stringToTrustAnchorState = map[string]TrustAnchorState{
+	"AddPending": AddPending,
+	"Valid":      Valid,
+	"Missing":    Missing,
+	"Revoked":    Revoked,
+}
+
+func (s TrustAnchorState) String() string {
+	if str, present := trustAnchorStateToString[s]; present {
+		return str
+	}
+	return fmt.Sprintf("TrustAnchorState(%d)", int(s))
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (s TrustAnchorState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (s *TrustAnchorState) UnmarshalText(text []byte) error {
+	state, present := stringToTrustAnchorState[string(text)]
+	if !present {
+		return fmt.Errorf("solvere: Unknown trust anchor state %q", text)
+	}
+	*s = state
+	return nil
+}
+
+var (
+	// DefaultAddHoldDown is the time a new key must be seen for before it is
+	// trusted (RFC 5011 Section 2.4.1)
+	DefaultAddHoldDown = 30 * 24 * time.Hour
+	// DefaultRemoveHoldDown is the time a revoked key is kept for before it is
+	// removed (RFC 5011 Section 2.4.2)
+	DefaultRemoveHoldDown = 30 * 24 * time.Hour
+)
+
+// TrustAnchor describes a key tracked by a TrustAnchorManager
+type TrustAnchor struct {
+	Key     *dns.DNSKEY
+	State   TrustAnchorState
+	Changed time.Time
+}
+
+type trustAnchorJSON struct {
+	Key     string
+	State   TrustAnchorState
+	Changed time.Time
+}
+
+const trustAnchorStateVersion = 1
+
+type trustAnchorFile struct {
+	Version int
+	Anchors []trustAnchorJSON
+}
+
+// TrustAnchorManager keeps the root trust anchors up to date by following key
+// rollovers using the automated trust anchor update mechanism described in
+// RFC 5011. If a path is given the state is persisted to it after every
+// change.
+type TrustAnchorManager struct {
+	AddHoldDown    time.Duration
+	RemoveHoldDown time.Duration
+
+	mu      sync.RWMutex
+	anchors map[string]*TrustAnchor
+	path    string
+	clk     clock.Clock
+}
+
+// keyID identifies a key independently of its flags so a key can be matched
+// with its revoked version
+func keyID(k *dns.DNSKEY) string {
+	return fmt.Sprintf("%d %d %s", k.Protocol, k.Algorithm, k.PublicKey)
+}
+
+// NewTrustAnchorManager returns a initialized TrustAnchorManager. If the file at
+// path exists the state is loaded from it, otherwise the DNSKEY records in
+// initial are used as the Valid trust anchors. If path is empty the state isn't
+// persisted. If the initial state can't be saved the manager is returned along
+// with the error so it can still be used.
+func NewTrustAnchorManager(initial []dns.RR, path string, clk clock.Clock) (*TrustAnchorManager, error) {
+	tam := &TrustAnchorManager{
+		AddHoldDown:    DefaultAddHoldDown,
+		RemoveHoldDown: DefaultRemoveHoldDown,
+		anchors:        make(map[string]*TrustAnchor),
+		path:           path,
+		clk:            clk,
+	}
+	if path != "" {
+		err := tam.load()
+		if err == nil {
+			return tam, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	for _, r := range initial {
+		if k, ok := r.(*dns.DNSKEY); ok && k.Flags&dns.SEP != 0 && k.Flags&dns.REVOKE == 0 {
+			tam.anchors[keyID(k)] = &TrustAnchor{Key: k, State: Valid, Changed: clk.Now()}
+		}
+	}
+	if len(tam.anchors) == 0 {
+		return nil, ErrNoTrustAnchors
+	}
+	return tam, tam.save()
+}
+
+func (tam *TrustAnchorManager) load() error {
+	data, err := ioutil.ReadFile(tam.path)
+	if err != nil {
+		return err
+	}
+	var f trustAnchorFile
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return err
+	}
+	if f.Version != trustAnchorStateVersion {
+		return ErrUnknownStateVersion
+	}
+	for _, a := range f.Anchors {
+		r, err := dns.NewRR(a.Key)
+		if err != nil {
+			return err
+		}
+		k, ok := r.(*dns.DNSKEY)
+		if !ok {
+			return ErrInvalidTrustAnchorKey
+		}
+		tam.anchors[keyID(k)] = &TrustAnchor{Key: k, State: a.State, Changed: a.Changed}
+	}
+	return nil
+}
+
+// save writes the state to a temporary file and renames it so a crash can't
+// leave a partially written state file. It must be called with mu held.
+func (tam *TrustAnchorManager) save() error {
+	if tam.path == "" {
+		return nil
+	}
+	f := trustAnchorFile{Version: trustAnchorStateVersion, Anchors: []trustAnchorJSON{}}
+	for _, a := range tam.list() {
+		f.Anchors = append(f.Anchors, trustAnchorJSON{Key: a.Key.String(), State: a.State, Changed: a.Changed})
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(tam.path), filepath.Base(tam.path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), tam.path)
+}
+
+func (tam *TrustAnchorManager) list() []TrustAnchor {
+	anchors := []TrustAnchor{}
+	for _, a := range tam.anchors {
+		anchors = append(anchors, *a)
+	}
+	sort.Slice(anchors, func(i, j int) bool { return anchors[i].Key.KeyTag() < anchors[j].Key.KeyTag() })
+	return anchors
+}
+
+// List returns all of the keys being tracked and their states
+func (tam *TrustAnchorManager) List() []TrustAnchor {
+	tam.mu.RLock()
+	defer tam.mu.RUnlock()
+	return tam.list()
+}
+
+// Anchors returns the keys that should currently be used as trust anchors,
+// those in the Valid or Missing states
+func (tam *TrustAnchorManager) Anchors() []dns.RR {
+	anchors := []dns.RR{}
+	for _, a := range tam.List() {
+		if a.State == Valid || a.State == Missing {
+			anchors = append(anchors, a.Key)
+		}
+	}
+	return anchors
+}
+
+// isSelfSigned checks that the DNSKEY RRset in answer is signed by k
+func isSelfSigned(k *dns.DNSKEY, answer []dns.RR) bool {
+	keys := extractRRSet(answer, k.Hdr.Name, dns.TypeDNSKEY)
+	tag := k.KeyTag()
+	for _, r := range extractRRSet(answer, k.Hdr.Name, dns.TypeRRSIG) {
+		sig := r.(*dns.RRSIG)
+		if sig.TypeCovered == dns.TypeDNSKEY && sig.KeyTag == tag && sig.Verify(k, keys) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Update moves keys between states using a DNSKEY RRset (and its signatures)
+// that has already been validated using the current trust anchors, as described
+// in RFC 5011 Section 4
+func (tam *TrustAnchorManager) Update(answer []dns.RR) error {
+	tam.mu.Lock()
+	defer tam.mu.Unlock()
+	now := tam.clk.Now()
+
+	seen := map[string]struct{}{}
+	for _, r := range extractRRSet(answer, ".", dns.TypeDNSKEY) {
+		k := r.(*dns.DNSKEY)
+		if k.Flags&dns.SEP == 0 {
+			continue
+		}
+		id := keyID(k)
+		seen[id] = struct{}{}
+		a, present := tam.anchors[id]
+		if k.Flags&dns.REVOKE != 0 {
+			// a revoked key must sign the DNSKEY RRset itself
+			if !present || a.State == Revoked || !isSelfSigned(k, answer) {
+				continue
+			}
+			if a.State == AddPending {
+				delete(tam.anchors, id)
+				continue
+			}
+			a.Key, a.State, a.Changed = k, Revoked, now
+			continue
+		}
+		if !present {
+			tam.anchors[id] = &TrustAnchor{Key: k, State: AddPending, Changed: now}
+			continue
+		}
+		switch a.State {
+		case AddPending:
+			if now.Sub(a.Changed) >= tam.AddHoldDown {
+				a.State, a.Changed = Valid, now
+			}
+		case Missing:
+			a.State, a.Changed = Valid, now
+		}
+	}
+
+	for id, a := range tam.anchors {
+		if _, present := seen[id]; present && a.State != Revoked {
+			continue
+		}
+		switch a.State {
+		case AddPending:
+			// the hold-down restarts if the key is seen again
+			delete(tam.anchors, id)
+		case Valid:
+			a.State, a.Changed = Missing, now
+		case Revoked:
+			if now.Sub(a.Changed) >= tam.RemoveHoldDown {
+				delete(tam.anchors, id)
+			}
+		}
+	}
+	return tam.save()
+}
+
+// Refresh fetches the root DNSKEY RRset from one of the root nameservers used by
+// rr, validates it using the current trust anchors, and updates the state of
+// the anchors. It should be called periodically, RFC 5011 Section 2.3 suggests
+// at least every 15 days.
+func (tam *TrustAnchorManager) Refresh(ctx context.Context, rr *RecursiveResolver) error {
+	auth := rr.rootNameservers[rand.Intn(len(rr.rootNameservers))]
+	m := new(dns.Msg)
+	m.SetEdns0(4096, true)
+	m.Question = []dns.Question{{Name: ".", Qtype: dns.TypeDNSKEY, Qclass: dns.ClassINET}}
+	r, _, err := rr.c.Exchange(m, net.JoinHostPort(auth.Addr, dnsPort))
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) == 0 {
+		return ErrNoDNSKEY
+	}
+	anchors := rr.algorithms.usableDS(trustAnchorDS(tam.Anchors()))
+	sepKeys, err := checkDS(zoneKeys(r.Answer), anchors)
+	if err != nil {
+		return err
+	}
+	_, err = rr.validator().verifyDNSKEYSet(r.Answer, ".", sepKeys)
+	if err != nil {
+		return err
+	}
+	return tam.Update(r.Answer)
+}
@@ -0,0 +1,209 @@
+package solvere
+
+import (
+	"context"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"github.com/miekg/dns"
+)
+
+// mockRoot serves a root DNSKEY RRset that can be changed during a test
+type mockRoot struct {
+	mu     sync.Mutex
+	answer []dns.RR
+}
+
+func (mr *mockRoot) publish(now time.Time, keys []*dns.DNSKEY, signers map[*dns.DNSKEY]*rsa.PrivateKey) {
+	rrset := []dns.RR{}
+	for _, k := range keys {
+		rrset = append(rrset, k)
+	}
+	answer := []dns.RR{}
+	for _, r := range rrset {
+		// the test keeps using the keys so the server gets its own copies
+		answer = append(answer, dns.Copy(r))
+	}
+	for k, pk := range signers {
+		answer = append(answer, signAt(k, pk, rrset, now))
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	mr.answer = answer
+}
+
+func (mr *mockRoot) handler(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	mr.mu.Lock()
+	m.Answer = mr.answer
+	// packing the message writes to the records so it can't be shared
+	// between concurrent queries
+	m = m.Copy()
+	mr.mu.Unlock()
+	w.WriteMsg(m)
+}
+
+func newRootKey(flags uint16) (*dns.DNSKEY, *rsa.PrivateKey) {
+	k, pk := newTestKey(".", flags)
+	k.Hdr.Class = dns.ClassINET
+	return k, pk
+}
+
+func anchorStates(tam *TrustAnchorManager) map[uint16]TrustAnchorState {
+	states := map[uint16]TrustAnchorState{}
+	for _, a := range tam.List() {
+		states[a.Key.KeyTag()] = a.State
+	}
+	return states
+}
+
+func TestTrustAnchorRollover(t *testing.T) {
+	root := &mockRoot{}
+	defer startMockServer(t, root.handler)()
+
+	dir, err := ioutil.TempDir("", "solvere-anchors")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "anchors.json")
+
+	fc := clock.NewFake()
+	fc.Set(time.Now())
+	rr := &RecursiveResolver{
+		useDNSSEC:       true,
+		c:               new(dns.Client),
+		rootNameservers: []Nameserver{{Name: "a.root.", Addr: "127.0.0.1", Zone: "."}},
+		clk:             fc,
+	}
+
+	oldKSK, oldKSKPrivate := newRootKey(dns.ZONE | dns.SEP)
+	newKSK, newKSKPrivate := newRootKey(dns.ZONE | dns.SEP)
+	zsk, _ := newRootKey(dns.ZONE)
+
+	tam, err := NewTrustAnchorManager([]dns.RR{oldKSK, zsk}, path, fc)
+	if err != nil {
+		t.Fatalf("NewTrustAnchorManager failed: %s", err)
+	}
+	rr.SetTrustAnchorManager(tam)
+	if anchors := tam.Anchors(); len(anchors) != 1 || anchors[0] != oldKSK {
+		t.Fatalf("TrustAnchorManager has wrong initial anchors: %v", anchors)
+	}
+
+	// A new key signed by the current anchor is added pending the hold-down
+	root.publish(fc.Now(), []*dns.DNSKEY{oldKSK, newKSK, zsk}, map[*dns.DNSKEY]*rsa.PrivateKey{oldKSK: oldKSKPrivate})
+	err = tam.Refresh(context.Background(), rr)
+	if err != nil {
+		t.Fatalf("Refresh failed: %s", err)
+	}
+	states := anchorStates(tam)
+	if states[oldKSK.KeyTag()] != Valid || states[newKSK.KeyTag()] != AddPending {
+		t.Fatalf("Unexpected states after new key published: %v", states)
+	}
+	if len(tam.Anchors()) != 1 {
+		t.Fatal("Key pending addition is used as a trust anchor")
+	}
+
+	// Once the hold-down has passed it becomes valid
+	fc.Add(DefaultAddHoldDown + time.Hour)
+	root.publish(fc.Now(), []*dns.DNSKEY{oldKSK, newKSK, zsk}, map[*dns.DNSKEY]*rsa.PrivateKey{oldKSK: oldKSKPrivate})
+	err = tam.Refresh(context.Background(), rr)
+	if err != nil {
+		t.Fatalf("Refresh failed: %s", err)
+	}
+	states = anchorStates(tam)
+	if states[newKSK.KeyTag()] != Valid {
+		t.Fatalf("New key isn't valid after the add hold-down: %v", states)
+	}
+
+	// The old key is revoked, signing the RRset itself
+	revokedKSK := dns.Copy(oldKSK).(*dns.DNSKEY)
+	revokedKSK.Flags |= dns.REVOKE
+	fc.Add(time.Hour)
+	root.publish(fc.Now(), []*dns.DNSKEY{revokedKSK, newKSK, zsk}, map[*dns.DNSKEY]*rsa.PrivateKey{revokedKSK: oldKSKPrivate, newKSK: newKSKPrivate})
+	err = tam.Refresh(context.Background(), rr)
+	if err != nil {
+		t.Fatalf("Refresh failed: %s", err)
+	}
+	if anchors := tam.Anchors(); len(anchors) != 1 || anchors[0].(*dns.DNSKEY).PublicKey != newKSK.PublicKey {
+		t.Fatalf("Revoked key is still used as a trust anchor: %v", anchors)
+	}
+
+	// State is persisted
+	loaded, err := NewTrustAnchorManager(nil, path, fc)
+	if err != nil {
+		t.Fatalf("Failed to load trust anchor state: %s", err)
+	}
+	if len(loaded.List()) != 2 || len(loaded.Anchors()) != 1 || loaded.Anchors()[0].(*dns.DNSKEY).PublicKey != newKSK.PublicKey {
+		t.Fatalf("Loaded trust anchor state doesn't match saved state: %v", loaded.List())
+	}
+
+	// After the remove hold-down the revoked key is forgotten
+	fc.Add(DefaultRemoveHoldDown + time.Hour)
+	root.publish(fc.Now(), []*dns.DNSKEY{newKSK, zsk}, map[*dns.DNSKEY]*rsa.PrivateKey{newKSK: newKSKPrivate})
+	err = tam.Refresh(context.Background(), rr)
+	if err != nil {
+		t.Fatalf("Refresh failed: %s", err)
+	}
+	if list := tam.List(); len(list) != 1 {
+		t.Fatalf("Revoked key wasn't removed after the remove hold-down: %v", list)
+	}
+
+	// A RRset that isn't signed by a trust anchor is ignored
+	rogueKSK, rogueKSKPrivate := newRootKey(dns.ZONE | dns.SEP)
+	root.publish(fc.Now(), []*dns.DNSKEY{newKSK, rogueKSK, zsk}, map[*dns.DNSKEY]*rsa.PrivateKey{rogueKSK: rogueKSKPrivate})
+	err = tam.Refresh(context.Background(), rr)
+	if err == nil {
+		t.Fatal("Refresh didn't fail with a DNSKEY RRset not signed by a trust anchor")
+	}
+	if list := tam.List(); len(list) != 1 {
+		t.Fatalf("Unauthenticated key was added: %v", list)
+	}
+}
+
+func TestTrustAnchorMissing(t *testing.T) {
+	fc := clock.NewFake()
+	ksk, _ := newRootKey(dns.ZONE | dns.SEP)
+	tam, err := NewTrustAnchorManager([]dns.RR{ksk}, "", fc)
+	if err != nil {
+		t.Fatalf("NewTrustAnchorManager failed: %s", err)
+	}
+	// A key that disappears without being revoked is still trusted
+	err = tam.Update(nil)
+	if err != nil {
+		t.Fatalf("Update failed: %s", err)
+	}
+	if states := anchorStates(tam); states[ksk.KeyTag()] != Missing || len(tam.Anchors()) != 1 {
+		t.Fatalf("Key that disappeared isn't Missing: %v", states)
+	}
+	err = tam.Update([]dns.RR{ksk})
+	if err != nil {
+		t.Fatalf("Update failed: %s", err)
+	}
+	if states := anchorStates(tam); states[ksk.KeyTag()] != Valid {
+		t.Fatalf("Key that reappeared isn't Valid: %v", states)
+	}
+
+	_, err = NewTrustAnchorManager(nil, "", fc)
+	if err != ErrNoTrustAnchors {
+		t.Fatalf("NewTrustAnchorManager didn't fail with ErrNoTrustAnchors: %v", err)
+	}
+
+	// the manager can still be used if its state can't be saved
+	dir, err := ioutil.TempDir("", "solvere-anchors")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	tam, err = NewTrustAnchorManager([]dns.RR{ksk}, filepath.Join(dir, "missing", "anchors.json"), fc)
+	if err == nil || tam == nil || len(tam.Anchors()) != 1 {
+		t.Fatalf("NewTrustAnchorManager with a unwritable path returned %v (%v)", tam, err)
+	}
+}
@@ -0,0 +1,118 @@
+package solvere
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TTLLimits bound the TTLs of cached answers. Min raises the TTL of records
+// that would otherwise be cached for too short a time, or not at all if their
+// TTL is 0, Max lowers the TTL of records that would be cached for too long and
+// NegativeMax does the same for answers that deny a name or type exists. A
+// zero limit isn't applied.
+type TTLLimits struct {
+	Min         time.Duration
+	Max         time.Duration
+	NegativeMax time.Duration
+}
+
+// TTLPolicy clamps the TTLs of answers as they are added to a cache. Zones
+// maps zone names to limits used instead of the default ones for questions
+// about names at or below them, if more than one zone matches the closest one
+// is used.
+type TTLPolicy struct {
+	TTLLimits
+	Zones map[string]TTLLimits
+}
+
+// limits returns the limits for questions about name
+func (p *TTLPolicy) limits(name string) TTLLimits {
+	if len(p.Zones) == 0 {
+		return p.TTLLimits
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, i := range append(dns.Split(name), len(name)-1) {
+		for zone, limits := range p.Zones {
+			if strings.EqualFold(dns.Fqdn(zone), name[i:]) {
+				return limits
+			}
+		}
+	}
+	return p.TTLLimits
+}
+
+// negativeAnswer returns true if answer denies the name or type asked about
+// exists
+func negativeAnswer(answer *Answer) bool {
+	return answer.Rcode == dns.RcodeNameError || (answer.Rcode == dns.RcodeSuccess && len(answer.Answer) == 0)
+}
+
+// clampTTL returns ttl raised to min and lowered to max, in seconds
+func clampTTL(ttl, min, max uint32) uint32 {
+	if min > 0 && ttl < min {
+		ttl = min
+	}
+	if max > 0 && ttl > max {
+		ttl = max
+	}
+	return ttl
+}
+
+// clamp returns a copy of a answer to q with the TTLs of its records clamped
+// to the limits for q, and true, or the answer as is and false if none of
+// them needed to be. The validation chain is left alone since it isn't used to
+// decide how long the answer is cached for.
+func (p *TTLPolicy) clamp(q *Question, answer *Answer) (*Answer, bool) {
+	if p == nil {
+		return answer, false
+	}
+	limits := p.limits(q.Name)
+	max := limits.Max
+	if negativeAnswer(answer) && limits.NegativeMax > 0 && (max == 0 || limits.NegativeMax < max) {
+		max = limits.NegativeMax
+	}
+	minSecs, maxSecs := uint32(limits.Min/time.Second), uint32(max/time.Second)
+	if minSecs == 0 && maxSecs == 0 {
+		return answer, false
+	}
+	clamped := false
+	for _, section := range [][]dns.RR{answer.Answer, answer.Authority, answer.Additional} {
+		for _, r := range section {
+			if hdr := r.Header(); hdr.Rrtype != dns.TypeOPT && clampTTL(hdr.Ttl, minSecs, maxSecs) != hdr.Ttl {
+				clamped = true
+			}
+		}
+	}
+	if !clamped {
+		return answer, false
+	}
+	c := *answer
+	for _, section := range []*[]dns.RR{&c.Answer, &c.Authority, &c.Additional} {
+		if *section == nil {
+			continue
+		}
+		rrs := make([]dns.RR, len(*section))
+		for i, r := range *section {
+			rrs[i] = dns.Copy(r)
+			if hdr := rrs[i].Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl = clampTTL(hdr.Ttl, minSecs, maxSecs)
+			}
+		}
+		*section = rrs
+	}
+	return &c, true
+}
+
+// lower returns a copy of a answer to q with the TTLs of its records lowered
+// to the maximum for q. Unlike clamp TTLs aren't raised to the minimum since
+// the answer is built from records that have already been cached for a while.
+func (p *TTLPolicy) lower(q *Question, answer *Answer) *Answer {
+	if p == nil {
+		return answer
+	}
+	limits := p.limits(q.Name)
+	answer, _ = (&TTLPolicy{TTLLimits: TTLLimits{Max: limits.Max, NegativeMax: limits.NegativeMax}}).clamp(q, answer)
+	return answer
+}
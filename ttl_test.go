@@ -0,0 +1,116 @@
+package solvere
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"github.com/miekg/dns"
+)
+
+func TestTTLPolicyClamp(t *testing.T) {
+	policy := &TTLPolicy{
+		TTLLimits: TTLLimits{Min: time.Minute, Max: time.Hour, NegativeMax: time.Minute * 5},
+		Zones: map[string]TTLLimits{
+			"corp.example.":       {Max: time.Second * 30},
+			"Dev.Corp.example.":   {Min: time.Second * 10},
+			"other.corp.example.": {},
+		},
+	}
+	testCases := []struct {
+		name     string
+		rcode    int
+		ttl      uint32
+		expected uint32
+	}{
+		{"example.com.", dns.RcodeSuccess, 0, 60},
+		{"example.com.", dns.RcodeSuccess, 300, 300},
+		{"example.com.", dns.RcodeSuccess, 86400, 3600},
+		{"example.com.", dns.RcodeNameError, 3600, 300},
+		{"www.corp.example.", dns.RcodeSuccess, 0, 0},
+		{"www.corp.example.", dns.RcodeSuccess, 300, 30},
+		{"a.dev.corp.example", dns.RcodeSuccess, 0, 10},
+		{"a.dev.corp.example", dns.RcodeSuccess, 86400, 86400},
+		{"other.corp.example.", dns.RcodeSuccess, 86400, 86400},
+	}
+	for _, tc := range testCases {
+		q := &Question{Name: tc.name, Type: dns.TypeA}
+		answer := &Answer{Rcode: tc.rcode, Additional: []dns.RR{&dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Ttl: 1 << 15}}}}
+		if tc.rcode == dns.RcodeSuccess {
+			answer.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: tc.name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: tc.ttl}, A: net.IP{192, 0, 2, 1}}}
+		} else {
+			answer.Authority = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: tc.ttl}}}
+		}
+		clamped, ok := policy.clamp(q, answer)
+		records := append(clamped.Answer, clamped.Authority...)
+		if ttl := records[0].Header().Ttl; ttl != tc.expected {
+			t.Fatalf("clamp returned TTL %d for %s with TTL %d, expected %d", ttl, tc.name, tc.ttl, tc.expected)
+		}
+		if ok != (tc.ttl != tc.expected) {
+			t.Fatalf("clamp returned %t for %s with TTL %d", ok, tc.name, tc.ttl)
+		}
+		if ok && append(answer.Answer, answer.Authority...)[0].Header().Ttl != tc.ttl {
+			t.Fatalf("clamp modified the original answer for %s", tc.name)
+		}
+		if clamped.Additional[0].Header().Ttl != 1<<15 {
+			t.Fatalf("clamp modified the flags of a OPT record for %s", tc.name)
+		}
+	}
+
+	var nilPolicy *TTLPolicy
+	answer := lruAnswer(0)
+	if clamped, ok := nilPolicy.clamp(&Question{Name: "example.com."}, answer); ok || clamped != answer {
+		t.Fatal("clamp with no policy modified the answer")
+	}
+}
+
+func TestCacheTTLPolicy(t *testing.T) {
+	policy := &TTLPolicy{
+		TTLLimits: TTLLimits{Min: time.Minute, Max: time.Hour},
+		Zones:     map[string]TTLLimits{"internal.": {Max: time.Second * 10}},
+	}
+	for name, newCache := range testCaches {
+		fc := clock.NewFake()
+		cache := newCache(CacheOptions{Clock: fc, PruneInterval: -1, TTLs: policy})
+
+		// a TTL of 0 would otherwise stop the answer being cached
+		zero := Question{Name: "zero.", Type: dns.TypeA}
+		cache.Add(&zero, lruAnswer(0), false)
+		long := Question{Name: "long.", Type: dns.TypeA}
+		cache.Add(&long, lruAnswer(86400), false)
+		internal := Question{Name: "www.internal.", Type: dns.TypeA}
+		cache.Add(&internal, lruAnswer(300), false)
+		unchanged := Question{Name: "unchanged.", Type: dns.TypeA}
+		cache.Add(&unchanged, lruAnswer(300), false)
+
+		expected := map[string]time.Duration{
+			"zero.":         time.Minute,
+			"long.":         time.Hour,
+			"www.internal.": time.Second * 10,
+			"unchanged.":    time.Minute * 5,
+		}
+		entries := cache.List(".", true)
+		if len(entries) != len(expected) {
+			t.Fatalf("%s: List returned %d answers, expected %d", name, len(entries), len(expected))
+		}
+		for _, e := range entries {
+			if remaining := e.Expires.Sub(fc.Now()); remaining != expected[e.Question.Name] {
+				t.Fatalf("%s: %s expires in %s, expected %s", name, e.Question.Name, remaining, expected[e.Question.Name])
+			}
+			if ttl := time.Duration(e.Answer.Answer[0].Header().Ttl) * time.Second; ttl != expected[e.Question.Name] {
+				t.Fatalf("%s: %s has TTL %s, expected %s", name, e.Question.Name, ttl, expected[e.Question.Name])
+			}
+		}
+		if stats := cache.Stats(); stats.Clamped != 3 {
+			t.Fatalf("%s: Stats returned %d clamped answers, expected 3", name, stats.Clamped)
+		}
+		fc.Add(time.Second * 11)
+		if cache.Get(&internal) != nil {
+			t.Fatalf("%s: answer didn't expire at the zone's max TTL", name)
+		}
+		if cache.Get(&zero) == nil {
+			t.Fatalf("%s: answer expired before the min TTL", name)
+		}
+	}
+}